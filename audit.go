@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	defaultAuditMaxSize    = 100 << 20
+	defaultAuditMaxBackups = 5
+)
+
+// An auditRecord is one client command after login. Message bodies and
+// credentials are never part of it.
+type auditRecord struct {
+	Time     time.Time `json:"ts"`
+	Cid      int64     `json:"cid"`
+	User     string    `json:"user"`
+	Upstream string    `json:"upstream"`
+	Command  string    `json:"command"`
+	// the argument of SELECT STATUS APPEND..., or the selected mailbox
+	Mailbox string `json:"mailbox,omitempty"`
+	// the destination of COPY MOVE RENAME
+	Target string `json:"target,omitempty"`
+	Uids   string `json:"uids,omitempty"`
+	Seqs   string `json:"seqs,omitempty"`
+	// STORE item and flags, like +FLAGS (\Deleted), or APPEND flags
+	Flags      string  `json:"flags,omitempty"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// auditSetArgs are the commands with a sequence or UID set as first argument.
+var auditSetArgs = map[string]bool{
+	"FETCH":   true,
+	"STORE":   true,
+	"COPY":    true,
+	"MOVE":    true,
+	"EXPUNGE": true,
+}
+
+// An auditLog writes records as JSON lines.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	// writes begun by writeAudit, Close waits for them
+	inflight sync.WaitGroup
+}
+
+// newAuditLog returns nil when conf is off.
+func newAuditLog(conf *AuditConf) (*auditLog, error) {
+	if conf.File != "" && conf.Syslog != "" {
+		return nil, errors.New("imap.audit: file and syslog are exclusive")
+	}
+
+	switch {
+	case conf.File != "":
+		w, err := newRotatingFile(conf.File, conf.MaxSize, conf.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("open audit file fail: %w", err)
+		}
+		return &auditLog{w: w}, nil
+
+	case conf.Syslog != "":
+		network, raddr := "", ""
+		if conf.Syslog != "local" {
+			u, err := url.Parse(conf.Syslog)
+			if err != nil {
+				return nil, fmt.Errorf("bad audit syslog: %w", err)
+			}
+			network, raddr = u.Scheme, u.Host
+			if network == "unix" || network == "unixgram" {
+				raddr = u.Path
+			}
+		}
+		w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "mailp-audit")
+		if err != nil {
+			return nil, fmt.Errorf("dial audit syslog fail: %w", err)
+		}
+		return &auditLog{w: w}, nil
+	}
+
+	return nil, nil
+}
+
+func (a *auditLog) write(rec *auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the log once the records in flight to it are written. It is
+// called after the log is no longer the one in use.
+func (a *auditLog) Close() error {
+	a.inflight.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
+
+// A rotatingFile is a file renamed to path.1, path.1 to path.2 and so on
+// when it would grow over maxSize, maxBackups are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultAuditMaxBackups
+	}
+
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// Write is not safe for concurrent use, auditLog serializes it.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
+
+// auditFilter records each command with its completion.
+type auditFilter struct {
+	mp       *Mailp
+	cid      int64
+	user     string
+	upstream string
+
+	mu       sync.Mutex
+	selected string
+	pending  map[string]*auditRecord
+}
+
+func newAuditFilter(mp *Mailp, cid int64, user, upstream string) *auditFilter {
+	return &auditFilter{
+		mp:       mp,
+		cid:      cid,
+		user:     user,
+		upstream: upstream,
+		pending:  map[string]*auditRecord{},
+	}
+}
+
+func (f *auditFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	rec := &auditRecord{
+		Cid:      f.cid,
+		User:     f.user,
+		Upstream: f.upstream,
+		Command:  cmd.Name,
+		Time:     time.Now(),
+	}
+
+	name := strings.TrimPrefix(cmd.Name, "UID ")
+	skip := 2
+	if name != cmd.Name {
+		skip = 3
+	}
+	toks := imapTokens(cmd.Data, skip+4)
+	arg := func(i int) (imapToken, bool) {
+		if skip+i < len(toks) {
+			return toks[skip+i], true
+		}
+		return imapToken{}, false
+	}
+
+	f.mu.Lock()
+	rec.Mailbox = f.selected
+	f.mu.Unlock()
+
+	if idxs, ok := mailboxArgs[cmd.Name]; ok {
+		for n, i := range idxs {
+			tok, ok := arg(i)
+			if !ok {
+				break
+			}
+			if tok.list {
+				// GETMETADATA options
+				continue
+			}
+			if n == 0 && i == 0 {
+				rec.Mailbox = decodeMailbox(tok.value)
+			} else {
+				rec.Target = decodeMailbox(tok.value)
+			}
+		}
+	}
+
+	if auditSetArgs[name] {
+		if tok, ok := arg(0); ok && !tok.list {
+			if name != cmd.Name {
+				rec.Uids = tok.value
+			} else if name != "EXPUNGE" {
+				rec.Seqs = tok.value
+			}
+		}
+	}
+
+	switch name {
+	case "STORE":
+		item, ok1 := arg(1)
+		flags, ok2 := arg(2)
+		if ok1 && ok2 {
+			rec.Flags = item.value + " " + flags.value
+		}
+	case "APPEND":
+		if flags, ok := arg(1); ok && flags.list {
+			rec.Flags = flags.value
+		}
+	}
+
+	f.mu.Lock()
+	f.pending[cmd.Tag] = rec
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *auditFilter) FilterResponse(resp *ProxyResponse) bool {
+	if resp.Tag == "*" || resp.Tag == "+" {
+		return true
+	}
+
+	f.mu.Lock()
+	rec, ok := f.pending[resp.Tag]
+	delete(f.pending, resp.Tag)
+	if ok {
+		switch rec.Command {
+		case "SELECT", "EXAMINE":
+			f.selected = ""
+			if resp.Name == "OK" {
+				f.selected = rec.Mailbox
+			}
+		case "CLOSE", "UNSELECT":
+			f.selected = ""
+		}
+	}
+	f.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	rec.Status = resp.Name
+	rec.DurationMs = float64(time.Since(rec.Time).Microseconds()) / 1000
+
+	if err := f.mp.writeAudit(rec); err != nil {
+		f.mp.log.Printf("conn(%d) audit fail: %s\n", f.cid, err)
+	}
+	return true
+}
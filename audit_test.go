@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_rotatingFile(t *testing.T) {
+	A := Assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := newRotatingFile(path, 10, 2)
+	A.NoError(err, "newRotatingFile")
+	defer rf.Close()
+
+	for _, s := range []string{"1111111\n", "2222222\n", "3333333\n", "4444444\n"} {
+		_, err := rf.Write([]byte(s))
+		A.NoError(err, "write")
+	}
+
+	for file, want := range map[string]string{path: "4444444\n", path + ".1": "3333333\n", path + ".2": "2222222\n"} {
+		b, err := os.ReadFile(file)
+		A.NoError(err, file)
+		A.Equal(want, string(b), file)
+	}
+	_, err = os.Stat(path + ".3")
+	A.True(os.IsNotExist(err), "only maxBackups kept")
+}
+
+func Test_auditSyslog(t *testing.T) {
+	A := Assert.New(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:1241")
+	A.NoError(err, "listen")
+	defer pc.Close()
+
+	audit, err := newAuditLog(&AuditConf{Syslog: "udp://127.0.0.1:1241"})
+	A.NoError(err, "newAuditLog")
+	defer audit.Close()
+
+	A.NoError(audit.write(&auditRecord{Cid: 7, User: "abc", Command: "NOOP", Status: "OK"}))
+
+	b := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(b)
+	A.NoError(err, "read")
+	A.Contains(string(b[:n]), "mailp-audit")
+	A.Contains(string(b[:n]), `"user":"abc"`)
+}
+
+// testGateWriter holds each write until gate is closed.
+type testGateWriter struct {
+	gate    chan struct{}
+	started chan struct{}
+	mu      sync.Mutex
+	lines   []string
+	closed  bool
+}
+
+func (w *testGateWriter) Write(b []byte) (int, error) {
+	w.started <- struct{}{}
+	<-w.gate
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	w.lines = append(w.lines, string(b))
+	return len(b), nil
+}
+
+func (w *testGateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+func Test_auditLogDrain(t *testing.T) {
+	A := Assert.New(t)
+
+	w := &testGateWriter{gate: make(chan struct{}), started: make(chan struct{}, 1)}
+	mp := &Mailp{audit: &auditLog{w: w}}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- mp.writeAudit(&auditRecord{Cid: 7, Command: "NOOP", Status: "OK"})
+	}()
+	<-w.started
+
+	// replaced like Reload does, the old log is closed after the write
+	mp.mu.Lock()
+	old := mp.audit
+	mp.audit = nil
+	mp.mu.Unlock()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- old.Close()
+	}()
+	select {
+	case <-closed:
+		A.Fail("closed before the write")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(w.gate)
+	A.NoError(<-written, "write")
+	A.NoError(<-closed, "close")
+	A.Len(w.lines, 1, "record kept")
+	A.True(w.closed)
+
+	A.NoError(mp.writeAudit(&auditRecord{}), "no log in use")
+}
+
+func Test_mailpAudit(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  audit:
+    file: ` + path + `
+  users:
+    abc:
+      password: "pw"
+      readOnly: true
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+
+	A.NoError(c.Login("abc", "pw"), "login")
+	_, err = c.Select("INBOX", false)
+	A.NoError(err, "select")
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(1)
+	section := &imap.BodySectionName{}
+	msgs := make(chan *imap.Message, 1)
+	A.NoError(c.UidFetch(seq, []imap.FetchItem{section.FetchItem()}, msgs), "fetch")
+	A.Error(c.Store(seq, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag}, nil), "store")
+
+	b, err := os.ReadFile(path)
+	A.NoError(err, "read audit")
+	A.NotContains(string(b), "password", "no credentials")
+	A.NotContains(string(b), "Subject", "no bodies")
+
+	var recs []auditRecord
+	sc := bufio.NewScanner(strings.NewReader(string(b)))
+	for sc.Scan() {
+		rec := auditRecord{}
+		A.NoError(json.Unmarshal(sc.Bytes(), &rec), sc.Text())
+		recs = append(recs, rec)
+	}
+	A.GreaterOrEqual(len(recs), 3)
+
+	byCmd := map[string]auditRecord{}
+	for _, rec := range recs {
+		A.Equal("abc", rec.User)
+		A.Equal("127.0.0.1:1233", rec.Upstream)
+		byCmd[rec.Command] = rec
+	}
+	A.Equal("INBOX", byCmd["SELECT"].Mailbox)
+	A.Equal("OK", byCmd["SELECT"].Status)
+	A.Equal("1", byCmd["UID FETCH"].Uids)
+	A.Equal("INBOX", byCmd["UID FETCH"].Mailbox)
+	A.Equal("NO", byCmd["STORE"].Status)
+	A.Equal("1", byCmd["STORE"].Seqs)
+	A.Equal(`+FLAGS.SILENT (\Deleted)`, byCmd["STORE"].Flags)
+}
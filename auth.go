@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// peerCert returns the verified client certificate of c, if any.
+func peerCert(c *tls.Conn) *x509.Certificate {
+	cs := c.ConnectionState()
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return cs.PeerCertificates[0]
+}
+
+// matchCert reports whether cert is mapped to u by CertSubject or
+// CertFingerprint. Both must match when both are set.
+func (u *ImapUserConf) matchCert(cert *x509.Certificate) bool {
+	if cert == nil || (u.CertSubject == "" && u.CertFingerprint == "") {
+		return false
+	}
+
+	if u.CertSubject != "" && u.CertSubject != cert.Subject.String() && u.CertSubject != "CN="+cert.Subject.CommonName {
+		return false
+	}
+
+	if u.CertFingerprint != "" {
+		fp := sha256.Sum256(cert.Raw)
+		want := strings.ToLower(strings.ReplaceAll(u.CertFingerprint, ":", ""))
+		if want != hex.EncodeToString(fp[:]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// certUser returns the user cert is mapped to, identity, when non empty, is
+// the user asked for by the client and is looked up in users. Without it
+// only imap.users are searched.
+func (c *ImapConf) certUser(users UserStore, cert *x509.Certificate, identity string) (string, error) {
+	if identity != "" {
+		if user, _, err := users.LookupUser(identity); err == nil && user.matchCert(cert) {
+			return identity, nil
+		}
+		return "", fmt.Errorf("certificate not valid for %s", identity)
+	}
+
+	var names []string
+	for name, user := range c.Users {
+		if user.matchCert(cert) {
+			names = append(names, name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "", errors.New("no user for certificate")
+	case 1:
+		return names[0], nil
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("certificate matches users %s, need an authorization identity", strings.Join(names, ","))
+}
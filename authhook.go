@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultAuthHookTimeout  = 5 * time.Second
+	defaultAuthHookCacheTtl = 30 * time.Second
+)
+
+// authHookRequest is sent to the hook as JSON, Token is set instead of
+// Password for XOAUTH2.
+type authHookRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Mechanism  string `json:"mechanism"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// authHookResponse is read like the config, so its upstream and limits are
+// written as in a user there, durations as strings like "30s".
+type authHookResponse struct {
+	Allow     bool
+	Reason    string
+	Upstream  *ImapUpstreamConf
+	ReadOnly  bool `yaml:"readOnly"`
+	Mailboxes MailboxesConf
+	RateLimit RateLimitConf `yaml:"rateLimit"`
+}
+
+// An authHook asks an HTTP service or a command whether a login is allowed
+// and where it goes. Decisions, allowed or not, are cached for CacheTtl.
+type authHook struct {
+	conf   *AuthHookConf
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[32]byte]authHookDecision
+}
+
+type authHookDecision struct {
+	user    *ImapUserConf
+	err     error
+	expires time.Time
+}
+
+// newAuthHook returns nil when conf is off.
+func newAuthHook(conf *AuthHookConf) (*authHook, error) {
+	if conf.Url == "" && len(conf.Command) == 0 {
+		return nil, nil
+	}
+	if conf.Url != "" && len(conf.Command) > 0 {
+		return nil, errors.New("imap.authHook: url and command are exclusive")
+	}
+
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultAuthHookTimeout
+	}
+
+	return &authHook{
+		conf:   conf,
+		client: &http.Client{Timeout: timeout},
+		cache:  map[[32]byte]authHookDecision{},
+	}, nil
+}
+
+func (h *authHook) ttl() time.Duration {
+	if h.conf.CacheTtl == 0 {
+		return defaultAuthHookCacheTtl
+	}
+	return h.conf.CacheTtl
+}
+
+// check returns the user of req, or the error to reply. A hook that can not
+// be asked gives a statusError UNAVAILABLE, which is not cached.
+func (h *authHook) check(req *authHookRequest) (*ImapUserConf, error) {
+	// the client port changes with every connection
+	key := *req
+	if host, _, err := net.SplitHostPort(key.RemoteAddr); err == nil {
+		key.RemoteAddr = host
+	}
+	kb, _ := json.Marshal(key)
+	sum := sha256.Sum256(kb)
+
+	now := time.Now()
+	h.mu.Lock()
+	d, ok := h.cache[sum]
+	h.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.user, d.err
+	}
+
+	res, err := h.ask(req)
+	if err != nil {
+		return nil, &statusError{code: "UNAVAILABLE", err: fmt.Errorf("auth hook fail: %w", err)}
+	}
+
+	d = authHookDecision{expires: now.Add(h.ttl())}
+	switch {
+	case !res.Allow:
+		reason := res.Reason
+		if reason == "" {
+			reason = "bad username or password"
+		}
+		d.err = errors.New(reason)
+	case res.Upstream == nil || len(res.Upstream.addrs()) == 0:
+		return nil, &statusError{code: "UNAVAILABLE", err: errors.New("auth hook fail: no upstream")}
+	default:
+		d.user = &ImapUserConf{
+			Upstream:  *res.Upstream,
+			ReadOnly:  res.ReadOnly,
+			Mailboxes: res.Mailboxes,
+			RateLimit: res.RateLimit,
+		}
+	}
+
+	if h.ttl() > 0 {
+		h.mu.Lock()
+		for k, old := range h.cache {
+			if !now.Before(old.expires) {
+				delete(h.cache, k)
+			}
+		}
+		h.cache[sum] = d
+		h.mu.Unlock()
+	}
+
+	return d.user, d.err
+}
+
+// ask POSTs req to Url, or runs Command with req on stdin.
+func (h *authHook) ask(req *authHookRequest) (*authHookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	if h.conf.Url != "" {
+		res, err := h.client.Post(h.conf.Url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("http %s", res.Status)
+		}
+		if out, err = io.ReadAll(io.LimitReader(res.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), h.client.Timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, h.conf.Command[0], h.conf.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		if out, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("command: %w", err)
+		}
+	}
+
+	// JSON is YAML
+	res := &authHookResponse{}
+	if err := yaml.Unmarshal(out, res); err != nil {
+		return nil, fmt.Errorf("bad response: %w", err)
+	}
+	return res, nil
+}
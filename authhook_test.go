@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpAuthHook(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	var calls atomic.Int32
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		req := &authHookRequest{}
+		A.NoError(json.NewDecoder(r.Body).Decode(req), "hook request")
+		A.Contains(req.RemoteAddr, "127.0.0.1:", "remoteAddr")
+
+		upstream := `"upstream": {"addr": "127.0.0.1:1233", "failTimeout": "30s",
+			"auth": {"type": "plain", "username": "username", "password": "password"}}`
+		switch {
+		case (req.Mechanism == "LOGIN" && req.Username == "alice" && req.Password == "secret") ||
+			(req.Mechanism == Xoauth2 && req.Username == "bob" && req.Token == "tok"):
+			w.Write([]byte(`{"allow": true, ` + upstream + `}`))
+		case req.Username == "carol" && req.Password == "secret":
+			w.Write([]byte(`{"allow": true, ` + upstream + `, "readOnly": true,
+				"mailboxes": {"include": ["INBOX"]}, "rateLimit": {"down": 1000000}}`))
+		default:
+			w.Write([]byte(`{"allow": false, "reason": "go away"}`))
+		}
+	}))
+	defer hooks.Close()
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  authHook:
+    url: ` + hooks.URL + `
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	dial := func() *client.Client {
+		c, err := client.Dial("127.0.0.1:1234")
+		A.NoError(err, "client.Dial")
+		return c
+	}
+
+	c := dial()
+	err = c.Login("alice", "bad")
+	A.Error(err, "denied")
+	A.Contains(err.Error(), "go away", "hook reason")
+	A.NoError(c.Login("alice", "secret"), "allowed")
+	_, err = c.Select("INBOX", true)
+	A.NoError(err, "select")
+	c.Terminate()
+	A.EqualValues(2, calls.Load(), "hook calls")
+
+	c = dial()
+	A.NoError(c.Login("alice", "secret"), "cached")
+	c.Terminate()
+	A.EqualValues(2, calls.Load(), "decision cached")
+
+	c = dial()
+	ok, err := c.SupportAuth(Xoauth2)
+	A.NoError(err, "caps")
+	A.True(ok, "AUTH=XOAUTH2")
+	A.NoError(c.Authenticate(NewXoauth2Client("bob", "tok")), "xoauth2")
+	A.NoError(c.Create("Private"), "create")
+	c.Terminate()
+
+	// the hook sets what a user in the config may
+	c = dial()
+	defer c.Terminate()
+	A.NoError(c.Login("carol", "secret"), "carol")
+	ch := make(chan *imap.MailboxInfo, 10)
+	A.NoError(c.List("", "*", ch), "list")
+	var names []string
+	for m := range ch {
+		names = append(names, m.Name)
+	}
+	A.Equal([]string{"INBOX"}, names, "mailboxes")
+	A.Error(c.Create("x"), "readOnly")
+}
+
+func Test_authHookCommand(t *testing.T) {
+	A := Assert.New(t)
+
+	hook, err := newAuthHook(&AuthHookConf{
+		Command:  []string{"sh", "-c", `grep -q '"password":"secret"' && echo '{"allow":true,"upstream":{"addr":"127.0.0.1:1233","failTimeout":"1m","pool":{"keepAlive":"5m"}}}' || echo '{"allow":false}'`},
+		CacheTtl: -1,
+	})
+	A.NoError(err, "newAuthHook")
+
+	user, err := hook.check(&authHookRequest{Username: "alice", Password: "secret", Mechanism: "LOGIN"})
+	A.NoError(err, "allowed")
+	A.Equal("127.0.0.1:1233", user.Upstream.Addr)
+	A.Equal(time.Minute, user.Upstream.FailTimeout, "duration string")
+	A.Equal(5*time.Minute, user.Upstream.Pool.KeepAlive)
+
+	_, err = hook.check(&authHookRequest{Username: "alice", Password: "bad", Mechanism: "LOGIN"})
+	A.EqualError(err, "bad username or password")
+
+	hook, err = newAuthHook(&AuthHookConf{Command: []string{"false"}})
+	A.NoError(err, "newAuthHook")
+	_, err = hook.check(&authHookRequest{Username: "alice", Password: "secret"})
+	A.IsType(&statusError{}, err, "hook fail is unavailable")
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	defaultCacheMaxSize    = 1 << 30
+	defaultCacheMaxMessage = 32 << 20
+	cacheSaveInterval      = time.Minute
+	// UID FETCH with more UIDs go upstream as they are
+	cacheMaxHitUIDs = 1000
+	// a fetch answered from the cache asks upstream for this header, the
+	// id tells the hit
+	cachePlaceholder = "X-MAILP-CACHE-"
+)
+
+var cacheBodyItemRe = regexp.MustCompile(`(?i)^(?:BODY(\.PEEK)?\[\](?:<(\d+)\.(\d+)>)?|RFC822)$`)
+
+// A msgCache keeps message bodies in dir by their sha256, the index maps
+// account, mailbox, UIDVALIDITY and UID to them.
+type msgCache struct {
+	dir        string
+	maxSize    int64
+	maxMessage int64
+
+	mu      sync.Mutex
+	index   cacheIndex
+	refs    map[string]int
+	size    int64
+	pinned  map[string]int
+	changed bool
+}
+
+type cacheIndex struct {
+	// UIDVALIDITY by account and mailbox
+	Validity map[string]string
+	Entries  map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	Hash string
+	Size int64
+	Used time.Time
+}
+
+func cacheMailboxKey(account, mailbox string) string {
+	return account + "\x00" + mailbox
+}
+
+func cacheKey(account, mailbox, validity string, uid uint32) string {
+	return cacheMailboxKey(account, mailbox) + "\x00" + validity + "\x00" + strconv.FormatUint(uint64(uid), 10)
+}
+
+// newMsgCache reads the index in conf.Dir, nil when the cache is off.
+func newMsgCache(conf *CacheConf) (*msgCache, error) {
+	if conf.Dir == "" {
+		return nil, nil
+	}
+	c := &msgCache{
+		dir:        conf.Dir,
+		maxSize:    conf.MaxSize,
+		maxMessage: conf.MaxMessage,
+		index:      cacheIndex{Validity: map[string]string{}, Entries: map[string]*cacheEntry{}},
+		refs:       map[string]int{},
+		pinned:     map[string]int{},
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultCacheMaxSize
+	}
+	if c.maxMessage <= 0 {
+		c.maxMessage = defaultCacheMaxMessage
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cache dir fail: %w", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(c.dir, "index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		b = []byte("{}")
+	} else if err != nil {
+		return nil, fmt.Errorf("read cache index fail: %w", err)
+	}
+	if err := json.Unmarshal(b, &c.index); err != nil {
+		return nil, fmt.Errorf("bad cache index: %w", err)
+	}
+	if c.index.Validity == nil {
+		c.index.Validity = map[string]string{}
+	}
+	if c.index.Entries == nil {
+		c.index.Entries = map[string]*cacheEntry{}
+	}
+	for key, e := range c.index.Entries {
+		// a body gone from the dir is dropped
+		if c.refs[e.Hash] == 0 {
+			if _, err := os.Stat(c.path(e.Hash)); err != nil {
+				delete(c.index.Entries, key)
+				continue
+			}
+			c.size += e.Size
+		}
+		c.refs[e.Hash]++
+	}
+	if err := c.sweep(); err != nil {
+		return nil, fmt.Errorf("cache dir fail: %w", err)
+	}
+	return c, nil
+}
+
+// sweep removes the files of dir no entry has, like the bodies put after
+// the index was last saved.
+func (c *msgCache) sweep() error {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(c.dir, d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if c.refs[d.Name()+f.Name()] == 0 {
+				os.Remove(filepath.Join(c.dir, d.Name(), f.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+func (c *msgCache) path(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash[2:])
+}
+
+// validate drops the entries of a mailbox whose UIDVALIDITY changed.
+func (c *msgCache) validate(account, mailbox, validity string) {
+	mkey := cacheMailboxKey(account, mailbox)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, ok := c.index.Validity[mkey]
+	if ok && old == validity {
+		return
+	}
+	c.index.Validity[mkey] = validity
+	c.changed = true
+	if !ok {
+		return
+	}
+	prefix := mkey + "\x00" + old + "\x00"
+	for key := range c.index.Entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(key)
+		}
+	}
+}
+
+// pin returns the bodies of keys, kept until unpin, false when one is not
+// cached. An entry whose body file is gone is dropped.
+func (c *msgCache) pin(keys []string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hashes := make([]string, len(keys))
+	for i, key := range keys {
+		e, ok := c.index.Entries[key]
+		if !ok {
+			return nil, false
+		}
+		if _, err := os.Stat(c.path(e.Hash)); err != nil {
+			c.remove(key)
+			return nil, false
+		}
+		hashes[i] = e.Hash
+	}
+	now := time.Now()
+	for i, key := range keys {
+		c.index.Entries[key].Used = now
+		c.pinned[hashes[i]]++
+	}
+	c.changed = true
+	return hashes, true
+}
+
+func (c *msgCache) unpin(hashes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, h := range hashes {
+		if c.pinned[h]--; c.pinned[h] <= 0 {
+			delete(c.pinned, h)
+		}
+	}
+}
+
+// read returns a body by its hash.
+func (c *msgCache) read(hash string) ([]byte, error) {
+	return os.ReadFile(c.path(hash))
+}
+
+// put caches a body fetched from upstream.
+func (c *msgCache) put(key string, body []byte) error {
+	size := int64(len(body))
+	if size > c.maxMessage || size > c.maxSize {
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.index.Entries[key]; ok && e.Hash == hash {
+		return nil
+	}
+	if c.refs[hash] == 0 {
+		p := c.path(hash)
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			return err
+		}
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, body, 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+		c.size += size
+	}
+	c.remove(key)
+	c.refs[hash]++
+	c.index.Entries[key] = &cacheEntry{Hash: hash, Size: size, Used: time.Now()}
+	c.changed = true
+
+	c.evict()
+	return nil
+}
+
+// remove drops an entry, and its body when no other entry has it. Called
+// with c.mu held.
+func (c *msgCache) remove(key string) {
+	e, ok := c.index.Entries[key]
+	if !ok {
+		return
+	}
+	delete(c.index.Entries, key)
+	c.changed = true
+	if c.refs[e.Hash]--; c.refs[e.Hash] > 0 {
+		return
+	}
+	delete(c.refs, e.Hash)
+	os.Remove(c.path(e.Hash))
+	c.size -= e.Size
+}
+
+// evict drops the least recently used entries until the cache is below
+// maxSize, bodies pinned by hits are kept. Called with c.mu held.
+func (c *msgCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+	keys := make([]string, 0, len(c.index.Entries))
+	for key := range c.index.Entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.index.Entries[keys[i]].Used.Before(c.index.Entries[keys[j]].Used)
+	})
+	// a tenth below, not to evict on each put
+	target := c.maxSize - c.maxSize/10
+	for _, key := range keys {
+		if c.size <= target {
+			break
+		}
+		if c.pinned[c.index.Entries[key].Hash] == 0 {
+			c.remove(key)
+		}
+	}
+}
+
+// save writes the index when it changed.
+func (c *msgCache) save() error {
+	c.mu.Lock()
+	if !c.changed {
+		c.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(&c.index)
+	c.changed = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(c.dir, "index.json")
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write cache index fail: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("write cache index fail: %w", err)
+	}
+	return nil
+}
+
+func (mp *Mailp) runCacheSave(c *msgCache, done chan struct{}) {
+	t := time.NewTicker(cacheSaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := c.save(); err != nil {
+				mp.log.Printf("save cache index fail: %s\n", err)
+			}
+		}
+	}
+}
+
+// A cacheHit is a UID FETCH answered from the cache, sent upstream for a
+// placeholder header to keep sequence numbers, flags and \Seen upstream.
+type cacheHit struct {
+	tag    string
+	pinned []string
+	hashes map[uint32]string
+	// response item, like BODY[]<0> or RFC822
+	name          string
+	partial       bool
+	start, length int64
+}
+
+// cacheFilter answers fetches of cached bodies and caches the ones coming
+// from upstream, it follows the selected mailbox of its session.
+type cacheFilter struct {
+	c       *msgCache
+	account string
+	log     *log.Logger
+	cid     int64
+
+	mu        sync.Mutex
+	mailbox   string
+	validity  string
+	selecting map[string]string
+	pending   string
+	hits      map[int]*cacheHit
+	hitID     int
+}
+
+func newCacheFilter(c *msgCache, account string, log *log.Logger, cid int64) *cacheFilter {
+	return &cacheFilter{
+		c:         c,
+		account:   account,
+		log:       log,
+		cid:       cid,
+		selecting: map[string]string{},
+		hits:      map[int]*cacheHit{},
+	}
+}
+
+func (f *cacheFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Name {
+	case "SELECT", "EXAMINE":
+		// a failed SELECT deselects too
+		f.mailbox, f.validity = "", ""
+		if toks := imapTokens(cmd.Data, 3); len(toks) == 3 {
+			f.selecting[cmd.Tag] = canonicalMailbox(decodeMailbox(toks[2].value))
+			f.pending = ""
+		}
+	case "CLOSE", "UNSELECT":
+		f.mailbox, f.validity = "", ""
+	case "UID FETCH":
+		if f.mailbox != "" && f.validity != "" && cmd.Complete {
+			f.hit(cmd)
+		}
+	}
+	return nil
+}
+
+// hit rewrites cmd for a placeholder when all its UIDs are cached. Called
+// with f.mu held.
+func (f *cacheFilter) hit(cmd *ProxyCommand) {
+	toks := imapTokens(cmd.Data, 5)
+	if len(toks) < 5 {
+		return
+	}
+
+	// the body item and where it is in data
+	items := []imapToken{toks[4]}
+	base := 0
+	if toks[4].list {
+		base = toks[4].start + 1
+		items = imapTokens([]byte(toks[4].value[1:len(toks[4].value)-1]), 64)
+	}
+	var item imapToken
+	var m []string
+	for _, it := range items {
+		if it.list {
+			continue
+		}
+		if mm := cacheBodyItemRe.FindStringSubmatch(it.value); mm != nil {
+			if m != nil {
+				return
+			}
+			item, m = it, mm
+		}
+	}
+	if m == nil {
+		return
+	}
+
+	seqs, err := imap.ParseSeqSet(toks[3].value)
+	if err != nil {
+		return
+	}
+	var uids []uint32
+	var keys []string
+	for _, q := range seqs.Set {
+		if q.Start == 0 || q.Stop == 0 || int(q.Stop-q.Start)+len(uids) >= cacheMaxHitUIDs {
+			return
+		}
+		for uid := q.Start; uid <= q.Stop; uid++ {
+			uids = append(uids, uid)
+			keys = append(keys, cacheKey(f.account, f.mailbox, f.validity, uid))
+		}
+	}
+	hashes, ok := f.c.pin(keys)
+	if !ok {
+		return
+	}
+
+	h := &cacheHit{tag: cmd.Tag, pinned: hashes, hashes: map[uint32]string{}, name: "BODY[]"}
+	for i, uid := range uids {
+		h.hashes[uid] = hashes[i]
+	}
+	peek := ""
+	if strings.EqualFold(m[0], "RFC822") {
+		h.name = "RFC822"
+	} else if m[1] != "" {
+		peek = ".PEEK"
+	}
+	if m[2] != "" {
+		h.partial = true
+		h.start, _ = strconv.ParseInt(m[2], 10, 64)
+		h.length, _ = strconv.ParseInt(m[3], 10, 64)
+		h.name += "<" + m[2] + ">"
+	}
+
+	f.hitID++
+	f.hits[f.hitID] = h
+	placeholder := fmt.Sprintf("BODY%s[HEADER.FIELDS (%s%d)]", peek, cachePlaceholder, f.hitID)
+	cmd.Data = []byte(string(cmd.Data[:base+item.start]) + placeholder + string(cmd.Data[base+item.end:]))
+}
+
+func (f *cacheFilter) FilterResponse(resp *ProxyResponse) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case resp.Tag == "*" && resp.Name == "FETCH":
+		if resp.Complete {
+			f.fetchResp(resp)
+		}
+	case resp.Tag == "*":
+		if v, ok := respCode(resp.Data, "UIDVALIDITY"); ok && len(f.selecting) > 0 {
+			f.pending = v
+		}
+	case resp.Tag != "+":
+		if mailbox, ok := f.selecting[resp.Tag]; ok {
+			delete(f.selecting, resp.Tag)
+			if resp.Name == "OK" && f.pending != "" {
+				f.mailbox, f.validity = mailbox, f.pending
+				f.c.validate(f.account, f.mailbox, f.validity)
+			}
+		}
+		for id, h := range f.hits {
+			if h.tag == resp.Tag {
+				delete(f.hits, id)
+				f.c.unpin(h.pinned)
+			}
+		}
+	}
+	return true
+}
+
+// fetchResp puts cached bodies in place of placeholders, and caches the
+// bodies fetched. Called with f.mu held.
+func (f *cacheFilter) fetchResp(resp *ProxyResponse) {
+	toks := imapTokens(resp.Data, 4)
+	if len(toks) < 4 || !toks[3].list {
+		return
+	}
+	list := toks[3]
+	inner := []byte(list.value[1 : len(list.value)-1])
+	items := imapTokens(inner, 64)
+
+	var uid uint32
+	body := -1
+	holder := -1
+	for k := 0; k+1 < len(items); k += 2 {
+		key := strings.ToUpper(items[k].value)
+		switch {
+		case key == "UID":
+			n, _ := strconv.ParseUint(items[k+1].value, 10, 32)
+			uid = uint32(n)
+		case key == "BODY[]" || key == "RFC822":
+			body = k
+		case strings.HasPrefix(key, "BODY[HEADER.FIELDS ("+cachePlaceholder):
+			holder = k
+		}
+	}
+	if uid == 0 {
+		return
+	}
+
+	if holder >= 0 {
+		key := strings.ToUpper(items[holder].value)
+		id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(key, "BODY[HEADER.FIELDS ("+cachePlaceholder), ")]"))
+		h := f.hits[id]
+		// the placeholder is never for the client
+		item := "BODY[] NIL"
+		if h != nil {
+			item = h.name + " NIL"
+		}
+		if h != nil && h.hashes[uid] != "" {
+			if b, err := f.c.read(h.hashes[uid]); err != nil {
+				f.log.Printf("conn(%d) cache read fail: %s\n", f.cid, err)
+			} else {
+				if h.partial {
+					start := min(h.start, int64(len(b)))
+					b = b[start:min(start+h.length, int64(len(b)))]
+				}
+				item = fmt.Sprintf("%s {%d}\r\n%s", h.name, len(b), b)
+			}
+		}
+		newInner := string(inner[:items[holder].start]) + item + string(inner[items[holder+1].end:])
+		resp.Data = []byte(string(resp.Data[:list.start]) + "(" + newInner + ")" + string(resp.Data[list.end:]))
+		return
+	}
+
+	if body >= 0 && f.mailbox != "" && f.validity != "" && !items[body+1].nil {
+		key := cacheKey(f.account, f.mailbox, f.validity, uid)
+		if err := f.c.put(key, []byte(items[body+1].value)); err != nil {
+			f.log.Printf("conn(%d) cache put fail: %s\n", f.cid, err)
+		}
+	}
+}
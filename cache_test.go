@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_msgCache(t *testing.T) {
+	A := Assert.New(t)
+
+	dir := t.TempDir()
+	c, err := newMsgCache(&CacheConf{Dir: dir, MaxSize: 100})
+	A.NoError(err, "newMsgCache")
+
+	body := func(ch string) []byte { return []byte(strings.Repeat(ch, 40)) }
+	A.NoError(c.put(cacheKey("a", "INBOX", "1", 1), body("x")))
+	A.NoError(c.put(cacheKey("b", "INBOX", "1", 1), body("x")))
+	A.EqualValues(40, c.size, "same body kept once")
+	A.NoError(c.put(cacheKey("a", "INBOX", "1", 2), body("y")))
+
+	_, ok := c.pin([]string{cacheKey("a", "INBOX", "1", 1)})
+	A.True(ok)
+	A.NoError(c.put(cacheKey("a", "INBOX", "1", 3), body("z")))
+	A.LessOrEqual(c.size, int64(90), "evicted")
+	_, ok = c.pin([]string{cacheKey("a", "INBOX", "1", 2)})
+	A.False(ok, "least recently used went first")
+	_, ok = c.pin([]string{cacheKey("a", "INBOX", "1", 1)})
+	A.True(ok, "pinned is kept")
+
+	A.NoError(c.save(), "save")
+	c, err = newMsgCache(&CacheConf{Dir: dir, MaxSize: 100})
+	A.NoError(err, "reload")
+	hashes, ok := c.pin([]string{cacheKey("b", "INBOX", "1", 1)})
+	A.True(ok, "kept across restarts")
+	b, err := c.read(hashes[0])
+	A.NoError(err)
+	A.Equal(body("x"), b)
+
+	c.validate("b", "INBOX", "1")
+	c.validate("b", "INBOX", "2")
+	_, ok = c.pin([]string{cacheKey("b", "INBOX", "1", 1)})
+	A.False(ok, "dropped with UIDVALIDITY")
+	hashes, ok = c.pin([]string{cacheKey("a", "INBOX", "1", 1)})
+	A.True(ok, "other account kept")
+
+	// a body gone from the dir is a miss
+	A.NoError(os.Remove(c.path(hashes[0])))
+	_, ok = c.pin([]string{cacheKey("a", "INBOX", "1", 1)})
+	A.False(ok, "body file gone")
+	A.NotContains(c.index.Entries, cacheKey("a", "INBOX", "1", 1), "dropped")
+
+	// bodies put after the last save are not in the index, removed at load
+	A.NoError(c.put(cacheKey("a", "INBOX", "1", 4), body("w")))
+	hashes, ok = c.pin([]string{cacheKey("a", "INBOX", "1", 4)})
+	A.True(ok)
+	c, err = newMsgCache(&CacheConf{Dir: dir, MaxSize: 100})
+	A.NoError(err, "reload")
+	_, err = os.Stat(c.path(hashes[0]))
+	A.True(os.IsNotExist(err), "swept")
+}
+
+func Test_mailpCache(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  cache:
+    dir: ` + t.TempDir() + `
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	A.NoError(c.Login("abc", "pw"), "login")
+	_, err = c.Select("INBOX", false)
+	A.NoError(err, "select")
+
+	seqs, _ := imap.ParseSeqSet("1:*")
+	fetch := func(section string) (*imap.Message, string) {
+		s, err := imap.ParseBodySectionName(imap.FetchItem(section))
+		A.NoError(err)
+		ch := make(chan *imap.Message, 1)
+		A.NoError(c.UidFetch(seqs, []imap.FetchItem{imap.FetchItem(section), imap.FetchFlags}, ch), "uid fetch")
+		m := <-ch
+		b, err := io.ReadAll(m.GetBody(s))
+		A.NoError(err)
+		return m, string(b)
+	}
+
+	m, body := fetch("BODY.PEEK[]")
+	A.Contains(body, "Subject:")
+
+	// on disk now, changed there to tell a hit; hits are for known UIDs
+	seqs = new(imap.SeqSet)
+	seqs.AddNum(m.Uid)
+	upConf := conf.Imap.Users["abc"].Upstream
+	account := quotaAccount("abc", &upConf)
+	cache := mp.cache
+	cache.mu.Lock()
+	validity := cache.index.Validity[cacheMailboxKey(account, "INBOX")]
+	e := cache.index.Entries[cacheKey(account, "INBOX", validity, m.Uid)]
+	cache.mu.Unlock()
+	A.NotNil(e, "cached")
+	A.NoError(os.WriteFile(cache.path(e.Hash), []byte("cached body"), 0o600))
+
+	m2, body := fetch("BODY.PEEK[]")
+	A.Equal("cached body", body, "from the cache")
+	A.Equal(m.SeqNum, m2.SeqNum)
+	_, body = fetch("BODY.PEEK[]<2.4>")
+	A.Equal("ched", body, "partial")
+
+	_, body = fetch("BODY[]")
+	A.Equal("cached body", body)
+
+	cache.mu.Lock()
+	A.Empty(cache.pinned, "hits done")
+	cache.mu.Unlock()
+
+	// \Seen is set upstream, the memory backend does not
+	f := newCacheFilter(cache, account, mp.log, 0)
+	f.mailbox, f.validity = "INBOX", validity
+	cmd := parseProxyCommand([]byte("a UID FETCH 6 (UID RFC822)\r\n"))
+	A.Nil(f.FilterCommand(cmd))
+	A.Equal("a UID FETCH 6 (UID BODY[HEADER.FIELDS (X-MAILP-CACHE-1)])\r\n", string(cmd.Data))
+
+	// a body that can not be read is NIL, the placeholder is not sent on
+	A.NoError(os.Remove(cache.path(e.Hash)))
+	resp := parseProxyResponse([]byte("* 1 FETCH (UID 6 BODY[HEADER.FIELDS (X-MAILP-CACHE-1)] {2}\r\n\r\n)\r\n"))
+	A.True(f.FilterResponse(resp))
+	A.Equal("* 1 FETCH (UID 6 RFC822 NIL)\r\n", string(resp.Data))
+}
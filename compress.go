@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+const capCompress = "COMPRESS=DEFLATE"
+
+// A deflateConn passes bytes as they are until start, then raw deflate both
+// ways like COMPRESS=DEFLATE (RFC 4978). It sits under the traces, so they
+// stay readable.
+type deflateConn struct {
+	net.Conn
+
+	// read by the reader only, start is called by it
+	r io.Reader
+
+	mu sync.Mutex
+	w  *flate.Writer
+}
+
+func newDeflateConn(c net.Conn) *deflateConn {
+	return &deflateConn{Conn: c}
+}
+
+// start turns compression on, pending are bytes read from the conn before
+// and not used, already compressed.
+func (c *deflateConn) start(level int, pending []byte) error {
+	w, err := flate.NewWriter(c.Conn, level)
+	if err != nil {
+		return err
+	}
+	c.r = flate.NewReader(io.MultiReader(bytes.NewReader(pending), c.Conn))
+
+	c.mu.Lock()
+	c.w = w
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *deflateConn) active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.w != nil
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write flushes each write, IMAP waits for what was sent.
+func (c *deflateConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.w == nil {
+		return c.Conn.Write(b)
+	}
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return n, err
+}
+
+// compressFilter answers COMPRESS DEFLATE for the client side, upstreams
+// never see it, and adds COMPRESS=DEFLATE to the capabilities.
+type compressFilter struct {
+	dc    *deflateConn
+	level int
+}
+
+func (f *compressFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	if cmd.Name != "COMPRESS" {
+		return nil
+	}
+	if f.dc.active() {
+		return &imap.StatusResp{Tag: cmd.Tag, Type: imap.StatusRespNo, Code: "COMPRESSIONACTIVE", Info: "DEFLATE active already"}
+	}
+	toks := imapTokens(cmd.Data, 3)
+	if len(toks) != 3 || !strings.EqualFold(toks[2].value, "DEFLATE") {
+		return &imap.StatusResp{Tag: cmd.Tag, Type: imap.StatusRespBad, Info: "only DEFLATE is supported"}
+	}
+	return &imap.StatusResp{Tag: cmd.Tag, Type: imap.StatusRespOk, Info: "DEFLATE active"}
+}
+
+// replied starts compression once the OK went out, before any other
+// response. The client waits for it, nothing compressed was read before.
+func (f *compressFilter) replied(cmd *ProxyCommand, resp *ProxyResponse) error {
+	if cmd.Name != "COMPRESS" || resp.Name != "OK" {
+		return nil
+	}
+	return f.dc.start(f.level, nil)
+}
+
+func (f *compressFilter) FilterResponse(resp *ProxyResponse) bool {
+	if !resp.Complete || bytes.Contains(bytes.ToUpper(resp.Data), []byte(capCompress)) {
+		return true
+	}
+
+	data := resp.Data
+	switch {
+	case resp.Tag == "*" && resp.Name == "CAPABILITY":
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			return true
+		}
+		resp.Data = []byte(string(data[:i]) + " " + capCompress + string(data[i:]))
+	default:
+		// [CAPABILITY ...] of OK responses, like the one of LOGIN
+		i := bytes.Index(bytes.ToUpper(data), []byte("[CAPABILITY "))
+		if i < 0 {
+			return true
+		}
+		j := bytes.IndexByte(data[i:], ']')
+		if j < 0 {
+			return true
+		}
+		resp.Data = []byte(string(data[:i+j]) + " " + capCompress + string(data[i+j:]))
+	}
+	return true
+}
+
+// compressUpstream asks uc for COMPRESS DEFLATE, an upstream without it is
+// used as it is.
+func (mp *Mailp) compressUpstream(cid int64, uc *upstreamConn, level int) {
+	if uc.dc == nil || uc.br == nil {
+		return
+	}
+	ret, err := uc.exec(&imap.Command{Name: "COMPRESS", Arguments: []any{imap.RawString("DEFLATE")}}, nil)
+	if err != nil {
+		mp.log.Printf("conn(%d) upstream compress fail: %s\n", cid, err)
+		return
+	}
+	if ret.Type != imap.StatusRespOk {
+		mp.log.Printf("conn(%d) upstream compress: %s\n", cid, ret.Info)
+		return
+	}
+
+	// compressed already, read along with the OK
+	pending, _ := uc.br.Peek(uc.br.Buffered())
+	pending = bytes.Clone(pending)
+	uc.br.Discard(len(pending))
+	if err := uc.dc.start(level, pending); err != nil {
+		mp.log.Printf("conn(%d) upstream compress fail: %s\n", cid, err)
+		return
+	}
+	mp.log.Printf("conn(%d) upstream compress: DEFLATE active\n", cid)
+}
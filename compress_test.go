@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpCompress(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  compress:
+    enabled: true
+    upstream: true
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	// advertised after login, the upstream has no COMPRESS
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	A.NoError(c.Login("abc", "pw"), "login")
+	ok, err := c.Support(capCompress)
+	A.NoError(err, "capability")
+	A.True(ok, "advertised")
+	c.Logout()
+
+	nc, err := net.Dial("tcp", "127.0.0.1:1234")
+	A.NoError(err, "dial")
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(nc)
+	var w io.Writer = nc
+	flush := func() {}
+	send := func(line string) {
+		_, err := fmt.Fprintf(w, "%s\r\n", line)
+		A.NoError(err, "send")
+		flush()
+	}
+	// reads up to the tagged response, returns the lines
+	recv := func(tag string) []string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			A.NoError(err, "recv")
+			lines = append(lines, line)
+			if strings.HasPrefix(line, tag+" ") {
+				return lines
+			}
+		}
+	}
+
+	_, err = r.ReadString('\n')
+	A.NoError(err, "greeting")
+	send("a LOGIN abc pw")
+	recv("a")
+
+	send("b COMPRESS GZIP")
+	A.Contains(recv("b")[0], "b BAD")
+	send("c COMPRESS DEFLATE")
+	A.Contains(recv("c")[0], "c OK")
+
+	fw, err := flate.NewWriter(nc, flate.DefaultCompression)
+	A.NoError(err)
+	w = fw
+	flush = func() { A.NoError(fw.Flush()) }
+	r = bufio.NewReader(flate.NewReader(nc))
+
+	send("d SELECT INBOX")
+	lines := recv("d")
+	A.Contains(strings.Join(lines, ""), "1 EXISTS")
+	A.Contains(lines[len(lines)-1], "d OK")
+
+	send("e COMPRESS DEFLATE")
+	A.Contains(recv("e")[0], "e NO [COMPRESSIONACTIVE]")
+
+	send("f FETCH 1 BODY.PEEK[]")
+	A.Contains(strings.Join(recv("f"), ""), "Subject:")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// upstreamProbe is the result of the last active check of an upstream addr.
+type upstreamProbe struct {
+	Up        bool      `json:"up"`
+	LatencyMs float64   `json:"latencyMs"`
+	LastError string    `json:"lastError,omitempty"`
+	LastCheck time.Time `json:"lastCheck"`
+	LastUp    time.Time `json:"lastUp"`
+	// NotAfter of the upstream certificate, for tls upstreams
+	CertExpiry *time.Time `json:"certExpiry,omitempty"`
+}
+
+type healthChecker struct {
+	mu     sync.Mutex
+	probes map[string]*upstreamProbe
+	// closed to stop the checks, nil when they are off
+	stop chan struct{}
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{probes: map[string]*upstreamProbe{}}
+}
+
+func (h *healthChecker) set(addr string, p *upstreamProbe) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if old, ok := h.probes[addr]; ok && !p.Up {
+		p.LastUp = old.LastUp
+	}
+	h.probes[addr] = p
+}
+
+// keep drops the probes of what is no longer a target.
+func (h *healthChecker) keep(targets map[string]healthTarget) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range h.probes {
+		if _, ok := targets[key]; !ok {
+			delete(h.probes, key)
+		}
+	}
+}
+
+// snapshot returns a copy of the probes, keyed by addr.
+func (h *healthChecker) snapshot() map[string]upstreamProbe {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ret := make(map[string]upstreamProbe, len(h.probes))
+	for addr, p := range h.probes {
+		ret[addr] = *p
+	}
+	return ret
+}
+
+// A healthTarget is an upstream addr and the conf to reach it with.
+type healthTarget struct {
+	addr string
+	conf ImapUpstreamConf
+}
+
+// healthKey names the probe of addr as reached with conf, the addr alone
+// for plain direct conns. Other TLS settings and proxies are probed apart.
+func (c *ImapConf) healthKey(addr string, conf *ImapUpstreamConf) string {
+	key := addr
+	if conf.Tls.Enabled {
+		key += " tls"
+		b, _ := json.Marshal(conf.Tls)
+		if plain, _ := json.Marshal(TlsClientConf{Enabled: true}); string(b) != string(plain) {
+			sum := sha256.Sum256(b)
+			key += ":" + hex.EncodeToString(sum[:4])
+		}
+	}
+	via := conf.DialVia
+	if via == "" {
+		via = c.DialVia
+	}
+	if via != "" && via != "direct" {
+		if u, err := url.Parse(via); err == nil {
+			via = u.Redacted()
+		}
+		key += " via " + via
+	}
+	return key
+}
+
+// healthTargets returns the upstreams to probe by healthKey, preferring
+// the confs with a check user.
+func (c *ImapConf) healthTargets() map[string]healthTarget {
+	targets := map[string]healthTarget{}
+	add := func(upstream *ImapUpstreamConf) {
+		for _, addr := range upstream.addrs() {
+			if addr == "" {
+				continue
+			}
+			key := c.healthKey(addr, upstream)
+			if t, ok := targets[key]; ok && t.conf.Check.Type != "" {
+				continue
+			}
+			targets[key] = healthTarget{addr: addr, conf: *upstream}
+		}
+	}
+	addUser := func(user *ImapUserConf) {
+		add(&user.Upstream)
+		for _, upstream := range user.Upstreams {
+			add(&upstream)
+		}
+	}
+	for _, user := range c.Users {
+		addUser(&user)
+	}
+	for _, route := range c.Routes {
+		addUser(&route.ImapUserConf)
+	}
+	return targets
+}
+
+// setHealthCheck starts or stops the checks as conf asks, for Start and
+// Reload. The probes of upstreams no longer in conf go at once.
+func (mp *Mailp) setHealthCheck(conf *ImapConf) {
+	on := conf.HealthCheck.Enabled
+
+	h := mp.health
+	h.mu.Lock()
+	switch {
+	case on && h.stop == nil:
+		h.stop = make(chan struct{})
+		go mp.runHealthCheck(h.stop)
+	case !on && h.stop != nil:
+		close(h.stop)
+		h.stop = nil
+	}
+	h.mu.Unlock()
+
+	if on {
+		h.keep(conf.healthTargets())
+	}
+}
+
+// runHealthCheck probes all upstreams every interval, until stop or
+// mp.done is closed. The probes go with it.
+func (mp *Mailp) runHealthCheck(stop <-chan struct{}) {
+	for {
+		conf := mp.getConf().Imap.HealthCheck
+
+		interval := conf.Interval
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		timeout := conf.Timeout
+		if timeout <= 0 {
+			timeout = defaultHealthCheckTimeout
+		}
+
+		targets := mp.getConf().Imap.healthTargets()
+		mp.health.keep(targets)
+
+		var wg sync.WaitGroup
+		for key, t := range targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mp.probeUpstream(key, t.addr, &t.conf, timeout)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-stop:
+			mp.health.keep(nil)
+			return
+		case <-mp.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probeUpstream dials addr, reads the greeting, logs in as the check user if
+// there is one, and logs out, all within timeout. The result is kept as key.
+func (mp *Mailp) probeUpstream(key, addr string, conf *ImapUpstreamConf, timeout time.Duration) {
+	start := time.Now()
+	p := &upstreamProbe{LastCheck: start}
+
+	// a failed check login is of the check user, the upstream was reached
+	reached := false
+	err := func() error {
+		uc, err := mp.dialUpstreamBy(start.Add(timeout), 0, addr, conf, nil)
+		if err != nil {
+			return err
+		}
+		defer uc.c.Close()
+		uc.c.SetDeadline(start.Add(timeout))
+
+		if tlsc, ok := uc.c.(*tls.Conn); ok {
+			if certs := tlsc.ConnectionState().PeerCertificates; len(certs) > 0 {
+				p.CertExpiry = &certs[0].NotAfter
+			}
+		}
+
+		if conf.Check.Type != "" {
+			if err := mp.loginUpstream(0, uc, &conf.Check); err != nil {
+				var se *statusError
+				reached = errors.As(err, &se)
+				return err
+			}
+		}
+
+		return uc.logout()
+	}()
+
+	p.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		p.LastError = err.Error()
+		mp.log.Printf("health check %s fail: %s\n", key, err)
+	} else {
+		p.Up = true
+		p.LastUp = p.LastCheck
+	}
+	switch {
+	case err == nil || reached:
+		mp.upstreams.ok(addr)
+	default:
+		mp.upstreams.fail(addr, conf, err)
+	}
+
+	mp.health.set(key, p)
+}
+
+func (mp *Mailp) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	probes := mp.health.snapshot()
+
+	up := 0
+	for _, p := range probes {
+		if p.Up {
+			up++
+		}
+	}
+
+	ret := struct {
+		Status    string                   `json:"status"`
+		Upstreams map[string]upstreamProbe `json:"upstreams"`
+	}{
+		Status:    "ok",
+		Upstreams: probes,
+	}
+	code := http.StatusOK
+	if up < len(probes) {
+		ret.Status = "degraded"
+	}
+	if up == 0 && len(probes) > 0 {
+		ret.Status = "down"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// handleMetrics writes metrics in the prometheus text format.
+func (mp *Mailp) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	probes := mp.health.snapshot()
+	addrs := make([]string, 0, len(probes))
+	for addr := range probes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	mp.mu.Lock()
+	sessions := len(mp.sessions)
+	mp.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# TYPE mailp_sessions gauge\n")
+	fmt.Fprintf(w, "mailp_sessions %d\n", sessions)
+
+	fmt.Fprintf(w, "# TYPE mailp_upstream_up gauge\n")
+	for _, addr := range addrs {
+		up := 0
+		if probes[addr].Up {
+			up = 1
+		}
+		fmt.Fprintf(w, "mailp_upstream_up{addr=%q} %d\n", addr, up)
+	}
+
+	fmt.Fprintf(w, "# TYPE mailp_upstream_probe_duration_seconds gauge\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "mailp_upstream_probe_duration_seconds{addr=%q} %g\n", addr, probes[addr].LatencyMs/1000)
+	}
+
+	fmt.Fprintf(w, "# TYPE mailp_upstream_cert_expiry_timestamp_seconds gauge\n")
+	for _, addr := range addrs {
+		if t := probes[addr].CertExpiry; t != nil {
+			fmt.Fprintf(w, "mailp_upstream_cert_expiry_timestamp_seconds{addr=%q} %d\n", addr, t.Unix())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdStore is an htpasswd file, re-read when it changes. It supports
+// bcrypt, apr1 (md5) and {SHA}, users with other hashes can not log in.
+// With PlainText every other entry is the password, as htpasswd -p writes.
+type htpasswdStore struct {
+	conf *UserStoreConf
+	log  *log.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	hashes  map[string]string
+}
+
+func newHtpasswdStore(conf *UserStoreConf, logger *log.Logger) *htpasswdStore {
+	return &htpasswdStore{conf: conf, log: logger}
+}
+
+// hash returns the password hash of name, the file is re-read when its
+// mtime or size changed. A file that can not be read keeps the old users.
+func (s *htpasswdStore) hash(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fi, err := os.Stat(s.conf.File); err == nil && (!fi.ModTime().Equal(s.modTime) || fi.Size() != s.size) {
+		if hashes, err := readHtpasswd(s.conf.File); err == nil {
+			s.hashes = hashes
+			s.modTime = fi.ModTime()
+			s.size = fi.Size()
+			for name, hash := range hashes {
+				if !htpasswdSupported(hash, s.conf.PlainText) {
+					s.log.Printf("htpasswd %s: unsupported hash of user %s\n", s.conf.File, name)
+				}
+			}
+		}
+	}
+
+	hash, ok := s.hashes[name]
+	return hash, ok
+}
+
+func readHtpasswd(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		hashes[name] = hash
+	}
+	return hashes, sc.Err()
+}
+
+func (s *htpasswdStore) LookupUser(login string) (*ImapUserConf, string, error) {
+	user, name, err := storeUser(s.conf, login)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := s.hash(name); !ok {
+		return nil, "", errNoSuchUser
+	}
+	return user, name, nil
+}
+
+func (s *htpasswdStore) VerifyPassword(login, password string) (*ImapUserConf, string, error) {
+	user, name, err := storeUser(s.conf, login)
+	if err != nil {
+		return nil, "", err
+	}
+	hash, ok := s.hash(name)
+	if !ok {
+		return nil, "", errNoSuchUser
+	}
+	if !htpasswdMatch(hash, password, s.conf.PlainText) {
+		return nil, "", errBadPassword
+	}
+	return user, name, nil
+}
+
+func htpasswdSupported(hash string, plainText bool) bool {
+	if plainText {
+		return true
+	}
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$", "$apr1$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// htpasswdMatch is false for hashes that are not supported, with plainText
+// they are the password.
+func htpasswdMatch(hash, password string, plainText bool) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+
+	case plainText:
+		return subtle.ConstantTimeCompare([]byte(password), []byte(hash)) == 1
+	}
+
+	return false
+}
+
+// apr1 is the Apache variant of the md5 crypt, $apr1$salt$hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 == 1 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 == 1 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	f := func(i int) uint32 { return uint32(final[i]) }
+	to64(f(0)<<16|f(6)<<8|f(12), 4)
+	to64(f(1)<<16|f(7)<<8|f(13), 4)
+	to64(f(2)<<16|f(8)<<8|f(14), 4)
+	to64(f(3)<<16|f(9)<<8|f(15), 4)
+	to64(f(4)<<16|f(10)<<8|f(5), 4)
+	to64(f(11), 2)
+
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+const defaultInspectMaxLiteral = 64 * 1024
+
+// A ProxyCommand is a command sent by the client, seen by CommandFilters
+// before it goes upstream.
+type ProxyCommand struct {
+	Tag string
+	// upper case, "UID " and the sub command for UID commands
+	Name string
+	// the command as sent, lines with CRLF and literals. When Complete is
+	// false it ends with the line announcing a literal too big to buffer,
+	// that literal and the rest of the command are streamed.
+	Data     []byte
+	Complete bool
+}
+
+// A ProxyResponse is a response sent by the upstream, seen by
+// ResponseFilters before it goes to the client.
+type ProxyResponse struct {
+	// "*" for data, "+" for continuation requests, or the command tag
+	Tag string
+	// upper case, like FETCH or EXISTS for data, OK NO BAD for tagged
+	Name string
+	// like ProxyCommand.Data
+	Data     []byte
+	Complete bool
+}
+
+// A CommandFilter passes, rewrites, rejects or logs client commands. The
+// responses of rejected commands go through the ResponseFilters.
+type CommandFilter interface {
+	// FilterCommand may change cmd.Data, or return the response sent to
+	// the client in place of forwarding cmd.
+	FilterCommand(cmd *ProxyCommand) *imap.StatusResp
+}
+
+// A replyHook is a CommandFilter told its reply was written, before the
+// client is sent anything else.
+type replyHook interface {
+	replied(cmd *ProxyCommand, resp *ProxyResponse) error
+}
+
+// A ResponseFilter passes, rewrites, drops or logs upstream responses.
+type ResponseFilter interface {
+	// FilterResponse may change resp.Data, or return false to drop it. Only
+	// complete responses can be dropped.
+	FilterResponse(resp *ProxyResponse) bool
+}
+
+// parseProxyCommand reads the tag and name of a command line. Lines that
+// are not commands, like DONE ending IDLE, have an empty Name.
+func parseProxyCommand(line []byte) *ProxyCommand {
+	cmd := &ProxyCommand{Data: line, Complete: true}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return cmd
+	}
+	cmd.Tag = fields[0]
+	cmd.Name = strings.ToUpper(fields[1])
+	if cmd.Name == "UID" && len(fields) > 2 {
+		cmd.Name += " " + strings.ToUpper(fields[2])
+	}
+	return cmd
+}
+
+// rename replaces the command name, keeping the arguments.
+func (cmd *ProxyCommand) rename(name string) {
+	data := string(cmd.Data)
+	i := strings.IndexByte(data, ' ')
+	j := strings.IndexAny(data[i+1:], " \r\n")
+	if j < 0 {
+		j = len(data) - i - 1
+	}
+	cmd.Data = []byte(data[:i+1] + name + data[i+1+j:])
+	cmd.Name = name
+}
+
+func parseProxyResponse(line []byte) *ProxyResponse {
+	resp := &ProxyResponse{Data: line, Complete: true}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return resp
+	}
+	resp.Tag = fields[0]
+	if len(fields) > 1 {
+		resp.Name = strings.ToUpper(fields[1])
+	}
+	// * 3 FETCH
+	if _, err := strconv.ParseUint(resp.Name, 10, 32); err == nil && len(fields) > 2 {
+		resp.Name = strings.ToUpper(fields[2])
+	}
+	if resp.Tag == "+" {
+		resp.Name = ""
+	}
+	return resp
+}
+
+// literalSize returns the size of the literal a line ends with, and whether
+// the sender waits for a continuation request before sending it.
+func literalSize(line []byte) (n int64, sync bool, ok bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) < 3 || line[len(line)-1] != '}' {
+		return 0, false, false
+	}
+	i := bytes.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, false, false
+	}
+	s := string(line[i+1 : len(line)-1])
+	sync = !strings.HasSuffix(s, "+")
+	n, err := strconv.ParseInt(strings.TrimSuffix(s, "+"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+// readOnlyAllowed are the commands readOnly users may run, with or without
+// UID. The others are refused, extensions included.
+var readOnlyAllowed = map[string]bool{
+	"CAPABILITY":   true,
+	"NOOP":         true,
+	"LOGOUT":       true,
+	"ID":           true,
+	"ENABLE":       true,
+	"COMPRESS":     true,
+	"NAMESPACE":    true,
+	"LIST":         true,
+	"LSUB":         true,
+	"XLIST":        true,
+	"STATUS":       true,
+	"SELECT":       true,
+	"EXAMINE":      true,
+	"UNSELECT":     true,
+	"CLOSE":        true,
+	"CHECK":        true,
+	"IDLE":         true,
+	"FETCH":        true,
+	"SEARCH":       true,
+	"SORT":         true,
+	"THREAD":       true,
+	"GETQUOTA":     true,
+	"GETQUOTAROOT": true,
+	"GETACL":       true,
+	"MYRIGHTS":     true,
+	"LISTRIGHTS":   true,
+	"GETMETADATA":  true,
+}
+
+// readOnlyFilter refuses commands that are not reads, SELECT becomes
+// EXAMINE so the mailbox is opened [READ-ONLY].
+type readOnlyFilter struct{}
+
+func (readOnlyFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	if cmd.Name == "SELECT" {
+		cmd.rename("EXAMINE")
+		return nil
+	}
+	// lines that are not commands, like DONE
+	if cmd.Name == "" || readOnlyAllowed[strings.TrimPrefix(cmd.Name, "UID ")] {
+		return nil
+	}
+	return &imap.StatusResp{
+		Tag:  cmd.Tag,
+		Type: imap.StatusRespNo,
+		Code: "NOPERM",
+		Info: "read-only access",
+	}
+}
+
+// logFilter logs each command and how it completed.
+type logFilter struct {
+	log *log.Logger
+	cid int64
+}
+
+func (f *logFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	f.log.Printf("conn(%d) command %s %s\n", f.cid, cmd.Tag, cmd.Name)
+	return nil
+}
+
+func (f *logFilter) FilterResponse(resp *ProxyResponse) bool {
+	if resp.Tag != "*" && resp.Tag != "+" {
+		f.log.Printf("conn(%d) done %s %s\n", f.cid, resp.Tag, resp.Name)
+	}
+	return true
+}
+
+var errCommandRejected = errors.New("command rejected by upstream")
+
+// An inspector proxies like pipe, framing commands and responses for the
+// filters. Literals up to maxLiteral are buffered so filters see whole
+// commands and responses, bigger ones are streamed.
+type inspector struct {
+	maxLiteral int64
+	commands   []CommandFilter
+	responses  []ResponseFilter
+
+	c_r *bufio.Reader
+	c_w *imap.Writer
+	u_r *bufio.Reader
+	u_w io.Writer
+
+	// guards writes to the client, replies go between upstream responses
+	cmu sync.Mutex
+
+	// the command waiting for a continuation request of the upstream
+	wmu     sync.Mutex
+	waitTag string
+	cont    chan bool
+	closed  chan struct{}
+}
+
+func newInspector(conf *InspectConf, commands []CommandFilter, responses []ResponseFilter) *inspector {
+	in := &inspector{
+		maxLiteral: conf.MaxLiteral,
+		commands:   commands,
+		responses:  responses,
+		cont:       make(chan bool, 1),
+		closed:     make(chan struct{}),
+	}
+	if in.maxLiteral <= 0 {
+		in.maxLiteral = defaultInspectMaxLiteral
+	}
+	return in
+}
+
+// pipe proxies until either side ends.
+func (in *inspector) pipe(c_r io.Reader, c_w *imap.Writer, u_r io.Reader, u_w io.Writer) {
+	in.c_r = bufio.NewReader(c_r)
+	in.c_w = c_w
+	in.u_r = bufio.NewReader(u_r)
+	in.u_w = u_w
+
+	done := make(chan struct{}, 2)
+	go func() {
+		in.commandLoop()
+		done <- struct{}{}
+	}()
+	go func() {
+		in.responseLoop()
+		close(in.closed)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
+
+func (in *inspector) writeUpstream(b []byte) error {
+	if _, err := in.u_w.Write(b); err != nil {
+		return err
+	}
+	return pipeFlush(in.u_w)
+}
+
+// readMessage reads a command or response starting with line, buffering
+// literals up to maxLiteral, and only non synchronizing ones when
+// stopAtSync is set.
+func (in *inspector) readMessage(r *bufio.Reader, line []byte, stopAtSync bool) (data []byte, complete bool, err error) {
+	data = line
+	for {
+		n, sync, ok := literalSize(line)
+		if !ok {
+			return data, true, nil
+		}
+		if n > in.maxLiteral || (sync && stopAtSync) {
+			return data, false, nil
+		}
+
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(r, lit); err != nil {
+			return nil, false, err
+		}
+		if line, err = r.ReadBytes('\n'); err != nil {
+			return nil, false, err
+		}
+		data = append(append(data, lit...), line...)
+	}
+}
+
+func (in *inspector) commandLoop() error {
+	for {
+		line, err := in.c_r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		cmd := parseProxyCommand(line)
+		if cmd.Name == "" {
+			if err := in.writeUpstream(line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// a synchronizing literal is streamed, the client waits for the
+		// upstream to ask for it
+		cmd.Data, cmd.Complete, err = in.readMessage(in.c_r, line, true)
+		if err != nil {
+			return err
+		}
+
+		var reply *imap.StatusResp
+		var by CommandFilter
+		for _, f := range in.commands {
+			if reply = f.FilterCommand(cmd); reply != nil {
+				by = f
+				break
+			}
+		}
+		if reply != nil {
+			if !cmd.Complete {
+				if err := in.drain(lastLine(cmd.Data)); err != nil {
+					return err
+				}
+			}
+
+			// replies are seen by the response filters like upstream ones
+			var b bytes.Buffer
+			reply.WriteTo(imap.NewWriter(&b))
+			var after func(*ProxyResponse) error
+			if h, ok := by.(replyHook); ok {
+				after = func(resp *ProxyResponse) error { return h.replied(cmd, resp) }
+			}
+			if err := in.respond(parseProxyResponse(b.Bytes()), after); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := in.sendCommand(cmd); err != nil {
+			return err
+		}
+		if !cmd.Complete {
+			if err := in.streamCommand(cmd.Tag, lastLine(cmd.Data)); err != nil && err != errCommandRejected {
+				return err
+			}
+		}
+	}
+}
+
+// sendCommand sends the buffered part of cmd, the last line of an
+// incomplete command is left to streamCommand.
+func (in *inspector) sendCommand(cmd *ProxyCommand) error {
+	data := cmd.Data
+	if !cmd.Complete {
+		data = data[:len(data)-len(lastLine(data))]
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return in.writeUpstream(data)
+}
+
+// streamCommand sends line and streams the rest of the command after it. A
+// synchronizing literal is read once the upstream asked the client for it,
+// or dropped by the client when the upstream completed the command instead.
+func (in *inspector) streamCommand(tag string, line []byte) error {
+	for {
+		n, sync, ok := literalSize(line)
+		if ok && sync {
+			in.expectContinue(tag)
+		}
+		if err := in.writeUpstream(line); err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if sync && !in.waitContinue() {
+			return errCommandRejected
+		}
+		if err := pipeCopyN(in.u_w, in.c_r, n); err != nil {
+			return err
+		}
+
+		var err error
+		if line, err = in.c_r.ReadBytes('\n'); err != nil {
+			return err
+		}
+	}
+}
+
+// drain reads and drops the rest of a command after line, up to a
+// synchronizing literal the client waits to send.
+func (in *inspector) drain(line []byte) error {
+	for {
+		n, sync, ok := literalSize(line)
+		if !ok || sync {
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, in.c_r, n); err != nil {
+			return err
+		}
+
+		var err error
+		if line, err = in.c_r.ReadBytes('\n'); err != nil {
+			return err
+		}
+	}
+}
+
+// expectContinue is called before sending a line announcing a synchronizing
+// literal.
+func (in *inspector) expectContinue(tag string) {
+	in.wmu.Lock()
+	in.waitTag = tag
+	in.wmu.Unlock()
+}
+
+// waitContinue reports whether the upstream asked for the literal, false is
+// the command completed instead.
+func (in *inspector) waitContinue() bool {
+	select {
+	case ok := <-in.cont:
+		return ok
+	case <-in.closed:
+		return false
+	}
+}
+
+// continued tells a command waiting for a continuation request how the
+// upstream answered.
+func (in *inspector) continued(resp *ProxyResponse) {
+	in.wmu.Lock()
+	defer in.wmu.Unlock()
+
+	if in.waitTag == "" {
+		return
+	}
+	if resp.Tag == "+" || resp.Tag == in.waitTag {
+		in.cont <- resp.Tag == "+"
+		in.waitTag = ""
+	}
+}
+
+func (in *inspector) responseLoop() error {
+	for {
+		line, err := in.u_r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		resp := parseProxyResponse(line)
+		in.continued(resp)
+
+		resp.Data, resp.Complete, err = in.readMessage(in.u_r, line, false)
+		if err != nil {
+			return err
+		}
+		if err := in.respond(resp, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// respond passes resp to the filters and writes it to the client, after,
+// which may be nil, is called once it is written.
+func (in *inspector) respond(resp *ProxyResponse, after func(*ProxyResponse) error) error {
+	for _, f := range in.responses {
+		if !f.FilterResponse(resp) && resp.Complete {
+			return nil
+		}
+	}
+	return in.writeResponse(resp, after)
+}
+
+// writeResponse writes resp and streams the rest of it when it is not
+// complete.
+func (in *inspector) writeResponse(resp *ProxyResponse, after func(*ProxyResponse) error) error {
+	in.cmu.Lock()
+	defer in.cmu.Unlock()
+
+	if _, err := in.c_w.Write(resp.Data); err != nil {
+		return err
+	}
+	if !resp.Complete {
+		line := lastLine(resp.Data)
+		for {
+			n, _, ok := literalSize(line)
+			if !ok {
+				break
+			}
+			if err := pipeCopyN(in.c_w, in.u_r, n); err != nil {
+				return err
+			}
+
+			var err error
+			if line, err = in.u_r.ReadBytes('\n'); err != nil {
+				return err
+			}
+			if _, err := in.c_w.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	if err := in.c_w.Flush(); err != nil {
+		return err
+	}
+	if after != nil {
+		return after(resp)
+	}
+	return nil
+}
+
+func lastLine(data []byte) []byte {
+	i := bytes.LastIndexByte(bytes.TrimSuffix(data, []byte("\n")), '\n')
+	return data[i+1:]
+}
+
+func pipeFlush(w io.Writer) error {
+	if wf, ok := w.(pipeFlusher); ok {
+		return wf.Flush()
+	}
+	return nil
+}
+
+// pipeCopyN copies a literal, flushing as it goes so big ones are streamed.
+func pipeCopyN(w io.Writer, r io.Reader, n int64) error {
+	b := make([]byte, 32*1024)
+	for n > 0 {
+		m, err := r.Read(b[:min(int64(len(b)), n)])
+		if m > 0 {
+			if _, err := w.Write(b[:m]); err != nil {
+				return err
+			}
+			if err := pipeFlush(w); err != nil {
+				return err
+			}
+			n -= int64(m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
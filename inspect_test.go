@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_parseProxyCommand(t *testing.T) {
+	A := Assert.New(t)
+
+	cmd := parseProxyCommand([]byte("a1 uid store 1 +FLAGS (\\Seen)\r\n"))
+	A.Equal("a1", cmd.Tag)
+	A.Equal("UID STORE", cmd.Name)
+
+	cmd = parseProxyCommand([]byte("a2 select INBOX\r\n"))
+	cmd.rename("EXAMINE")
+	A.Equal("a2 EXAMINE INBOX\r\n", string(cmd.Data))
+
+	A.Empty(parseProxyCommand([]byte("DONE\r\n")).Name, "not a command")
+
+	n, sync, ok := literalSize([]byte("a3 APPEND INBOX {12}\r\n"))
+	A.True(ok && sync)
+	A.EqualValues(12, n)
+	n, sync, ok = literalSize([]byte("a3 LOGIN {3+}\r\n"))
+	A.True(ok && !sync)
+	A.EqualValues(3, n)
+	_, _, ok = literalSize([]byte("* OK {x}\r\n"))
+	A.False(ok)
+}
+
+func Test_mailpReadOnly(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  users:
+    auditor:
+      password: "pw"
+      readOnly: true
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+
+	A.NoError(c.Login("auditor", "pw"), "login")
+	mbox, err := c.Select("INBOX", false)
+	A.NoError(err, "select")
+	A.True(mbox.ReadOnly, "select is examine")
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(1)
+	msgs := make(chan *imap.Message, 1)
+	A.NoError(c.Fetch(seq, []imap.FetchItem{imap.FetchEnvelope}, msgs), "fetch")
+	A.NotNil(<-msgs, "fetched")
+
+	err = c.Store(seq, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag}, nil)
+	A.Error(err, "store")
+	A.Contains(err.Error(), "read-only")
+	A.Error(c.UidCopy(seq, "INBOX"), "uid copy")
+	A.Error(c.Create("new"), "create")
+	A.Error(c.Append("INBOX", nil, time.Now(), imap.Literal(strings.NewReader("Subject: x\r\n\r\nx\r\n"))), "append")
+	A.NoError(c.Noop(), "still in sync")
+	A.Error(c.Subscribe("INBOX"), "subscribe, not a read")
+	_, err = c.Search(&imap.SearchCriteria{SeqNum: seq})
+	A.NoError(err, "search")
+
+	// a synchronizing literal is refused before the client sends it
+	nc, err := net.Dial("tcp", "127.0.0.1:1234")
+	A.NoError(err, "dial")
+	defer nc.Close()
+	br := bufio.NewReader(nc)
+	readTagged := func(tag string) string {
+		for {
+			line, err := br.ReadString('\n')
+			A.NoError(err, "read")
+			if strings.HasPrefix(line, tag+" ") {
+				return line
+			}
+		}
+	}
+
+	nc.Write([]byte("a LOGIN auditor pw\r\n"))
+	A.Contains(readTagged("a"), "a OK")
+	nc.Write([]byte("b APPEND INBOX {5}\r\n"))
+	A.Contains(readTagged("b"), "b NO [NOPERM]")
+	nc.Write([]byte("c NOOP\r\n"))
+	A.Contains(readTagged("c"), "c OK")
+	nc.Write([]byte("d SETMETADATA INBOX (/private/comment \"x\")\r\n"))
+	A.Contains(readTagged("d"), "d NO [NOPERM]", "unknown commands too")
+}
+
+type testCommandFilter func(cmd *ProxyCommand) *imap.StatusResp
+
+func (f testCommandFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp { return f(cmd) }
+
+type testResponseFilter func(resp *ProxyResponse) bool
+
+func (f testResponseFilter) FilterResponse(resp *ProxyResponse) bool { return f(resp) }
+
+func Test_inspector(t *testing.T) {
+	A := Assert.New(t)
+
+	client, cproxy := net.Pipe()
+	uproxy, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	var cmds []ProxyCommand
+	var resps []ProxyResponse
+	in := newInspector(&InspectConf{MaxLiteral: 8},
+		[]CommandFilter{testCommandFilter(func(cmd *ProxyCommand) *imap.StatusResp {
+			cmds = append(cmds, *cmd)
+			if cmd.Name == "DELETE" {
+				return &imap.StatusResp{Tag: cmd.Tag, Type: imap.StatusRespNo, Info: "not here"}
+			}
+			return nil
+		})},
+		[]ResponseFilter{testResponseFilter(func(resp *ProxyResponse) bool {
+			resps = append(resps, *resp)
+			return resp.Name != "DROP"
+		})},
+	)
+	go func() {
+		in.pipe(cproxy, imap.NewWriter(bufio.NewWriter(cproxy)), uproxy, uproxy)
+		cproxy.Close()
+		uproxy.Close()
+	}()
+
+	cr := bufio.NewReader(client)
+	ur := bufio.NewReader(upstream)
+	read := func(r *bufio.Reader, n int) string {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		A.NoError(err, "read")
+		return string(b)
+	}
+
+	// small LITERAL+ literals are buffered
+	s := "a1 LOGIN {3+}\r\nabc {3+}\r\ndef\r\n"
+	client.Write([]byte(s))
+	A.Equal(s, read(ur, len(s)))
+	A.True(cmds[0].Complete, "buffered")
+	A.Equal(s, string(cmds[0].Data))
+
+	// big ones are streamed
+	s = "a2 APPEND INBOX {20+}\r\n01234567890123456789\r\n"
+	go client.Write([]byte(s))
+	A.Equal(s, read(ur, len(s)))
+	A.False(cmds[1].Complete, "streamed")
+	A.Equal("a2 APPEND INBOX {20+}\r\n", string(cmds[1].Data))
+
+	// the upstream asks for synchronizing literals
+	client.Write([]byte("a3 APPEND INBOX {5}\r\n"))
+	A.Equal("a3 APPEND INBOX {5}\r\n", read(ur, 21))
+	upstream.Write([]byte("+ go\r\n"))
+	A.Equal("+ go\r\n", read(cr, 6))
+	client.Write([]byte("hello\r\n"))
+	A.Equal("hello\r\n", read(ur, 7))
+	upstream.Write([]byte("a3 OK done\r\n"))
+	A.Equal("a3 OK done\r\n", read(cr, 12))
+
+	// or refuse them, the client does not send the literal
+	client.Write([]byte("a4 APPEND INBOX {5}\r\n"))
+	A.Equal("a4 APPEND INBOX {5}\r\n", read(ur, 21))
+	upstream.Write([]byte("a4 NO too big\r\n"))
+	A.Equal("a4 NO too big\r\n", read(cr, 15))
+	client.Write([]byte("a5 NOOP\r\n"))
+	A.Equal("a5 NOOP\r\n", read(ur, 9))
+
+	// rejected by a filter
+	client.Write([]byte("a6 DELETE x\r\n"))
+	A.Equal("a6 NO not here\r\n", read(cr, 16))
+
+	// responses, dropped, buffered and streamed
+	go upstream.Write([]byte("* DROP me\r\n* 1 FETCH (BODY[] {4}\r\nabcd)\r\n* 2 FETCH (BODY[] {10}\r\n0123456789)\r\na7 OK\r\n"))
+	s = "* 1 FETCH (BODY[] {4}\r\nabcd)\r\n* 2 FETCH (BODY[] {10}\r\n0123456789)\r\na7 OK\r\n"
+	A.Equal(s, read(cr, len(s)))
+	A.Equal("DROP", resps[len(resps)-4].Name)
+	A.True(resps[len(resps)-3].Complete)
+	A.Equal("FETCH", resps[len(resps)-3].Name)
+	A.False(resps[len(resps)-2].Complete)
+	A.Equal("a7", resps[len(resps)-1].Tag)
+}
+
+func Test_mailpInspect(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  inspect:
+    enabled: true
+    maxLiteral: 16
+    log: true
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+
+	A.NoError(c.Login("abc", "pw"), "login")
+	_, err = c.Select("INBOX", false)
+	A.NoError(err, "select")
+
+	body := "Subject: inspected\r\n\r\n" + strings.Repeat("x", 100) + "\r\n"
+	A.NoError(c.Append("INBOX", nil, time.Now(), imap.Literal(strings.NewReader(body))), "append")
+
+	mbox, err := c.Select("INBOX", false)
+	A.NoError(err, "select")
+	seq := new(imap.SeqSet)
+	seq.AddNum(mbox.Messages)
+	section := &imap.BodySectionName{}
+	msgs := make(chan *imap.Message, 1)
+	A.NoError(c.Fetch(seq, []imap.FetchItem{section.FetchItem()}, msgs), "fetch")
+	msg := <-msgs
+	A.NotNil(msg, "fetched")
+	b, err := io.ReadAll(msg.GetBody(section))
+	A.NoError(err, "body")
+	A.Equal(body, string(b))
+
+	stop := make(chan struct{})
+	idleErr := make(chan error, 1)
+	go func() {
+		idleErr <- c.Idle(stop, &client.IdleOptions{PollInterval: -1})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	A.NoError(<-idleErr, "idle")
+
+	A.NoError(c.Noop(), "noop")
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const ldapTimeout = 5 * time.Second
+
+// ldapStore checks passwords with an LDAP simple bind as the DN built from
+// BindDN. A login is a user when a base search finds its DN, as LookupDN or
+// anonymously.
+type ldapStore struct {
+	conf *UserStoreConf
+	d    *net.Dialer
+}
+
+func newLdapStore(conf *UserStoreConf) *ldapStore {
+	return &ldapStore{
+		conf: conf,
+		d:    &net.Dialer{Timeout: ldapTimeout},
+	}
+}
+
+func (s *ldapStore) LookupUser(login string) (*ImapUserConf, string, error) {
+	user, name, err := storeUser(s.conf, login)
+	if err != nil {
+		return nil, "", err
+	}
+	dn, err := s.bindDN(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	lc, err := s.dial()
+	if err != nil {
+		return nil, "", err
+	}
+	defer lc.close()
+
+	ok, err := s.exists(lc, dn)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", errNoSuchUser
+	}
+	return user, name, nil
+}
+
+func (s *ldapStore) VerifyPassword(login, password string) (*ImapUserConf, string, error) {
+	user, name, err := storeUser(s.conf, login)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// an empty password is an unauthenticated bind, which always works
+	if password == "" {
+		return nil, "", errBadPassword
+	}
+
+	dn, err := s.bindDN(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	lc, err := s.dial()
+	if err != nil {
+		return nil, "", err
+	}
+	defer lc.close()
+
+	if err := lc.bind(dn, password); err != nil {
+		// a DN not found is a login for the next stores
+		if err == errBadPassword {
+			if ok, err := s.exists(lc, dn); err == nil && !ok {
+				return nil, "", errNoSuchUser
+			}
+		}
+		return nil, "", err
+	}
+
+	return user, name, nil
+}
+
+// exists searches dn, bound as LookupDN first when there is one. A DN the
+// directory does not show is not found.
+func (s *ldapStore) exists(lc *ldapConn, dn string) (bool, error) {
+	if s.conf.LookupDN != "" {
+		if err := lc.bind(s.conf.LookupDN, s.conf.LookupPassword); err != nil {
+			return false, fmt.Errorf("ldap lookupDN bind: %w", err)
+		}
+	}
+	return lc.search(dn)
+}
+
+// bindDN executes the BindDN template, with values escaped for a DN.
+func (s *ldapStore) bindDN(name string) (string, error) {
+	info := newLoginInfo(name)
+	info.Login = ldapEscapeDN(info.Login)
+	info.Local = ldapEscapeDN(info.Local)
+	info.Domain = ldapEscapeDN(info.Domain)
+
+	tmpl, err := template.New("").Option("missingkey=error").Parse(s.conf.BindDN)
+	if err != nil {
+		return "", fmt.Errorf("ldap bindDN template: %w", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, info); err != nil {
+		return "", fmt.Errorf("ldap bindDN template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// An ldapConn runs requests one at a time.
+type ldapConn struct {
+	c  net.Conn
+	r  *bufio.Reader
+	id int32
+}
+
+func (s *ldapStore) dial() (*ldapConn, error) {
+	c, err := s.d.Dial("tcp", s.conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(ldapTimeout))
+
+	if s.conf.Tls.Enabled {
+		tlsConfig, err := tlsClientConfig(&s.conf.Tls, s.conf.Addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tls.Client(c, tlsConfig)
+	}
+	return &ldapConn{c: c, r: bufio.NewReader(c)}, nil
+}
+
+func (lc *ldapConn) close() {
+	// UnbindRequest ::= [APPLICATION 2] NULL
+	lc.c.Write(berTLV(0x30, berInt(lc.nextID()), berTLV(0x42)))
+	lc.c.Close()
+}
+
+// nextID returns the id of the next message, from 1 again past MaxInt32.
+func (lc *ldapConn) nextID() int64 {
+	if lc.id == math.MaxInt32 {
+		lc.id = 0
+	}
+	lc.id++
+	return int64(lc.id)
+}
+
+// send writes op as the next message.
+func (lc *ldapConn) send(op []byte) error {
+	_, err := lc.c.Write(berTLV(0x30, berInt(lc.nextID()), op))
+	return err
+}
+
+// receive reads the protocol op of the next message.
+func (lc *ldapConn) receive() (berElem, error) {
+	tag, msg, err := readBER(lc.r)
+	if err != nil {
+		return berElem{}, err
+	}
+	if tag != 0x30 {
+		return berElem{}, fmt.Errorf("ldap: bad response tag %#x", tag)
+	}
+	fields, err := parseBERSeq(msg)
+	if err != nil {
+		return berElem{}, err
+	}
+	if len(fields) < 2 {
+		return berElem{}, errors.New("ldap: bad response")
+	}
+	return fields[1], nil
+}
+
+// ldapResult returns the resultCode and diagnosticMessage of an LDAPResult.
+func ldapResult(op berElem) (byte, string, error) {
+	res, err := parseBERSeq(op.value)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(res) < 3 || res[0].tag != 0x0a || len(res[0].value) == 0 {
+		return 0, "", errors.New("ldap: bad result")
+	}
+	return res[0].value[len(res[0].value)-1], string(res[2].value), nil
+}
+
+// bind does a simple bind, it returns errBadPassword for invalidCredentials.
+func (lc *ldapConn) bind(dn, password string) error {
+	// BindRequest ::= [APPLICATION 0] SEQUENCE {
+	//     version INTEGER, name LDAPDN, authentication simple [0] OCTET STRING }
+	if err := lc.send(berTLV(0x60,
+		berInt(3),
+		berTLV(0x04, []byte(dn)),
+		berTLV(0x80, []byte(password)),
+	)); err != nil {
+		return err
+	}
+
+	// BindResponse ::= [APPLICATION 1] SEQUENCE {
+	//     resultCode ENUMERATED, matchedDN, diagnosticMessage, ... }
+	op, err := lc.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != 0x61 {
+		return errors.New("ldap: want bind response")
+	}
+	code, msg, err := ldapResult(op)
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case 0:
+		return nil
+	case 49: // invalidCredentials
+		return errBadPassword
+	default:
+		return fmt.Errorf("ldap: bind result %d: %s", code, msg)
+	}
+}
+
+// search reports whether a base search finds dn, noSuchObject and
+// insufficientAccessRights are not found.
+func (lc *ldapConn) search(dn string) (bool, error) {
+	// SearchRequest ::= [APPLICATION 3] SEQUENCE {
+	//     baseObject LDAPDN, scope baseObject, derefAliases neverDerefAliases,
+	//     sizeLimit 1, timeLimit, typesOnly FALSE,
+	//     filter present [7] objectClass, attributes { "1.1" } }
+	if err := lc.send(berTLV(0x63,
+		berTLV(0x04, []byte(dn)),
+		berTLV(0x0a, []byte{0}),
+		berTLV(0x0a, []byte{0}),
+		berInt(1),
+		berInt(int64(ldapTimeout/time.Second)),
+		berTLV(0x01, []byte{0}),
+		berTLV(0x87, []byte("objectClass")),
+		berTLV(0x30, berTLV(0x04, []byte("1.1"))),
+	)); err != nil {
+		return false, err
+	}
+
+	found := false
+	for {
+		op, err := lc.receive()
+		if err != nil {
+			return false, err
+		}
+		switch op.tag {
+		case 0x64: // SearchResultEntry
+			found = true
+		case 0x73: // SearchResultReference
+		case 0x65: // SearchResultDone
+			code, msg, err := ldapResult(op)
+			if err != nil {
+				return false, err
+			}
+			switch code {
+			case 0:
+				return found, nil
+			case 32, 50: // noSuchObject, insufficientAccessRights
+				return false, nil
+			default:
+				return false, fmt.Errorf("ldap: search result %d: %s", code, msg)
+			}
+		default:
+			return false, fmt.Errorf("ldap: unexpected response %#x", op.tag)
+		}
+	}
+}
+
+// ldapEscapeDN escapes s for an attribute value of a DN, RFC 4514.
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, ch) >= 0,
+			(ch == ' ' || ch == '#') && i == 0,
+			ch == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// berTLV encodes a BER tag, length and the concatenated contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// berInt encodes n as a BER INTEGER, the fewest two's complement bytes.
+func berInt(n int64) []byte {
+	b := []byte{byte(n)}
+	for n >= 0x80 || n < -0x80 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berTLV(0x02, b)
+}
+
+// readBER reads one BER element, only definite lengths are supported.
+func readBER(r io.ByteReader) (tag byte, value []byte, err error) {
+	if tag, err = r.ReadByte(); err != nil {
+		return
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	n := int(l)
+	if l&0x80 != 0 {
+		nb := int(l & 0x7f)
+		if nb == 0 || nb > 4 {
+			return 0, nil, errors.New("ber: unsupported length")
+		}
+		n = 0
+		for i := 0; i < nb; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("ber: too long")
+	}
+
+	value = make([]byte, n)
+	for i := range value {
+		if value[i], err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	return tag, value, nil
+}
+
+type berElem struct {
+	tag   byte
+	value []byte
+}
+
+// parseBERSeq parses the contents of a constructed element.
+func parseBERSeq(b []byte) ([]berElem, error) {
+	r := &byteReader{b: b}
+	var elems []berElem
+	for r.i < len(b) {
+		tag, value, err := readBER(r)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, berElem{tag, value})
+	}
+	return elems, nil
+}
+
+type byteReader struct {
+	b []byte
+	i int
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.i >= len(r.b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.i++
+	return r.b[r.i-1], nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	quotaWindow       = 24 * time.Hour
+	quotaSaveInterval = time.Minute
+	// bytes per second of the sessions of an account over its dailyQuota
+	overQuotaRate = 16 << 10
+)
+
+// A tokenBucket holds up to one second of rate, a take may go into debt
+// and is told how long to wait it out.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+}
+
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// A limiter holds the rateLimit buckets of users and the dailyQuota usage
+// of upstream accounts, by hour.
+type limiter struct {
+	file string
+
+	mu      sync.Mutex
+	down    map[string]*tokenBucket
+	up      map[string]*tokenBucket
+	over    map[string]*tokenBucket
+	usage   map[string]map[int64]int64
+	changed bool
+}
+
+// newLimiter reads the usage saved in file, which may be empty.
+func newLimiter(file string) (*limiter, error) {
+	l := &limiter{
+		file:  file,
+		down:  map[string]*tokenBucket{},
+		up:    map[string]*tokenBucket{},
+		over:  map[string]*tokenBucket{},
+		usage: map[string]map[int64]int64{},
+	}
+	if file == "" {
+		return l, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read quota file fail: %w", err)
+	}
+	if err := json.Unmarshal(b, &l.usage); err != nil {
+		return nil, fmt.Errorf("bad quota file %s: %w", file, err)
+	}
+	return l, nil
+}
+
+func quotaHour(t time.Time) int64 {
+	return t.Unix() / 3600
+}
+
+// add counts n bytes for account in the current hour.
+func (l *limiter) add(account string, n int64) {
+	hour := quotaHour(time.Now())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hours := l.usage[account]
+	if hours == nil {
+		hours = map[int64]int64{}
+		l.usage[account] = hours
+	}
+	hours[hour] += n
+	l.changed = true
+}
+
+// used returns the bytes of account in the last 24h, older hours are
+// dropped.
+func (l *limiter) used(account string) int64 {
+	oldest := quotaHour(time.Now().Add(-quotaWindow))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int64
+	for hour, b := range l.usage[account] {
+		if hour <= oldest {
+			delete(l.usage[account], hour)
+			continue
+		}
+		n += b
+	}
+	return n
+}
+
+// bucket returns the bucket of key in m, with rate.
+func (l *limiter) bucket(m map[string]*tokenBucket, key string, rate int64) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := m[key]
+	if b == nil {
+		b = newTokenBucket(rate)
+		m[key] = b
+	} else {
+		b.setRate(rate)
+	}
+	return b
+}
+
+// save writes the usage to the file, when it changed.
+func (l *limiter) save() error {
+	if l.file == "" {
+		return nil
+	}
+
+	oldest := quotaHour(time.Now().Add(-quotaWindow))
+
+	l.mu.Lock()
+	if !l.changed {
+		l.mu.Unlock()
+		return nil
+	}
+	for account, hours := range l.usage {
+		for hour := range hours {
+			if hour <= oldest {
+				delete(hours, hour)
+			}
+		}
+		if len(hours) == 0 {
+			delete(l.usage, account)
+		}
+	}
+	b, err := json.Marshal(l.usage)
+	l.changed = false
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.file), ".quota-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), l.file)
+}
+
+// runQuotaSave saves the usage every quotaSaveInterval until done.
+func (mp *Mailp) runQuotaSave(l *limiter, done chan struct{}) {
+	t := time.NewTicker(quotaSaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := l.save(); err != nil {
+				mp.log.Printf("save quota file fail: %s\n", err)
+			}
+		}
+	}
+}
+
+// quotaAccount names the upstream account of a login, the dailyQuota
+// is kept by it.
+func quotaAccount(login string, conf *ImapUpstreamConf) string {
+	username := conf.Auth.Username
+	if username == "" || conf.Auth.Type == "passthrough" {
+		username = login
+	}
+	return username + "@" + strings.Join(conf.addrs(), ",")
+}
+
+// sessionLimits are the limits of one session after login.
+type sessionLimits struct {
+	l       *limiter
+	account string
+	quota   int64
+	// nil is no limit
+	down, up *tokenBucket
+}
+
+// newSessionLimits returns the limits of the user name, the login without
+// the upstream selector, shared whatever upstream a session picks.
+func (mp *Mailp) newSessionLimits(name string, conf *ImapUserConf) *sessionLimits {
+	if mp.limits == nil || (conf.RateLimit.Down <= 0 && conf.RateLimit.Up <= 0 && conf.Upstream.DailyQuota <= 0) {
+		return nil
+	}
+
+	l := mp.limits
+	s := &sessionLimits{l: l}
+	if conf.RateLimit.Down > 0 {
+		s.down = l.bucket(l.down, name, conf.RateLimit.Down)
+	}
+	if conf.RateLimit.Up > 0 {
+		s.up = l.bucket(l.up, name, conf.RateLimit.Up)
+	}
+	if conf.Upstream.DailyQuota > 0 {
+		s.account = quotaAccount(name, &conf.Upstream)
+		s.quota = conf.Upstream.DailyQuota
+	}
+	return s
+}
+
+func (s *sessionLimits) overQuota() bool {
+	return s.quota > 0 && s.l.used(s.account) >= s.quota
+}
+
+// reader counts the bytes of r for the quota and waits for b, and for
+// overQuotaRate when over the quota.
+func (s *sessionLimits) reader(r io.Reader, b *tokenBucket) io.Reader {
+	if b == nil && s.quota <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, s: s, b: b}
+}
+
+type limitedReader struct {
+	r io.Reader
+	s *sessionLimits
+	b *tokenBucket
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+
+	var wait time.Duration
+	if r.b != nil {
+		wait = r.b.take(n)
+	}
+	if s := r.s; s.quota > 0 {
+		s.l.add(s.account, int64(n))
+		if s.overQuota() {
+			wait = max(wait, s.l.bucket(s.l.over, s.account, overQuotaRate).take(n))
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// quotaAllowed are commands still answered over the quota.
+var quotaAllowed = map[string]bool{
+	"CAPABILITY": true,
+	"NOOP":       true,
+	"LOGOUT":     true,
+}
+
+// quotaFilter refuses commands with NO [LIMIT] once the account is over
+// its dailyQuota.
+type quotaFilter struct {
+	s *sessionLimits
+}
+
+func (f *quotaFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	if quotaAllowed[cmd.Name] || !f.s.overQuota() {
+		return nil
+	}
+	return &imap.StatusResp{
+		Tag:  cmd.Tag,
+		Type: imap.StatusRespNo,
+		Code: "LIMIT",
+		Info: "daily transfer quota exceeded",
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_limiter(t *testing.T) {
+	A := Assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "quota.json")
+	l, err := newLimiter(file)
+	A.NoError(err, "newLimiter")
+
+	l.add("a@x", 100)
+	l.add("a@x", 20)
+	l.usage["a@x"][quotaHour(time.Now().Add(-25*time.Hour))] = 1000
+	A.EqualValues(120, l.used("a@x"), "older than 24h is dropped")
+	A.NoError(l.save(), "save")
+
+	l, err = newLimiter(file)
+	A.NoError(err, "reload")
+	A.EqualValues(120, l.used("a@x"), "kept across restarts")
+	A.Zero(l.used("b@x"))
+
+	b := newTokenBucket(1000)
+	A.Zero(b.take(1000), "burst")
+	A.InDelta(float64(500*time.Millisecond), float64(b.take(500)), float64(20*time.Millisecond), "debt")
+}
+
+func Test_mailpRateLimit(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	file := filepath.Join(t.TempDir(), "quota.json")
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  quotaFile: ` + file + `
+  users:
+    abc:
+      password: "pw"
+      rateLimit:
+        up: 4000
+      upstream:
+        addr: 127.0.0.1:1233
+        dailyQuota: 8000
+        auth:
+          type: plain
+          username: username
+          password: password
+      upstreams:
+        work:
+          addr: 127.0.0.1:1233
+          auth:
+            type: plain
+            username: username
+            password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	A.NoError(c.Login("abc", "pw"), "login")
+
+	body := "Subject: big\r\n\r\n" + strings.Repeat("x", 8000) + "\r\n"
+	start := time.Now()
+	A.NoError(c.Append("INBOX", nil, time.Now(), imap.Literal(strings.NewReader(body))), "append")
+	A.Greater(time.Since(start), 800*time.Millisecond, "throttled up")
+
+	_, err = c.Select("INBOX", false)
+	A.Error(err, "over quota")
+	A.Contains(err.Error(), "quota")
+	A.NoError(c.Noop(), "noop still answered")
+
+	// by the user, whatever upstream the login picks
+	c2, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c2.Terminate()
+	A.NoError(c2.Login("abc+work", "pw"), "login with a selector")
+	var keys []string
+	mp.limits.mu.Lock()
+	for key := range mp.limits.up {
+		keys = append(keys, key)
+	}
+	mp.limits.mu.Unlock()
+	A.Equal([]string{"abc"}, keys, "one bucket")
+
+	A.NoError(mp.Stop(), "stop")
+	l, err := newLimiter(file)
+	A.NoError(err, "read quota file")
+	A.GreaterOrEqual(l.used("username@127.0.0.1:1233"), int64(8000), "saved at stop")
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultJournalSocket = "/run/systemd/journal/socket"
+
+	// the example enterprise number of RFC 5612
+	syslogSdId = "mailp@32473"
+
+	syslogFacilityDaemon = 3
+	severityInfo         = 6
+	severityDebug        = 7
+)
+
+// A logEntry is a line of the log, or of connLog traces, with the conn it
+// belongs to.
+type logEntry struct {
+	time  time.Time
+	cid   int64
+	user  string
+	trace bool
+	msg   string
+}
+
+func (e *logEntry) severity() int {
+	if e.trace {
+		return severityDebug
+	}
+	return severityInfo
+}
+
+// A logSink takes entries when log.output is not stderr.
+type logSink interface {
+	write(e *logEntry) error
+	Close() error
+}
+
+// newLogSink returns nil for stderr.
+func newLogSink(conf *LogConf) (logSink, error) {
+	if conf.Output == "" || conf.Output == "stderr" {
+		return nil, nil
+	}
+	if conf.Output == "journald" {
+		return newJournalSink(defaultJournalSocket)
+	}
+
+	u, err := url.Parse(conf.Output)
+	if err != nil {
+		return nil, fmt.Errorf("bad log.output: %w", err)
+	}
+	switch u.Scheme {
+	case "syslog", "syslog+udp":
+		return newSyslogSink("udp", u.Host)
+	case "syslog+tcp":
+		return newSyslogSink("tcp", u.Host)
+	case "journald":
+		return newJournalSink(u.Path)
+	}
+	return nil, fmt.Errorf("bad log.output %s", conf.Output)
+}
+
+// A syslogSink sends RFC 5424 messages, one per datagram over udp and octet
+// counted over tcp, with cid and user as structured data.
+type syslogSink struct {
+	network, addr string
+	hostname      string
+
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func newSyslogSink(network, addr string) (*syslogSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "514")
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	s := &syslogSink{network: network, addr: addr, hostname: hostname}
+	if err := s.connect(); err != nil {
+		return nil, fmt.Errorf("dial log syslog fail: %w", err)
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() error {
+	c, err := net.DialTimeout(s.network, s.addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	s.c = c
+	return nil
+}
+
+// format returns the message, <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID
+// MSGID SD MSG.
+func (s *syslogSink) format(e *logEntry) []byte {
+	msgid := "log"
+	if e.trace {
+		msgid = "trace"
+	}
+
+	sd := "-"
+	if e.cid > 0 {
+		sd = fmt.Sprintf(`[%s cid="%d"`, syslogSdId, e.cid)
+		if e.user != "" {
+			sd += ` user="` + syslogParamEscape(e.user) + `"`
+		}
+		sd += "]"
+	}
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s mailp %d %s %s %s",
+		syslogFacilityDaemon*8+e.severity(),
+		e.time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, os.Getpid(), msgid, sd, e.msg))
+}
+
+func syslogParamEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
+
+func (s *syslogSink) write(e *logEntry) error {
+	msg := s.format(e)
+	if s.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.c == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	_, err := s.c.Write(msg)
+	if err != nil && s.network == "tcp" {
+		// the server went away, once more on a new conn
+		s.c.Close()
+		s.c = nil
+		if err = s.connect(); err == nil {
+			_, err = s.c.Write(msg)
+		}
+	}
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.c == nil {
+		return nil
+	}
+	err := s.c.Close()
+	s.c = nil
+	return err
+}
+
+// A journalSink sends entries with the native journald protocol, a
+// datagram of fields per entry, or a file for the big ones.
+type journalSink struct {
+	c *net.UnixConn
+}
+
+func newJournalSink(path string) (*journalSink, error) {
+	if path == "" {
+		path = defaultJournalSocket
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("dial journald fail: %w", err)
+	}
+	return &journalSink{c: c}, nil
+}
+
+// journalField appends KEY=value, or the binary form for values with a
+// newline.
+func journalField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func (s *journalSink) write(e *logEntry) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", e.msg)
+	journalField(&b, "PRIORITY", strconv.Itoa(e.severity()))
+	journalField(&b, "SYSLOG_IDENTIFIER", "mailp")
+	if e.cid > 0 {
+		journalField(&b, "MAILP_CID", strconv.FormatInt(e.cid, 10))
+	}
+	if e.user != "" {
+		journalField(&b, "MAILP_USER", e.user)
+	}
+	if e.trace {
+		journalField(&b, "MAILP_TRACE", "1")
+	}
+
+	_, err := s.c.Write(b.Bytes())
+	if errors.Is(err, syscall.EMSGSIZE) {
+		err = s.writeFile(b.Bytes())
+	}
+	return err
+}
+
+// writeFile passes an entry too big for a datagram as an unlinked file in
+// /dev/shm, like sd_journal_sendv does when it has no memfd.
+func (s *journalSink) writeFile(entry []byte) error {
+	dir := "/dev/shm"
+	if _, err := os.Stat(dir); err != nil {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "mailp-journal-")
+	if err != nil {
+		return fmt.Errorf("journal file fail: %w", err)
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+
+	if _, err := f.Write(entry); err != nil {
+		return fmt.Errorf("journal file fail: %w", err)
+	}
+
+	// net refuses WriteMsgUnix on a connected unixgram
+	rc, err := s.c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Write(func(fd uintptr) bool {
+		serr = syscall.Sendmsg(int(fd), nil, syscall.UnixRights(int(f.Fd())), nil, 0)
+		return serr != syscall.EAGAIN
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+func (s *journalSink) Close() error {
+	return s.c.Close()
+}
+
+// logWriter is the writer of mp.log, lines go to the sink with the cid of
+// their "conn(N)" prefix.
+type logWriter struct {
+	mp *Mailp
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	sink := w.mp.getLogSink()
+	if sink == nil {
+		return os.Stderr.Write(b)
+	}
+
+	msg := strings.TrimSuffix(strings.TrimPrefix(string(b), "+ "), "\n")
+	e := &logEntry{time: time.Now(), msg: msg}
+	if rest, ok := strings.CutPrefix(msg, "conn("); ok {
+		if n, _, ok := strings.Cut(rest, ")"); ok {
+			e.cid, _ = strconv.ParseInt(n, 10, 64)
+			e.user = w.mp.sessionUser(e.cid)
+		}
+	}
+	if err := sink.write(e); err != nil {
+		os.Stderr.Write(b)
+	}
+	return len(b), nil
+}
+
+// traceWriter takes the connLog traces of a conn, each write is the
+// direction prefix and the bytes. A sink gets one entry per line.
+type traceWriter struct {
+	mp  *Mailp
+	cid int64
+}
+
+func (mp *Mailp) traceWriter(cid int64) *traceWriter {
+	return &traceWriter{mp: mp, cid: cid}
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	prefix, data := "", string(b)
+	if len(data) >= 3 && (data[1] == '>' || data[1] == '<') && data[2] == ' ' {
+		prefix, data = data[:3], data[3:]
+	}
+	lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	masked := false
+	if prefix == "c> " || prefix == "s< " {
+		for i, line := range lines {
+			if m := maskTraceLine(line); m != line {
+				lines[i], masked = m, true
+			}
+		}
+	}
+
+	sink := w.mp.getLogSink()
+	if sink == nil {
+		if masked {
+			b = []byte(prefix + strings.Join(lines, "\n") + "\n")
+		}
+		return os.Stderr.Write(b)
+	}
+
+	user := w.mp.sessionUser(w.cid)
+	now := time.Now()
+	for _, line := range lines {
+		e := &logEntry{
+			time:  now,
+			cid:   w.cid,
+			user:  user,
+			trace: true,
+			msg:   prefix + strings.TrimSuffix(line, "\r"),
+		}
+		if err := sink.write(e); err != nil {
+			os.Stderr.Write([]byte(prefix + strings.Join(lines, "\n") + "\n"))
+			break
+		}
+	}
+	return len(b), nil
+}
+
+// base64Re is a line that is only base64, like SASL responses.
+var base64Re = regexp.MustCompile(`^[A-Za-z0-9+/]{8,}={0,2}$`)
+
+// maskTraceLine hides the secrets of a line sent to a server: LOGIN and
+// PASS passwords, SASL responses and APOP digests. Literals of LOGIN are
+// not followed, the lines after are only masked when they are base64.
+func maskTraceLine(line string) string {
+	const mask = "***"
+	cr := ""
+	if strings.HasSuffix(line, "\r") {
+		line, cr = line[:len(line)-1], "\r"
+	}
+	if base64Re.MatchString(line) {
+		return mask + cr
+	}
+
+	// POP3 commands come first, IMAP ones after the tag; the user name or
+	// mechanism is kept, what follows goes
+	f := strings.Fields(line)
+	keep := 0
+	switch {
+	case len(f) > 0 && strings.EqualFold(f[0], "PASS"):
+		keep = 1
+	case len(f) > 0 && (strings.EqualFold(f[0], "APOP") || strings.EqualFold(f[0], "AUTH")):
+		keep = 2
+	case len(f) > 1 && (strings.EqualFold(f[1], "LOGIN") || strings.EqualFold(f[1], "AUTHENTICATE")):
+		keep = 3
+	}
+	if keep == 0 || len(f) <= keep {
+		return line + cr
+	}
+	return strings.Join(f[:keep], " ") + " " + mask + cr
+}
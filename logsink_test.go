@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpLogSyslog(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:1242")
+	A.NoError(err, "listen syslog")
+	defer pc.Close()
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+log:
+  output: syslog://127.0.0.1:1242
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	A.NoError(c.Login("abc", "pw"), "login")
+	A.NoError(c.Noop(), "noop")
+	c.Terminate()
+
+	var logged, traced bool
+	buf := make([]byte, 64<<10)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !(logged && traced) {
+		n, _, err := pc.ReadFrom(buf)
+		A.NoError(err, "read syslog")
+		msg := string(buf[:n])
+
+		A.Regexp(`^<\d+>1 \S+ \S+ mailp \d+ (log|trace) `, msg)
+		A.NotContains(msg, "\n", "one line per message")
+		A.NotContains(msg, " pw", "client password masked")
+		A.NotContains(msg, "dXNlcm5hbWUAdXNlcm5hbWUAcGFzc3dvcmQ=", "upstream password masked")
+		if strings.Contains(msg, " log ") && strings.Contains(msg, `user="abc"] conn(`) {
+			logged = true
+		}
+		if strings.HasPrefix(msg, "<31>1 ") && strings.Contains(msg, `user="abc"] c> `) && strings.HasSuffix(msg, "NOOP") {
+			traced = true
+		}
+	}
+}
+
+func Test_maskTraceLine(t *testing.T) {
+	A := Assert.New(t)
+
+	for line, want := range map[string]string{
+		"a1 LOGIN abc pw\r":                  "a1 LOGIN abc ***\r",
+		"a1 login \"abc\" \"p w\"":           "a1 login \"abc\" ***",
+		"a2 AUTHENTICATE PLAIN AGFiYwBwdw==": "a2 AUTHENTICATE PLAIN ***",
+		"a2 AUTHENTICATE PLAIN":              "a2 AUTHENTICATE PLAIN",
+		"AGFiYwBwdw==\r":                     "***\r",
+		"PASS secret":                        "PASS ***",
+		"APOP abc 0123456789abcdef":          "APOP abc ***",
+		"AUTH PLAIN AGFiYwBwdw==":            "AUTH PLAIN ***",
+		"a3 SELECT INBOX":                    "a3 SELECT INBOX",
+		"* OK done":                          "* OK done",
+	} {
+		A.Equal(want, maskTraceLine(line), line)
+	}
+}
+
+func Test_journalSink(t *testing.T) {
+	A := Assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	A.NoError(err, "listen journal")
+	defer pc.Close()
+
+	sink, err := newLogSink(&LogConf{Output: "journald://" + path})
+	A.NoError(err, "newLogSink")
+	defer sink.Close()
+
+	buf := make([]byte, 4096)
+	read := func() []byte {
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := pc.Read(buf)
+		A.NoError(err, "read journal")
+		return buf[:n]
+	}
+
+	A.NoError(sink.write(&logEntry{cid: 3, user: "abc", msg: "conn(3) pipe"}))
+	A.Equal("MESSAGE=conn(3) pipe\nPRIORITY=6\nSYSLOG_IDENTIFIER=mailp\nMAILP_CID=3\nMAILP_USER=abc\n", string(read()))
+
+	A.NoError(sink.write(&logEntry{trace: true, msg: "a\nb"}))
+	want := &bytes.Buffer{}
+	want.WriteString("MESSAGE\n")
+	binary.Write(want, binary.LittleEndian, uint64(3))
+	want.WriteString("a\nb\nPRIORITY=7\nSYSLOG_IDENTIFIER=mailp\nMAILP_TRACE=1\n")
+	A.Equal(want.String(), string(read()), "binary safe field")
+
+	// over the datagram limit the entry comes as a file
+	big := strings.Repeat("x", 1<<20)
+	A.NoError(sink.write(&logEntry{msg: big}))
+	oob := make([]byte, 64)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, oobn, _, _, err := pc.ReadMsgUnix(buf, oob)
+	A.NoError(err, "read journal")
+	A.Zero(n, "empty datagram")
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	A.NoError(err)
+	A.Len(msgs, 1)
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	A.NoError(err)
+	A.Len(fds, 1)
+	f := os.NewFile(uintptr(fds[0]), "journal")
+	defer f.Close()
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 2<<20))
+	A.NoError(err)
+	A.Equal("MESSAGE="+big+"\nPRIORITY=6\nSYSLOG_IDENTIFIER=mailp\n", string(b))
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// mailboxArgs are the arguments of commands that are mailbox names, after
+// the tag and name.
+var mailboxArgs = map[string][]int{
+	"SELECT":      {0},
+	"EXAMINE":     {0},
+	"STATUS":      {0},
+	"APPEND":      {0},
+	"CREATE":      {0},
+	"DELETE":      {0},
+	"SUBSCRIBE":   {0},
+	"UNSUBSCRIBE": {0},
+	"RENAME":      {0, 1},
+	"COPY":        {1},
+	"MOVE":        {1},
+	"UID COPY":    {1},
+	"UID MOVE":    {1},
+	// ACL, QUOTA and METADATA
+	"GETACL":       {0},
+	"SETACL":       {0},
+	"DELETEACL":    {0},
+	"MYRIGHTS":     {0},
+	"LISTRIGHTS":   {0},
+	"GETQUOTAROOT": {0},
+	"GETMETADATA":  {0},
+	"SETMETADATA":  {0},
+}
+
+// mailboxResps are the untagged responses with a mailbox name, by its
+// token.
+var mailboxResps = map[string]int{
+	"LIST":       4,
+	"LSUB":       4,
+	"XLIST":      4,
+	"STATUS":     2,
+	"ACL":        2,
+	"MYRIGHTS":   2,
+	"LISTRIGHTS": 2,
+	"QUOTAROOT":  2,
+	"METADATA":   2,
+}
+
+// mailboxFilter hides and renames mailboxes, clients see the names of
+// MailboxesConf.Rename and never the hidden ones.
+type mailboxFilter struct {
+	conf *MailboxesConf
+
+	mu sync.Mutex
+	// client patterns of the LIST, LSUB and XLIST commands sent as "*", by
+	// tag
+	lists map[string]string
+}
+
+func newMailboxFilter(conf *MailboxesConf) *mailboxFilter {
+	return &mailboxFilter{conf: conf, lists: map[string]string{}}
+}
+
+// visible reports whether the upstream mailbox name is shown.
+func (c *MailboxesConf) visible(name string) bool {
+	if name == "" {
+		return true
+	}
+	ok := len(c.Include) == 0
+	for _, p := range c.Include {
+		if matchMailbox(p, name, 0) {
+			ok = true
+			break
+		}
+	}
+	for _, p := range c.Exclude {
+		if matchMailbox(p, name, 0) {
+			return false
+		}
+	}
+	return ok
+}
+
+func (c *MailboxesConf) delimiter() string {
+	if c.Delimiter == "" {
+		return "/"
+	}
+	return c.Delimiter
+}
+
+// renamed returns name with its prefix from replaced by to, the prefix is
+// the whole name or ends at a hierarchy delimiter.
+func (c *MailboxesConf) renamed(name, from, to string) (string, bool) {
+	from, to = canonicalMailbox(from), canonicalMailbox(to)
+	if name == from {
+		return to, true
+	}
+	if strings.HasPrefix(name, from+c.delimiter()) {
+		return to + name[len(from):], true
+	}
+	return "", false
+}
+
+// toUpstream returns the upstream name of a client name, false when the
+// client can not see it. Renames apply to children too, the longest one.
+func (c *MailboxesConf) toUpstream(name string) (string, bool) {
+	name = canonicalMailbox(name)
+	upstream := name
+	shadowed := false
+	longest := -1
+	for from, to := range c.Rename {
+		if _, ok := c.renamed(name, from, from); ok {
+			// renamed away, shadowed by the new name
+			shadowed = true
+		}
+		if u, ok := c.renamed(name, to, from); ok && len(to) > longest {
+			upstream = u
+			longest = len(to)
+		}
+	}
+	if longest < 0 && shadowed {
+		return "", false
+	}
+	return upstream, c.visible(upstream)
+}
+
+// toClient returns the name clients see for an upstream name, false when
+// it is hidden.
+func (c *MailboxesConf) toClient(name string) (string, bool) {
+	name = canonicalMailbox(name)
+	if !c.visible(name) {
+		return "", false
+	}
+	client := name
+	longest := -1
+	for from, to := range c.Rename {
+		if n, ok := c.renamed(name, from, to); ok && len(from) > longest {
+			client = n
+			longest = len(from)
+		}
+	}
+	return client, true
+}
+
+func canonicalMailbox(name string) string {
+	if strings.EqualFold(name, imap.InboxName) {
+		return imap.InboxName
+	}
+	return name
+}
+
+// matchMailbox matches name against a LIST pattern, * matches anything and
+// % anything but delim.
+func matchMailbox(pattern, name string, delim byte) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if matchMailbox(pattern[1:], name[i:], delim) {
+				return true
+			}
+			if i < len(name) && pattern[0] == '%' && delim != 0 && name[i] == delim {
+				return false
+			}
+		}
+		return false
+	}
+	if name == "" || pattern[0] != name[0] {
+		return false
+	}
+	return matchMailbox(pattern[1:], name[1:], delim)
+}
+
+func decodeMailbox(s string) string {
+	if d, err := utf7.Encoding.NewDecoder().String(s); err == nil {
+		return d
+	}
+	return s
+}
+
+func encodeMailbox(s string) string {
+	if e, err := utf7.Encoding.NewEncoder().String(s); err == nil {
+		return e
+	}
+	return s
+}
+
+func quoteMailbox(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(encodeMailbox(name)) + `"`
+}
+
+func nonexistentResp(tag string) *imap.StatusResp {
+	return &imap.StatusResp{
+		Tag:  tag,
+		Type: imap.StatusRespNo,
+		Code: "NONEXISTENT",
+		Info: "Unknown Mailbox",
+	}
+}
+
+func (f *mailboxFilter) FilterCommand(cmd *ProxyCommand) *imap.StatusResp {
+	if cmd.Name == "LIST" || cmd.Name == "LSUB" || cmd.Name == "XLIST" {
+		return f.filterList(cmd)
+	}
+
+	idxs, ok := mailboxArgs[cmd.Name]
+	if !ok {
+		return nil
+	}
+
+	skip := 2
+	if strings.HasPrefix(cmd.Name, "UID ") {
+		skip = 3
+	}
+	if cmd.Name == "GETMETADATA" {
+		// options come first
+		if toks := imapTokens(cmd.Data, 3); len(toks) == 3 && toks[2].list {
+			skip = 3
+		}
+	}
+	need := skip + idxs[len(idxs)-1] + 1
+	toks := imapTokens(cmd.Data, need)
+	if len(toks) < need {
+		// a bad command is for the upstream to answer, a name in a
+		// streamed literal can not be checked
+		if cmd.Complete {
+			return nil
+		}
+		return &imap.StatusResp{
+			Tag:  cmd.Tag,
+			Type: imap.StatusRespNo,
+			Info: "mailbox name literal too big",
+		}
+	}
+
+	data := string(cmd.Data)
+	// back to front, spans stay valid
+	for i := len(idxs) - 1; i >= 0; i-- {
+		tok := toks[skip+idxs[i]]
+		if tok.value == "" && strings.HasSuffix(cmd.Name, "METADATA") {
+			// the server annotations
+			continue
+		}
+		upstream, ok := f.conf.toUpstream(decodeMailbox(tok.value))
+		if !ok {
+			return nonexistentResp(cmd.Tag)
+		}
+		data = data[:tok.start] + quoteMailbox(upstream) + data[tok.end:]
+	}
+	cmd.Data = []byte(data)
+	return nil
+}
+
+// filterList sends LIST "" "*" upstream and keeps the client pattern to
+// filter the responses, LIST with selection or return options is sent as
+// is.
+func (f *mailboxFilter) filterList(cmd *ProxyCommand) *imap.StatusResp {
+	toks := imapTokens(cmd.Data, 5)
+	if len(toks) != 4 || toks[2].list || toks[3].list {
+		return nil
+	}
+
+	pattern := canonicalMailbox(decodeMailbox(toks[2].value + toks[3].value))
+	if pattern == "" {
+		// the hierarchy delimiter
+		return nil
+	}
+
+	f.mu.Lock()
+	f.lists[cmd.Tag] = pattern
+	f.mu.Unlock()
+
+	cmd.Data = []byte(string(cmd.Data[:toks[2].start]) + `"" "*"` + string(cmd.Data[toks[3].end:]))
+	return nil
+}
+
+func (f *mailboxFilter) FilterResponse(resp *ProxyResponse) bool {
+	if resp.Tag != "*" {
+		if resp.Tag != "+" {
+			f.mu.Lock()
+			delete(f.lists, resp.Tag)
+			f.mu.Unlock()
+		}
+		return true
+	}
+
+	// * LIST (attrs) delim name, * STATUS name (items)
+	idx, ok := mailboxResps[resp.Name]
+	if !ok {
+		return true
+	}
+
+	toks := imapTokens(resp.Data, idx+1)
+	if len(toks) < idx+1 {
+		return true
+	}
+	tok := toks[idx]
+
+	name, ok := f.conf.toClient(decodeMailbox(tok.value))
+	if !ok {
+		return false
+	}
+
+	if idx == 4 {
+		var delim byte
+		if d := toks[3]; !d.nil && len(d.value) == 1 {
+			delim = d.value[0]
+		}
+
+		f.mu.Lock()
+		matched := len(f.lists) == 0
+		for _, pattern := range f.lists {
+			if matchMailbox(pattern, name, delim) {
+				matched = true
+				break
+			}
+		}
+		f.mu.Unlock()
+		if !matched {
+			return false
+		}
+	}
+
+	resp.Data = []byte(string(resp.Data[:tok.start]) + quoteMailbox(name) + string(resp.Data[tok.end:]))
+	return true
+}
+
+// An imapToken is an argument of a command or response, start and end are
+// its bytes.
+type imapToken struct {
+	start, end int
+	// atoms, quoted strings and literals, lists are kept raw
+	value string
+	list  bool
+	nil   bool
+}
+
+// imapTokens splits the first max arguments of data, the tag included. A
+// literal not in data ends the tokens.
+func imapTokens(data []byte, max int) []imapToken {
+	var toks []imapToken
+	i := 0
+	for len(toks) < max {
+		for i < len(data) && data[i] == ' ' {
+			i++
+		}
+		if i >= len(data) || data[i] == '\r' || data[i] == '\n' {
+			break
+		}
+
+		tok := imapToken{start: i}
+		switch data[i] {
+		case '"':
+			var b strings.Builder
+			i++
+			for i < len(data) && data[i] != '"' {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				b.WriteByte(data[i])
+				i++
+			}
+			if i >= len(data) {
+				return toks
+			}
+			i++
+			tok.value = b.String()
+
+		case '{':
+			j := i
+			for j < len(data) && data[j] != '\n' {
+				j++
+			}
+			n, _, ok := literalSize(data[i : j+min(1, len(data)-j)])
+			if !ok || j+1+int(n) > len(data) {
+				return toks
+			}
+			tok.value = string(data[j+1 : j+1+int(n)])
+			i = j + 1 + int(n)
+
+		case '(':
+			depth := 0
+			quoted := false
+			for ; i < len(data); i++ {
+				ch := data[i]
+				switch {
+				case quoted && ch == '\\':
+					i++
+				case ch == '"':
+					quoted = !quoted
+				case quoted:
+				case ch == '{':
+					// a literal in the list, like a subject in ENVELOPE
+					j := i
+					for j < len(data) && data[j] != '\n' {
+						j++
+					}
+					seg := data[i:min(j+1, len(data))]
+					if n, _, ok := literalSize(seg); ok && j < len(data) && bytes.LastIndexByte(seg, '{') == 0 {
+						if j+1+int(n) > len(data) {
+							return toks
+						}
+						i = j + int(n)
+					}
+				case ch == '(':
+					depth++
+				case ch == ')':
+					depth--
+				}
+				if depth == 0 {
+					break
+				}
+			}
+			if i >= len(data) {
+				return toks
+			}
+			i++
+			tok.list = true
+			tok.value = string(data[tok.start:i])
+
+		default:
+			brackets := 0
+			for ; i < len(data); i++ {
+				ch := data[i]
+				if ch == '[' {
+					brackets++
+				} else if ch == ']' {
+					brackets--
+				} else if brackets <= 0 && (ch == ' ' || ch == '\r' || ch == '\n' || ch == '(' || ch == ')') {
+					break
+				}
+			}
+			tok.value = string(data[tok.start:i])
+			tok.nil = strings.EqualFold(tok.value, "NIL")
+		}
+
+		tok.end = i
+		toks = append(toks, tok)
+	}
+	return toks
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_matchMailbox(t *testing.T) {
+	A := Assert.New(t)
+
+	A.True(matchMailbox("[Gmail]/*", "[Gmail]/Sent Mail", '/'))
+	A.True(matchMailbox("*", "a/b", '/'))
+	A.True(matchMailbox("%", "a", '/'))
+	A.False(matchMailbox("%", "a/b", '/'))
+	A.True(matchMailbox("a/%", "a/b", '/'))
+	A.False(matchMailbox("Sent", "Sent Mail", '/'))
+
+	toks := imapTokens([]byte("a1 RENAME {3+}\r\nold \"new \\\"x\\\"\" (A (B)) [x y]\r\n"), 6)
+	A.Len(toks, 6)
+	A.Equal("old", toks[2].value)
+	A.Equal(`new "x"`, toks[3].value)
+	A.True(toks[4].list)
+	A.Equal("[x y]", toks[5].value)
+}
+
+func Test_mailboxFilter(t *testing.T) {
+	A := Assert.New(t)
+
+	conf := &MailboxesConf{
+		Exclude: []string{"Old/Secret"},
+		Rename:  map[string]string{"Old": "New", "Old/Deep": "Deeper"},
+	}
+
+	for client, upstream := range map[string]string{
+		"New":        "Old",
+		"New/Sub":    "Old/Sub",
+		"Deeper/x":   "Old/Deep/x",
+		"Newer":      "Newer",
+		"inbox":      "INBOX",
+		"Old":        "",
+		"Old/Sub":    "",
+		"New/Secret": "",
+	} {
+		u, ok := conf.toUpstream(client)
+		A.Equal(upstream != "", ok, client)
+		if ok {
+			A.Equal(upstream, u, client)
+		}
+	}
+	for upstream, client := range map[string]string{
+		"Old":        "New",
+		"Old/Sub":    "New/Sub",
+		"Old/Deep/x": "Deeper/x",
+		"Older":      "Older",
+		"Old/Secret": "",
+	} {
+		c, ok := conf.toClient(upstream)
+		A.Equal(client != "", ok, upstream)
+		if ok {
+			A.Equal(client, c, upstream)
+		}
+	}
+
+	f := newMailboxFilter(conf)
+	for data, want := range map[string]string{
+		"a RENAME New/Sub Newer\r\n":                     "a RENAME \"Old/Sub\" \"Newer\"\r\n",
+		"a XLIST \"\" New/%\r\n":                         "a XLIST \"\" \"*\"\r\n",
+		"a GETACL New\r\n":                               "a GETACL \"Old\"\r\n",
+		"a MYRIGHTS New\r\n":                             "a MYRIGHTS \"Old\"\r\n",
+		"a LISTRIGHTS New smith\r\n":                     "a LISTRIGHTS \"Old\" smith\r\n",
+		"a GETQUOTAROOT New\r\n":                         "a GETQUOTAROOT \"Old\"\r\n",
+		"a GETMETADATA (DEPTH 1) New (/private/x)\r\n":   "a GETMETADATA (DEPTH 1) \"Old\" (/private/x)\r\n",
+		"a GETMETADATA \"\" /shared/comment\r\n":         "a GETMETADATA \"\" /shared/comment\r\n",
+		"a SETMETADATA New (/private/comment \"x\")\r\n": "a SETMETADATA \"Old\" (/private/comment \"x\")\r\n",
+	} {
+		cmd := parseProxyCommand([]byte(data))
+		cmd.Complete = true
+		A.Nil(f.FilterCommand(cmd), data)
+		A.Equal(want, string(cmd.Data), data)
+	}
+	for _, data := range []string{
+		"a GETACL Old/Secret\r\n",
+		"a MYRIGHTS Old\r\n",
+		"a GETQUOTAROOT New/Secret\r\n",
+		"a GETMETADATA (DEPTH 1) Old (/private/x)\r\n",
+	} {
+		cmd := parseProxyCommand([]byte(data))
+		cmd.Complete = true
+		resp := f.FilterCommand(cmd)
+		A.NotNil(resp, data)
+		A.Equal("NONEXISTENT", string(resp.Code), data)
+	}
+
+	for data, want := range map[string]string{
+		"* XLIST () \"/\" Old/Sub\r\n":        "* XLIST () \"/\" \"New/Sub\"\r\n",
+		"* ACL Old smith lr\r\n":              "* ACL \"New\" smith lr\r\n",
+		"* MYRIGHTS Old lr\r\n":               "* MYRIGHTS \"New\" lr\r\n",
+		"* QUOTAROOT Old/Sub \"\"\r\n":        "* QUOTAROOT \"New/Sub\" \"\"\r\n",
+		"* METADATA Old (/private/x NIL)\r\n": "* METADATA \"New\" (/private/x NIL)\r\n",
+	} {
+		resp := parseProxyResponse([]byte(data))
+		A.True(f.FilterResponse(resp), data)
+		A.Equal(want, string(resp.Data), data)
+	}
+	A.False(f.FilterResponse(parseProxyResponse([]byte("* XLIST () \"/\" Old/Secret\r\n"))), "hidden")
+	A.False(f.FilterResponse(parseProxyResponse([]byte("* ACL Old/Secret smith lr\r\n"))), "hidden")
+}
+
+func Test_mailpMailboxes(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	uc, err := client.Dial("127.0.0.1:1233")
+	A.NoError(err, "dial upstream")
+	defer uc.Terminate()
+	A.NoError(uc.Login("username", "password"), "login upstream")
+	for _, name := range []string{"[Gmail]/Sent Mail", "[Gmail]/Spam", "Private"} {
+		A.NoError(uc.Create(name), "create")
+	}
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  users:
+    abc:
+      password: "pw"
+      mailboxes:
+        include: ["INBOX", "[Gmail]/*"]
+        exclude: ["[Gmail]/Spam"]
+        rename:
+          "[Gmail]/Sent Mail": "Sent"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	A.NoError(c.Login("abc", "pw"), "login")
+
+	list := func(pattern string) []string {
+		ch := make(chan *imap.MailboxInfo, 10)
+		A.NoError(c.List("", pattern, ch), "list")
+		var names []string
+		for mi := range ch {
+			names = append(names, mi.Name)
+		}
+		return names
+	}
+	A.ElementsMatch([]string{"INBOX", "Sent"}, list("*"))
+	A.ElementsMatch([]string{"Sent"}, list("S%"))
+	A.ElementsMatch([]string{"INBOX"}, list("inbox"))
+
+	for _, name := range []string{"Private", "[Gmail]/Spam", "[Gmail]/Sent Mail"} {
+		_, err = c.Select(name, false)
+		A.Error(err, name)
+		A.Contains(err.Error(), "Unknown Mailbox", name)
+	}
+
+	status, err := c.Status("Sent", []imap.StatusItem{imap.StatusMessages})
+	A.NoError(err, "status")
+	A.Equal("Sent", status.Name)
+
+	A.NoError(c.Append("Sent", nil, time.Now(), imap.Literal(strings.NewReader("Subject: x\r\n\r\nx\r\n"))), "append")
+	ustatus, err := uc.Status("[Gmail]/Sent Mail", []imap.StatusItem{imap.StatusMessages})
+	A.NoError(err, "upstream status")
+	A.EqualValues(1, ustatus.Messages, "appended upstream")
+
+	_, err = c.Select("INBOX", false)
+	A.NoError(err, "select")
+	seq := new(imap.SeqSet)
+	seq.AddNum(1)
+	A.NoError(c.Copy(seq, "Sent"), "copy")
+	A.Error(c.Copy(seq, "Private"), "copy hidden")
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"bufio"
-	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -23,90 +24,567 @@ type Mailp struct {
 	conf *MailpConf
 	d    *net.Dialer
 
-	l   net.Listener
-	cid int64
-	log *log.Logger
+	mu       sync.Mutex
+	ls       []net.Listener
+	stopped  bool
+	sessions map[int64]*session
+	cid      int64
+	log      *log.Logger
+	logs     logSink
+
+	users     UserStore
+	hook      *authHook
+	audit     *auditLog
+	limits    *limiter
+	cache     *msgCache
+	pools     map[string]*upstreamPool
+	shares    map[string]*sharedAccount
+	mirrors   map[string]*mirror
+	upstreams *upstreamHealth
+	health    *healthChecker
+	http      *http.Server
+	done      chan struct{}
+	ready     chan struct{}
+}
+
+// A session is one accepted client connection.
+type session struct {
+	cid      int64
+	conn     net.Conn
+	listener *ImapListenerConf
+	start    time.Time
+	// login name, set after the handshake
+	user string
 }
 
 func (mp *Mailp) init() error {
 	mp.d = &net.Dialer{Timeout: 2 * time.Second}
-	mp.log = log.New(os.Stderr, "+ ", 0)
+	mp.log = log.New(&logWriter{mp: mp}, "+ ", 0)
+	mp.sessions = map[int64]*session{}
+	mp.pools = map[string]*upstreamPool{}
+	mp.shares = map[string]*sharedAccount{}
+	mp.mirrors = map[string]*mirror{}
+	mp.upstreams = newUpstreamHealth()
+	mp.health = newHealthChecker()
+	mp.done = make(chan struct{})
 
 	return nil
 }
 
+// Ready is closed once Start serves, Stop and Reload are for after.
+func (mp *Mailp) Ready() <-chan struct{} {
+	return mp.readyCh()
+}
+
+func (mp *Mailp) readyCh() chan struct{} {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.ready == nil {
+		mp.ready = make(chan struct{})
+	}
+	return mp.ready
+}
+
 func (mp *Mailp) Start() error {
 	if err := mp.init(); err != nil {
 		return err
 	}
 
-	var l net.Listener
-	{
-		var err error
+	conf := mp.getConf()
+	lconfs := conf.Imap.listeners()
 
-		if mp.conf.Imap.Tls.Enabled {
-			var cert tls.Certificate
-			cert, err = tls.LoadX509KeyPair(mp.conf.Imap.Tls.Cert, mp.conf.Imap.Tls.Key)
-			if err != nil {
-				err = fmt.Errorf("load imap.tls cert fail: %w", err)
-			} else {
-				l, err = tls.Listen("tcp", mp.conf.Imap.Addr, &tls.Config{
-					Certificates: []tls.Certificate{cert},
-				})
-				if err != nil {
-					err = fmt.Errorf("tls.listen fail: %w", err)
-				}
-			}
-		} else {
-			l, err = net.Listen("tcp", mp.conf.Imap.Addr)
-			if err != nil {
-				err = fmt.Errorf("net.listen fail: %w", err)
+	// a failed start closes what it opened, one path for every step
+	var (
+		ls        []net.Listener
+		pl, hl    net.Listener
+		inherited map[string][]net.Listener
+		started   bool
+	)
+	defer func() {
+		if started {
+			return
+		}
+		for _, l := range ls {
+			l.Close()
+		}
+		if pl != nil {
+			pl.Close()
+		}
+		if hl != nil {
+			hl.Close()
+		}
+		for _, ll := range inherited {
+			for _, l := range ll {
+				l.Close()
 			}
 		}
+
+		mp.mu.Lock()
+		audit, logs := mp.audit, mp.logs
+		mp.audit, mp.logs = nil, nil
+		mp.users, mp.hook, mp.limits, mp.cache = nil, nil, nil, nil
+		mp.mu.Unlock()
+		if audit != nil {
+			audit.Close()
+		}
+		if logs != nil {
+			logs.Close()
+		}
+	}()
+
+	logs, err := newLogSink(&conf.Log)
+	if err != nil {
+		return err
+	}
+	mp.mu.Lock()
+	mp.logs = logs
+	mp.mu.Unlock()
+
+	if err := checkMirrors(conf); err != nil {
+		return err
+	}
+	users, err := newUserStore(&conf.Imap, mp.log)
+	if err != nil {
+		return err
+	}
+	hook, err := newAuthHook(&conf.Imap.AuthHook)
+	if err != nil {
+		return err
+	}
+	audit, err := newAuditLog(&conf.Imap.Audit)
+	if err != nil {
+		return err
+	}
+	mp.mu.Lock()
+	mp.audit = audit
+	mp.mu.Unlock()
+	limits, err := newLimiter(conf.Imap.QuotaFile)
+	if err != nil {
+		return err
+	}
+	cache, err := newMsgCache(&conf.Imap.Cache)
+	if err != nil {
+		return err
+	}
+	mp.mu.Lock()
+	mp.users = users
+	mp.hook = hook
+	mp.limits = limits
+	mp.cache = cache
+	mp.mu.Unlock()
+
+	inherited, err = sdListeners()
+	if err != nil {
+		return err
+	}
+
+	// bind all or nothing
+	ls = make([]net.Listener, 0, len(lconfs))
+	for i := range lconfs {
+		l, err := mp.listen(&lconfs[i], inherited)
+		if err != nil {
+			return fmt.Errorf("imap listener %s: %w", lconfs[i].Addr, err)
+		}
+		ls = append(ls, l)
+	}
+	var plc ImapListenerConf
+	var stls *tls.Config
+	if conf.Pop3.Addr != "" {
+		plc = conf.Pop3.listener()
+		if conf.Pop3.Stls {
+			stls, err = tlsServerConfig(&conf.Pop3.Tls, mp.log)
+		}
+		if err == nil {
+			pl, err = mp.listen(&plc, inherited)
+		}
+		if err != nil {
+			return fmt.Errorf("pop3 listener %s: %w", plc.Addr, err)
+		}
+	}
+	if conf.Http.Addr != "" {
+		hl, err = net.Listen("tcp", conf.Http.Addr)
 		if err != nil {
+			return fmt.Errorf("http listener %s: %w", conf.Http.Addr, err)
+		}
+	}
+	started = true
+	for name, ll := range inherited {
+		mp.log.Printf("systemd socket %s not used\n", name)
+		for _, l := range ll {
+			l.Close()
+		}
+	}
+
+	mp.mu.Lock()
+	mp.ls = ls
+	if pl != nil {
+		mp.ls = append(ls[:len(ls):len(ls)], pl)
+	}
+	mp.mu.Unlock()
+
+	if hl != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", mp.handleHealthz)
+		mux.HandleFunc("/metrics", mp.handleMetrics)
+
+		mp.mu.Lock()
+		mp.http = &http.Server{Handler: mux}
+		mp.mu.Unlock()
+
+		mp.log.Printf("http listening on %s\n", hl.Addr().String())
+		go mp.http.Serve(hl)
+	}
+	go mp.runQuotaSave(limits, mp.done)
+	if cache != nil {
+		go mp.runCacheSave(cache, mp.done)
+	}
+	mp.startMirrors(conf)
+	mp.setHealthCheck(&conf.Imap)
+
+	errCh := make(chan error, len(ls)+1)
+	for i, l := range ls {
+		mp.log.Printf("listening on %s\n", l.Addr().String())
+
+		go func() {
+			errCh <- mp.accept(l, &lconfs[i])
+		}()
+	}
+	if pl != nil {
+		mp.log.Printf("pop3 listening on %s\n", pl.Addr().String())
+
+		go func() {
+			errCh <- mp.acceptPop3(pl, &plc, stls)
+		}()
+	}
+
+	sdNotify("READY=1")
+	close(mp.readyCh())
+
+	// one listener fails, all stop
+	err = <-errCh
+	for _, l := range ls {
+		l.Close()
+	}
+	if pl != nil {
+		pl.Close()
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.stopped {
+		return nil
+	}
+	return err
+}
+
+// Reload replaces the config used by new sessions, listeners are kept as is.
+// A config whose user stores are bad is not used.
+func (mp *Mailp) Reload(conf *MailpConf) error {
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+
+	if err := checkMirrors(conf); err != nil {
+		return err
+	}
+	users, err := newUserStore(&conf.Imap, mp.log)
+	if err != nil {
+		return err
+	}
+	hook, err := newAuthHook(&conf.Imap.AuthHook)
+	if err != nil {
+		return err
+	}
+
+	// the audit log is reopened only when its config changed
+	mp.mu.Lock()
+	oldAudit, auditChanged := mp.audit, mp.conf.Imap.Audit != conf.Imap.Audit
+	mp.mu.Unlock()
+	audit := oldAudit
+	if auditChanged {
+		if audit, err = newAuditLog(&conf.Imap.Audit); err != nil {
 			return err
 		}
 	}
 
-	mp.l = l
+	// so is the log sink
+	mp.mu.Lock()
+	oldLogs, logsChanged := mp.logs, mp.conf.Log != conf.Log
+	mp.mu.Unlock()
+	logs := oldLogs
+	if logsChanged {
+		if logs, err = newLogSink(&conf.Log); err != nil {
+			if auditChanged && audit != nil {
+				audit.Close()
+			}
+			return err
+		}
+	}
 
-	fmt.Printf("listing on %s\n", l.Addr().String())
+	mp.mu.Lock()
+	mp.conf = conf
+	mp.users = users
+	mp.hook = hook
+	mp.audit = audit
+	mp.logs = logs
+	mp.mu.Unlock()
+
+	if auditChanged && oldAudit != nil {
+		oldAudit.Close()
+	}
+	if logsChanged && oldLogs != nil {
+		oldLogs.Close()
+	}
+	mp.closePools()
+	mp.closeShares()
+	mp.closeMirrors()
+	mp.startMirrors(conf)
+	mp.setHealthCheck(&conf.Imap)
+
+	mp.log.Printf("config reloaded\n")
+
+	return nil
+}
+
+func (mp *Mailp) getConf() *MailpConf {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.conf
+}
+
+func (mp *Mailp) getAudit() *auditLog {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.audit
+}
+
+// writeAudit writes rec to the audit log in use, if any. A log replaced by
+// Reload or closed by Stop meanwhile is closed after rec is written.
+func (mp *Mailp) writeAudit(rec *auditRecord) error {
+	mp.mu.Lock()
+	audit := mp.audit
+	if audit != nil {
+		audit.inflight.Add(1)
+	}
+	mp.mu.Unlock()
+	if audit == nil {
+		return nil
+	}
+
+	defer audit.inflight.Done()
+	return audit.write(rec)
+}
 
+func (mp *Mailp) getLogSink() logSink {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.logs
+}
+
+// sessionUser returns the login name of conn cid, empty before login.
+func (mp *Mailp) sessionUser(cid int64) string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if s, ok := mp.sessions[cid]; ok {
+		return s.user
+	}
+	return ""
+}
+
+func (mp *Mailp) getUsers() (UserStore, *authHook) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.users, mp.hook
+}
+
+// listen binds lc, or takes the matching socket out of inherited for
+// network systemd.
+func (mp *Mailp) listen(lc *ImapListenerConf, inherited map[string][]net.Listener) (net.Listener, error) {
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "unix" && network != "systemd" {
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	var tlsConfig *tls.Config
+	if lc.Tls.Enabled {
+		var err error
+		tlsConfig, err = tlsServerConfig(&lc.Tls, mp.log)
+		if err != nil {
+			return nil, fmt.Errorf("imap.tls: %w", err)
+		}
+	}
+
+	var l net.Listener
+	if network == "systemd" {
+		ll := inherited[lc.Addr]
+		if len(ll) == 0 {
+			return nil, fmt.Errorf("no systemd socket named %s", lc.Addr)
+		}
+		l = ll[0]
+		if len(ll) > 1 {
+			inherited[lc.Addr] = ll[1:]
+		} else {
+			delete(inherited, lc.Addr)
+		}
+	} else {
+		var err error
+		l, err = net.Listen(network, lc.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("net.listen fail: %w", err)
+		}
+	}
+
+	// PROXY header comes before the TLS handshake
+	if lc.ProxyProtocol {
+		l = &proxyListener{l}
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	return l, nil
+}
+
+func (mp *Mailp) accept(l net.Listener, lc *ImapListenerConf) error {
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			return err
 		}
 
-		go mp.serve(c)
+		go mp.serve(c, lc)
 	}
 }
 
 func (mp *Mailp) Stop() error {
-	// TODO: wait all conns done, or close them?
-	return mp.l.Close()
+	sdNotify("STOPPING=1")
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.stopped {
+		return nil
+	}
+	mp.stopped = true
+
+	if mp.done != nil {
+		close(mp.done)
+	}
+	if mp.http != nil {
+		mp.http.Close()
+	}
+
+	var err error
+	for _, l := range mp.ls {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, s := range mp.sessions {
+		s.conn.Close()
+	}
+	if mp.audit != nil {
+		mp.audit.Close()
+		mp.audit = nil
+	}
+	if mp.logs != nil {
+		mp.logs.Close()
+		mp.logs = nil
+	}
+	if mp.limits != nil {
+		if e := mp.limits.save(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if mp.cache != nil {
+		if e := mp.cache.save(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, p := range mp.pools {
+		go p.close()
+	}
+	for _, a := range mp.shares {
+		go a.close()
+	}
+	for _, m := range mp.mirrors {
+		go m.close()
+	}
+
+	return err
+}
+
+func (mp *Mailp) addSession(c net.Conn, lc *ImapListenerConf) *session {
+	s := &session{
+		cid:      atomic.AddInt64(&mp.cid, 1),
+		conn:     c,
+		listener: lc,
+		start:    time.Now(),
+	}
+
+	mp.mu.Lock()
+	mp.sessions[s.cid] = s
+	mp.mu.Unlock()
+
+	return s
 }
 
-func (mp *Mailp) serve(c net.Conn) error {
-	cid := atomic.AddInt64(&mp.cid, 1)
+func (mp *Mailp) removeSession(s *session) {
+	mp.mu.Lock()
+	delete(mp.sessions, s.cid)
+	mp.mu.Unlock()
+}
+
+func (mp *Mailp) serve(c net.Conn, lc *ImapListenerConf) error {
+	sess := mp.addSession(c, lc)
+	cid := sess.cid
+	conf := mp.getConf()
+	users, hook := mp.getUsers()
 	mp.log.Printf("conn(%d) %s\n", cid, c.RemoteAddr())
 
 	defer func() {
 		mp.log.Printf("conn(%d) close\n", cid)
 		c.Close()
+		mp.removeSession(sess)
 	}()
 
 	// connLog == on|handshake ? (value) : nil
 	var doLog *atomic.Bool
-	if mp.conf.Imap.ConnLog == "on" || mp.conf.Imap.ConnLog == "handshake" {
+	if conf.Imap.ConnLog == "on" || conf.Imap.ConnLog == "handshake" {
 		doLog = &atomic.Bool{}
 		doLog.Store(true)
 	}
 
-	c_r := imap.NewReader(bufio.NewReader(newReaderWithMayPrefixWriter(c, "c> ", os.Stderr, doLog)))
-	c_w := imap.NewWriter(bufio.NewWriter(newWriterWithMayPrefixWriter(c, "c< ", os.Stderr, doLog)))
+	// verified client certificate
+	var cert *x509.Certificate
+	if tlsc, ok := c.(*tls.Conn); ok {
+		if err := tlsc.Handshake(); err != nil {
+			mp.log.Printf("conn(%d) tls handshake fail: %s\n", cid, err)
+			return err
+		}
+		cert = peerCert(tlsc)
+	}
+
+	// COMPRESS starts it later
+	dc := newDeflateConn(c)
+	c_r := imap.NewReader(bufio.NewReader(newReaderWithMayPrefixWriter(dc, "c> ", mp.traceWriter(cid), doLog)))
+	c_w := imap.NewWriter(bufio.NewWriter(newWriterWithMayPrefixWriter(dc, "c< ", mp.traceWriter(cid), doLog)))
 
 	caps := []string{"CAPABILITY", "IMAP4rev1", "AUTH=PLAIN", "LITERAL+", "SASL-IR"}
+	if cert != nil {
+		caps = append(caps, "AUTH=EXTERNAL")
+	}
+	if hook != nil {
+		caps = append(caps, "AUTH="+Xoauth2)
+	}
 	args := []any{}
 	for _, cap := range caps {
 		args = append(args, cap)
@@ -122,6 +600,145 @@ func (mp *Mailp) serve(c net.Conn) error {
 	}
 
 	var connUsername string
+	// the name of the user in its store, limits and the cache are by it
+	var connName string
+	var connUser *ImapUserConf
+	// logged in upstream during the handshake, for passthrough
+	var connUc *upstreamConn
+	defer func() {
+		if connUc != nil {
+			connUc.c.Close()
+		}
+	}()
+
+	// useUser logs in as user, a passthrough user is logged in upstream with
+	// the client's secret first
+	useUser := func(user *ImapUserConf, name, mechanism, secret string) error {
+		if user.Upstream.Auth.Type == "passthrough" {
+			// no local check, the upstream decides
+			uc, err := mp.connectUpstream(cid, &user.Upstream, doLog)
+			if err != nil {
+				return &statusError{code: "UNAVAILABLE", err: fmt.Errorf("upstream unavailable")}
+			}
+			auth := user.upstreamAuth(name, secret)
+			if mechanism == Xoauth2 {
+				auth.Type = "xoauth2"
+			}
+			if err := mp.loginUpstream(cid, uc, auth); err != nil {
+				uc.c.Close()
+				return err
+			}
+			connUc = uc
+		}
+
+		connName = name
+		connUser = user
+		return nil
+	}
+
+	// askHook lets the auth hook decide about a login no store knows
+	askHook := func(mechanism, username, secret string) error {
+		req := &authHookRequest{
+			Username:   username,
+			Mechanism:  mechanism,
+			RemoteAddr: c.RemoteAddr().String(),
+		}
+		if mechanism == Xoauth2 {
+			req.Token = secret
+		} else {
+			req.Password = secret
+		}
+		user, err := hook.check(req)
+		if err != nil {
+			if _, ok := err.(*statusError); ok {
+				mp.log.Printf("conn(%d) %s\n", cid, err)
+			}
+			return err
+		}
+		return useUser(user, username, mechanism, secret)
+	}
+
+	// password login, a user with certLogin needs no password when its
+	// certificate is presented
+	checkLogin := func(mechanism, username, password string) error {
+		if cert != nil {
+			user, name, err := users.LookupUser(username)
+			if err != nil && err != errNoSuchUser {
+				mp.log.Printf("conn(%d) lookup user %s fail: %s\n", cid, username, err)
+			}
+			if err == nil && user.CertLogin && user.matchCert(cert) {
+				return useUser(user, name, mechanism, password)
+			}
+		}
+
+		user, name, err := users.VerifyPassword(username, password)
+		if err == nil {
+			return useUser(user, name, mechanism, password)
+		}
+		if err == errNoSuchUser && hook != nil {
+			return askHook(mechanism, username, password)
+		}
+		if err != errNoSuchUser && err != errBadPassword {
+			mp.log.Printf("conn(%d) verify user %s fail: %s\n", cid, username, err)
+		}
+
+		return fmt.Errorf("bad username or password")
+	}
+
+	// openUpstream gets the upstream of connUser before the login is
+	// answered, it is NO [UNAVAILABLE] when there is none
+	openUpstream := func() error {
+		if connUc != nil {
+			return nil
+		}
+		if connUser.Upstream.shared() {
+			if a := mp.getShare(&connUser.Upstream); a != nil {
+				connUc = a.session(cid)
+			}
+		}
+		if connUc == nil && connUser.Upstream.pooled() {
+			if p := mp.getPool(&connUser.Upstream); p != nil {
+				connUc = p.take(cid, doLog)
+			}
+		}
+		if connUc != nil {
+			return nil
+		}
+
+		unavailable := &statusError{code: "UNAVAILABLE", err: fmt.Errorf("upstream unavailable")}
+		connUpConf := connUser.Upstream
+		uc, err := mp.connectUpstream(cid, &connUpConf, doLog)
+		if err != nil && connUser.Upstream.mirrored() {
+			m := mp.getMirror(&connUser.Upstream)
+			if m == nil {
+				return unavailable
+			}
+			// read-only from the mirror
+			mp.log.Printf("conn(%d) offline, serve mirror: %s\n", cid, err)
+			if uc, err = m.session(cid, connUsername); err != nil {
+				mp.log.Printf("conn(%d) mirror fail: %s\n", cid, err)
+				return unavailable
+			}
+			(&imap.StatusResp{
+				Tag:  "*",
+				Type: imap.StatusRespOk,
+				Code: imap.CodeAlert,
+				Info: offlineAlert,
+			}).WriteTo(c_w)
+			connUc = uc
+			return nil
+		}
+		if err != nil {
+			return unavailable
+		}
+		if err := mp.loginUpstream(cid, uc, &connUser.Upstream.Auth); err != nil {
+			uc.c.Close()
+			mp.log.Printf("conn(%d) login upstream fail: %s\n", cid, err)
+			return unavailable
+		}
+		connUc = uc
+		return nil
+	}
 
 	n := 0
 
@@ -183,23 +800,17 @@ handshake_client:
 				username := loginCmd.Username
 				password := loginCmd.Password
 
-				if user, ok := mp.conf.Imap.Users[username]; ok {
-					if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
-						connUsername = username
-						// set username for connect upstream
-						return nil
-					}
+				if err := checkLogin("LOGIN", username, password); err != nil {
+					return err
 				}
 
-				return fmt.Errorf("bad username or password")
+				// set username for connect upstream
+				connUsername = username
+				return openUpstream()
 			}()
 
 			if err != nil {
-				(&imap.StatusResp{
-					Tag:  cmd.Tag,
-					Type: imap.StatusRespNo,
-					Info: err.Error(),
-				}).WriteTo(c_w)
+				noResp(cmd.Tag, err).WriteTo(c_w)
 
 				// 鉴权失败，可以给Client多几次机会
 				continue handshake_client
@@ -223,24 +834,51 @@ handshake_client:
 						return errors.New("identities not supported")
 					}
 
-					if user, ok := mp.conf.Imap.Users[username]; ok {
-						if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
-							connUsername = username
-							// set username for connect upstream
-							return nil
-						}
+					if err := checkLogin(sasl.Plain, username, password); err != nil {
+						return err
 					}
 
-					return fmt.Errorf("bad username or password")
+					// set username for connect upstream
+					connUsername = username
+					return nil
 				}),
 			}
+			if cert != nil {
+				mechanisms[sasl.External] = sasl.NewExternalServer(func(identity string) error {
+					username, err := conf.Imap.certUser(users, cert, identity)
+					if err != nil {
+						return err
+					}
+
+					user, name, err := users.LookupUser(username)
+					if err != nil {
+						return err
+					}
+					if user.Upstream.Auth.Type == "passthrough" {
+						return errors.New("passthrough needs a password")
+					}
+					connUsername = username
+					connName = name
+					connUser = user
+					return nil
+				})
+			}
+			if hook != nil {
+				mechanisms[Xoauth2] = NewXoauth2Server(func(opts Xoauth2Options) *Xoauth2Error {
+					if err := askHook(Xoauth2, opts.Username, opts.Token); err != nil {
+						return &Xoauth2Error{Status: "401", Schemes: "bearer"}
+					}
+
+					connUsername = opts.Username
+					return nil
+				})
+			}
 			err := authCmd.Handle(mechanisms, cc)
+			if err == nil {
+				err = openUpstream()
+			}
 			if err != nil {
-				(&imap.StatusResp{
-					Tag:  cmd.Tag,
-					Type: imap.StatusRespNo,
-					Info: err.Error(),
-				}).WriteTo(c_w)
+				noResp(cmd.Tag, err).WriteTo(c_w)
 
 				// 鉴权失败，可以给Client多几次机会
 				continue handshake_client
@@ -265,139 +903,82 @@ handshake_client:
 
 	}
 
-	// handshake_upstream and pipe
+	// pipe, the upstream was opened by the login
 	err := func() error {
-		// mp.log.Printf("user %s", connUsername)
-		connUpConf := mp.conf.Imap.Users[connUsername].Upstream
-
-		addr := connUpConf.Addr
+		mp.log.Printf("conn(%d) user %s", cid, connUsername)
+		mp.mu.Lock()
+		sess.user = connUsername
+		mp.mu.Unlock()
+
+		uc := connUc
+		if conf.Imap.Compress.Enabled && conf.Imap.Compress.Upstream {
+			mp.compressUpstream(cid, uc, conf.Imap.Compress.level())
+		}
 
-		mp.log.Printf("conn(%d) connect upstream: %s", cid, addr)
+		mp.log.Printf("conn(%d) pipe\n", cid)
 
-		c2, err := mp.d.Dial("tcp", addr)
-		if err != nil {
-			return err
+		// TODO: use enum
+		if conf.Imap.ConnLog == "handshake" {
+			doLog.Store(false)
 		}
 
-		var c3 net.Conn
-		if connUpConf.Tls.Enabled {
-			serverName, _, _ := net.SplitHostPort(addr)
-			tlsConfig := &tls.Config{
-				ServerName:         serverName,
-				InsecureSkipVerify: connUpConf.Tls.SkipVerify,
-			}
-			tlsc := tls.Client(c2, tlsConfig)
-			if err := tlsc.Handshake(); err != nil {
-				return err
-			}
-			c3 = tlsc
-		} else {
-			c3 = c2
+		// rateLimit and dailyQuota
+		var u_r io.Reader = uc.r
+		var cl_r io.Reader = c_r
+		limits := mp.newSessionLimits(connName, connUser)
+		if limits != nil {
+			u_r = limits.reader(uc.r, limits.down)
+			cl_r = limits.reader(c_r, limits.up)
 		}
-		defer c3.Close()
-
-		mp.log.Printf("conn(%d) connect upstream: %s (ok)", cid, addr)
-
-		c3_r := imap.NewReader(bufio.NewReader(newReaderWithMayPrefixWriter(c3, "s> ", os.Stderr, doLog)))
-		c3_w := imap.NewWriter(bufio.NewWriter(newWriterWithMayPrefixWriter(c3, "s< ", os.Stderr, doLog)))
-
-		{
-			ret, err := imap.ReadResp(c3_r)
-			if err != nil {
-				return err
-			}
-
-			// m.log.Printf("conn(%d) server got %+v\n", cid, ret)
-
-			vv, ok := ret.(*imap.StatusResp)
-			if !ok {
-				// log
-				return fmt.Errorf("want greet")
-			}
-			if !(vv.Tag == "*" && vv.Type == imap.StatusRespOk) {
-				return fmt.Errorf("bad greet")
-			}
 
+		// PIPE
+		inspectConf := conf.Imap.Inspect
+		if mp.cache != nil {
+			// bodies to cache are buffered
+			inspectConf.MaxLiteral = max(inspectConf.MaxLiteral, defaultInspectMaxLiteral, mp.cache.maxMessage)
 		}
-
-		// AUTH
-		username := connUpConf.Auth.Username
-		password := connUpConf.Auth.Password
-		mp.log.Printf("conn(%d) login upstream as %s", cid, username)
-
-		var cmd *imap.Command
-
-		switch connUpConf.Auth.Type {
-		case "plain":
-			mech, ir, err := sasl.NewPlainClient(username, username, password).Start()
-			if err != nil {
-				return err
-			}
-			cmdr := &commands.Authenticate{
-				Mechanism:       mech,
-				InitialResponse: ir,
+		if conf.Imap.Inspect.Enabled || connUser.ReadOnly || connUser.Mailboxes.enabled() || conf.Imap.Audit.enabled() || (limits != nil && limits.quota > 0) || mp.cache != nil || conf.Imap.Compress.Enabled {
+			var commands []CommandFilter
+			var responses []ResponseFilter
+			// first, it sees commands as sent and all completions
+			if conf.Imap.Audit.enabled() {
+				af := newAuditFilter(mp, cid, connUsername, uc.addr)
+				commands = append(commands, af)
+				responses = append(responses, af)
 			}
-			cmd = cmdr.Command()
-
-		case "xoauth2":
-			mech, ir, err := NewXoauth2Client(username, password).Start()
-			if err != nil {
-				return err
+			if conf.Imap.Inspect.Log {
+				lf := &logFilter{log: mp.log, cid: cid}
+				commands = append(commands, lf)
+				responses = append(responses, lf)
 			}
-			cmdr := &commands.Authenticate{
-				Mechanism:       mech,
-				InitialResponse: ir,
+			if conf.Imap.Compress.Enabled {
+				cf := &compressFilter{dc: dc, level: conf.Imap.Compress.level()}
+				commands = append(commands, cf)
+				responses = append(responses, cf)
 			}
-			cmd = cmdr.Command()
-
-		default:
-			return fmt.Errorf("upstream auth support plain, got %s", connUpConf.Auth.Type)
-		}
-
-		cmd.Tag = "mailp.1"
-
-		// TODO: we need imap.Client.Execute()
-		if err := cmd.WriteTo(c3_w); err != nil {
-			return err
-		}
-		for {
-			ret, err := imap.ReadResp(c3_r)
-			if err != nil {
-				return err
+			if limits != nil && limits.quota > 0 {
+				commands = append(commands, &quotaFilter{s: limits})
 			}
-			mp.log.Printf("conn(%d) server auth ret: %+v\n", cid, ret)
-
-			if vv, ok := ret.(*imap.DataResp); ok {
-				name, fields, ok := imap.ParseNamedResp(vv)
-				if !ok || name != "CAPABILITY" {
-					return fmt.Errorf("auth bad data")
-				}
-				// TODO: use fields
-				_ = fields
-				continue
+			if connUser.Mailboxes.enabled() {
+				mf := newMailboxFilter(&connUser.Mailboxes)
+				commands = append(commands, mf)
+				responses = append(responses, mf)
 			}
-
-			vv, ok := ret.(*imap.StatusResp)
-			if !ok {
-				return fmt.Errorf("auth bad")
+			if connUser.ReadOnly {
+				commands = append(commands, readOnlyFilter{})
 			}
-			if !(vv.Tag == cmd.Tag && vv.Type == imap.StatusRespOk) {
-				return fmt.Errorf("auth fail")
+			// last, it sees upstream names and sends commands as they go
+			if mp.cache != nil {
+				cf := newCacheFilter(mp.cache, quotaAccount(connName, &connUser.Upstream), mp.log, cid)
+				commands = append(commands, cf)
+				responses = append(responses, cf)
 			}
 
-			break
-		}
-
-		mp.log.Printf("conn(%d) pipe\n", cid)
-
-		// TODO: use enum
-		if mp.conf.Imap.ConnLog == "handshake" {
-			doLog.Store(false)
+			newInspector(&inspectConf, commands, responses).pipe(cl_r, c_w, u_r, uc.w)
+		} else {
+			pipe(cl_r, c_w, u_r, uc.w)
 		}
 
-		// PIPE
-		pipe(c_r, c_w, c3_r, c3_w)
-
 		return nil
 	}()
 
@@ -464,8 +1045,9 @@ func (w *mayPrefixWriter) Write(p []byte) (n int, err error) {
 		return len(p), nil
 	}
 
-	w.w.Write(w.ch)
-	return w.w.Write(p)
+	// one write, a sink gets the prefix with the bytes
+	_, err = w.w.Write(append(w.ch[:len(w.ch):len(w.ch)], p...))
+	return len(p), err
 }
 
 func newMayPrefixWriter(ch string, w io.Writer, doWrite *atomic.Bool) io.Writer {
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -56,6 +59,11 @@ imap:
 		defer mp.Stop()
 	}
 	A.NoError(err, "start mp fail")
+	select {
+	case <-mp.Ready():
+	case <-time.After(time.Second):
+		A.Fail("not ready")
+	}
 
 	for _, useLogin := range []bool{true, false} {
 		name := "use_auth_plain"
@@ -70,6 +78,60 @@ imap:
 
 }
 
+// testLookupFailStore fails LookupUser, password logins must not need it.
+type testLookupFailStore struct {
+	UserStore
+	lookups int
+}
+
+func (s *testLookupFailStore) LookupUser(login string) (*ImapUserConf, string, error) {
+	s.lookups++
+	return nil, "", errors.New("lookup down")
+}
+
+func Test_mailpLoginNoLookup(t *testing.T) {
+	A := Assert.New(t)
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  users:
+    abc:
+      password: 123
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	mp.mu.Lock()
+	st := &testLookupFailStore{UserStore: mp.users}
+	mp.users = st
+	mp.mu.Unlock()
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	A.NoError(c.Login("abc", "123"), "login")
+	A.Zero(st.lookups, "no lookup without a certificate")
+}
+
 func Test_mailp_upstreamAuthXoauth2(t *testing.T) {
 	A := Assert.New(t)
 
@@ -252,27 +314,547 @@ imap:
 		err = c.Login("abc", "1")
 		A.Error(err, "login bad")
 
+		// the upstream cert is not trusted
 		err = c.Login("abc", "123")
-		A.NoError(err, "login")
+		A.Error(err, "login")
+		A.Contains(err.Error(), "upstream unavailable", "login")
+	})
+}
+
+func Test_mailpListeners(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	sock := filepath.Join(t.TempDir(), "mailp.sock")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  listeners:
+    - addr: ":1234"
+    - addr: ":1235"
+      proxyProtocol: true
+    - addr: ` + sock + `
+      network: unix
+  connLog: on
+  users:
+    abc:
+      password: 123
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	t.Run("tcp", func(t *testing.T) {
+		testMailpBasic(t, "127.0.0.1:1234", true)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		conn, err := net.Dial("unix", sock)
+		Assert.NoError(t, err, "dial unix")
+
+		c, err := client.New(conn)
+		Assert.NoError(t, err, "client.New")
+		defer c.Terminate()
+
+		testMailpClient(t, c, false)
+	})
+
+	t.Run("proxy protocol", func(t *testing.T) {
+		A := Assert.New(t)
+
+		c, err := net.Dial("tcp", "127.0.0.1:1235")
+		A.NoError(err, "tcp")
+		defer c.Close()
+
+		_, err = c.Write([]byte("PROXY TCP4 10.1.2.3 127.0.0.1 5555 1235\r\n"))
+		A.NoError(err, "write proxy header")
 
-		_, err = c.Capability()
-		A.Error(err, "c.caps() real")
-		A.Contains(err.Error(), "imap: connection close", "c.caps() real")
+		c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		line, _, err := bufio.NewReader(c).ReadLine()
+		A.NoError(err, "read greet")
+		A.True(strings.HasPrefix(string(line), "* OK"), "greet")
+
+		var remotes []string
+		mp.mu.Lock()
+		for _, s := range mp.sessions {
+			remotes = append(remotes, s.conn.RemoteAddr().String())
+		}
+		mp.mu.Unlock()
+		A.Contains(remotes, "10.1.2.3:5555")
 	})
 }
 
+func Test_mailpListenersBindAtomic(t *testing.T) {
+	A := Assert.New(t)
+
+	conf := &MailpConf{}
+	err := conf.Load(`
+imap:
+  listeners:
+    - addr: ":1234"
+    - addr: "256.0.0.1:1"
+`)
+	A.NoError(err, "load conf")
+
+	_, err = testStartMailp(conf, 20*time.Millisecond)
+	A.Error(err, "start mp should fail")
+	A.Contains(err.Error(), "256.0.0.1:1")
+
+	l, err := net.Listen("tcp", ":1234")
+	A.NoError(err, "first listener released")
+	l.Close()
+
+	// the http listener fails last, after the sockets systemd passed
+	busy, err := net.Listen("tcp", "127.0.0.1:1240")
+	A.NoError(err, "listen")
+	defer busy.Close()
+
+	l, err = net.Listen("tcp", "127.0.0.1:1235")
+	A.NoError(err, "listen")
+	f, err := l.(*net.TCPListener).File()
+	A.NoError(err, "listener file")
+	l.Close()
+	defer f.Close()
+
+	defer func(start int) { sdListenFdsStart = start }(sdListenFdsStart)
+	sdListenFdsStart = int(f.Fd())
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "unused")
+
+	conf = &MailpConf{}
+	A.NoError(conf.Load(`
+http:
+  addr: 127.0.0.1:1240
+imap:
+  addr: ":1234"
+  audit:
+    file: `+filepath.Join(t.TempDir(), "audit.log")+`
+`), "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	A.Error(err, "start mp should fail")
+	A.Contains(err.Error(), "http listener")
+
+	mp.mu.Lock()
+	audit := mp.audit
+	mp.mu.Unlock()
+	A.Nil(audit, "audit log closed")
+
+	l, err = net.Listen("tcp", ":1234")
+	A.NoError(err, "imap listener released")
+	l.Close()
+	l, err = net.Listen("tcp", "127.0.0.1:1235")
+	A.NoError(err, "systemd socket released")
+	l.Close()
+}
+
+func Test_mailpSystemd(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	// the socket systemd would pass
+	l, err := net.Listen("tcp", "127.0.0.1:1234")
+	A.NoError(err, "listen")
+	f, err := l.(*net.TCPListener).File()
+	A.NoError(err, "listener file")
+	l.Close()
+	defer f.Close()
+
+	defer func(start int) { sdListenFdsStart = start }(sdListenFdsStart)
+	sdListenFdsStart = int(f.Fd())
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "imap")
+
+	notifyAddr := filepath.Join(t.TempDir(), "notify.sock")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifyAddr, Net: "unixgram"})
+	A.NoError(err, "listen notify socket")
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", notifyAddr)
+
+	readNotify := func() string {
+		b := make([]byte, 256)
+		notify.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := notify.Read(b)
+		A.NoError(err, "read notify")
+		return string(b[:n])
+	}
+
+	confStr := `
+imap:
+  listeners:
+    - addr: imap
+      network: systemd
+  connLog: on
+  users:
+    abc:
+      password: 123
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`
+	conf := &MailpConf{}
+	A.NoError(conf.Load(confStr), "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+	A.Equal("READY=1", readNotify())
+
+	testMailpBasic(t, "127.0.0.1:1234", true)
+
+	conf2 := &MailpConf{}
+	A.NoError(conf2.Load(strings.Replace(confStr, "password: 123", "password: 456", 1)), "load conf")
+	A.NoError(mp.Reload(conf2), "reload")
+	A.Equal("RELOADING=1", readNotify())
+	A.Equal("READY=1", readNotify())
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	A.Error(c.Login("abc", "123"), "old password after reload")
+	A.NoError(c.Login("abc", "456"), "new password after reload")
+
+	mp.Stop()
+	A.Equal("STOPPING=1", readNotify())
+}
+
+func Test_mailpUpstreamFailover(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    abc:
+      password: 123
+      upstream:
+        addrs: ["127.0.0.1:1299", "127.0.0.1:1233"]
+        maxFails: 2
+        failTimeout: 1m
+        auth:
+          type: plain
+          username: username
+          password: password
+    down:
+      password: 123
+      upstream:
+        addrs: ["127.0.0.1:1298", "127.0.0.1:1299"]
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	upConf := conf.Imap.Users["abc"].Upstream
+
+	testMailpBasic(t, "127.0.0.1:1234", true)
+	A.Equal([]string{"127.0.0.1:1299", "127.0.0.1:1233"}, mp.upstreams.order(&upConf), "1 fail, still up")
+
+	testMailpBasic(t, "127.0.0.1:1234", false)
+	A.Equal([]string{"127.0.0.1:1233", "127.0.0.1:1299"}, mp.upstreams.order(&upConf), "2 fails, down")
+
+	// the login is not answered OK without an upstream
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	err = c.Login("down", "123")
+	A.Error(err, "no upstream")
+	A.Contains(err.Error(), "upstream unavailable")
+	A.Equal(imap.NotAuthenticatedState, c.State(), "still not authenticated")
+}
+
+func Test_upstreamHealthOrder(t *testing.T) {
+	A := Assert.New(t)
+
+	h := newUpstreamHealth()
+	conf := &ImapUpstreamConf{
+		Addrs:    []string{"a", "b", "c"},
+		Strategy: "round-robin",
+	}
+
+	A.Equal([]string{"a", "b", "c"}, h.order(conf))
+	A.Equal([]string{"b", "c", "a"}, h.order(conf))
+
+	h.fail("b", conf, errors.New("x"))
+	A.Equal([]string{"a", "c", "b"}, h.order(conf), "down addr goes last")
+
+	h.ok("b")
+	A.Equal([]string{"a", "b", "c"}, h.order(conf))
+
+	conf.Strategy = "random"
+	A.ElementsMatch([]string{"a", "b", "c"}, h.order(conf))
+
+	A.Equal([]string{"x"}, h.order(&ImapUpstreamConf{Addr: "x"}), "single addr")
+}
+
+func Test_mailpRoutes(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    vip@corp.example:
+      password: 999
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+  routes:
+    - match: "*@CORP.example"
+      password: 123
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: "{{.Local}}name"
+          password: password
+    - match: "user*"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: passthrough
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	login := func(username, password string) error {
+		c, err := client.Dial("127.0.0.1:1234")
+		A.NoError(err, "client.Dial")
+		defer c.Terminate()
+
+		if err := c.Login(username, password); err != nil {
+			return err
+		}
+		_, err = c.Select("INBOX", true)
+		return err
+	}
+
+	A.NoError(login("user@corp.example", "123"), "route with template")
+	A.Error(login("other@corp.example", "123"), "route, bad upstream username")
+	A.Error(login("vip@corp.example", "123"), "users win over routes")
+	A.NoError(login("vip@corp.example", "999"), "users win over routes")
+	A.NoError(login("username", "password"), "passthrough")
+	A.Error(login("nobody@example.com", "123"), "no route")
+
+	user, _, err := conf.Imap.lookupUser("alice@corp.example")
+	A.NoError(err, "lookupUser")
+	A.Equal("alicename", user.Upstream.Auth.Username)
+	A.Equal("{{.Local}}name", conf.Imap.Routes[0].Upstream.Auth.Username, "route conf unchanged")
+}
+
+func Test_mailpPassthrough(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    down:
+      upstream:
+        addr: 127.0.0.1:1299
+        auth:
+          type: passthrough
+  routes:
+    - match: "*"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: passthrough
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+
+	err = c.Login("username", "bad")
+	A.Error(err, "upstream rejects")
+	A.Contains(err.Error(), "auth fail", "upstream reply")
+
+	err = c.Login("down", "any")
+	A.Error(err, "upstream down")
+	A.Contains(err.Error(), "upstream unavailable")
+
+	A.NoError(c.Authenticate(sasl.NewPlainClient("", "username", "password")), "upstream accepts")
+	_, err = c.Select("INBOX", true)
+	A.NoError(err, "select")
+}
+
+func Test_mailpUpstreamSelector(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    abc:
+      password: 123
+      upstream:
+        addr: 127.0.0.1:1299
+      upstreams:
+        support:
+          addr: 127.0.0.1:1233
+          auth:
+            type: plain
+            username: username
+            password: password
+        personal:
+          addr: 127.0.0.1:1233
+          auth:
+            type: plain
+            username: username
+            password: bad
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	login := func(useLogin bool, username string) error {
+		c, err := client.Dial("127.0.0.1:1234")
+		A.NoError(err, "client.Dial")
+		defer c.Terminate()
+
+		if useLogin {
+			err = c.Login(username, "123")
+		} else {
+			err = c.Authenticate(sasl.NewPlainClient("", username, "123"))
+		}
+		if err != nil {
+			return err
+		}
+		_, err = c.Select("INBOX", true)
+		return err
+	}
+
+	for _, useLogin := range []bool{true, false} {
+		A.NoError(login(useLogin, "abc+support"), "+support")
+		A.NoError(login(useLogin, "abc/support"), "/support")
+		A.Error(login(useLogin, "abc+personal"), "+personal, upstream rejects")
+		A.Error(login(useLogin, "abc"), "default upstream is down")
+		A.Error(login(useLogin, "abc+nope"), "unknown selector")
+	}
+
+	abc := conf.Imap.Users["abc"]
+	abc.DefaultUpstream = "support"
+	user, name, err := (&ImapConf{Users: map[string]ImapUserConf{"abc": abc}}).lookupUser("abc")
+	A.NoError(err, "lookupUser")
+	A.Equal("abc", name)
+	A.Equal("127.0.0.1:1233", user.Upstream.Addr, "defaultUpstream")
+}
+
 func Test_mailpConnLog(t *testing.T) {
 	// connLog: handshake
 	t.Skip("TODO")
 }
 
 func testMailpBasic(t *testing.T, addr string, useLogin bool) {
-	A := Assert.New(t)
-
 	c, err := client.Dial(addr)
-	A.NoError(err, "client.New")
+	Assert.NoError(t, err, "client.New")
 	defer c.Terminate() // TODO: err?
 
+	testMailpClient(t, c, useLogin)
+}
+
+func testMailpClient(t *testing.T, c *client.Client, useLogin bool) {
+	A := Assert.New(t)
+
 	caps, err := c.Capability()
 	A.NoError(err, "c.caps()")
 	// caps map[AUTH=PLAIN:true CAPABILITY:true IMAP4rev1:true LITERAL+:true SASL-IR:true]
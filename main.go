@@ -4,7 +4,9 @@ import (
 	"flag"
 	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func main() {
@@ -25,23 +27,51 @@ func main() {
 		os.Exit(1)
 	}
 
-	conf := &MailpConf{}
-	{
-		var cs []byte
-		cs, err = os.ReadFile(*configPath)
-		if err == nil {
-			err = conf.Load(string(cs))
-		}
-	}
+	conf, err := loadConfFile(*configPath)
 	if err != nil {
 		panic(err)
 	}
 
 	mp := &Mailp{conf: conf}
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		// signals during the start wait for it
+		<-mp.Ready()
+		for sig := range sigCh {
+			if sig != syscall.SIGHUP {
+				mp.Stop()
+				continue
+			}
+
+			conf, err := loadConfFile(*configPath)
+			if err != nil {
+				mp.log.Printf("reload config fail: %s\n", err)
+				continue
+			}
+			if err := mp.Reload(conf); err != nil {
+				mp.log.Printf("reload config fail: %s\n", err)
+			}
+		}
+	}()
+
 	err = mp.Start()
 	if err != nil {
 		panic(err)
 	}
 
 }
+
+func loadConfFile(path string) (*MailpConf, error) {
+	cs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &MailpConf{}
+	if err := conf.Load(string(cs)); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+const (
+	defaultMirrorInterval = 5 * time.Minute
+	// new messages are fetched this many at a time
+	mirrorFetchBatch = 50
+)
+
+// mirrored reports whether conf asks for a mirror, passthrough logins have
+// no credentials to sync with.
+func (c *ImapUpstreamConf) mirrored() bool {
+	return c.Mirror.Dir != "" && c.Auth.Type != "passthrough"
+}
+
+// A mirrorStore is the copy of the mailboxes of an account in dir, a dir
+// per mailbox with its index and a file per message body.
+type mirrorStore struct {
+	dir string
+
+	mu sync.RWMutex
+	// replaced on sync, never changed in place
+	boxes map[string]*mirrorBox
+}
+
+type mirrorBox struct {
+	Name          string
+	Delimiter     string
+	Attributes    []string
+	UidValidity   uint32
+	HighestModSeq uint64
+	// by UID
+	Messages []*mirrorMsg
+}
+
+type mirrorMsg struct {
+	Uid   uint32
+	Flags []string
+	Date  time.Time
+	Size  uint32
+}
+
+func openMirrorStore(dir string) (*mirrorStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mirror dir fail: %w", err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("mirror dir fail: %w", err)
+	}
+
+	s := &mirrorStore{dir: dir, boxes: map[string]*mirrorBox{}}
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, ent.Name(), "index.json"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read mirror index fail: %w", err)
+		}
+		box := &mirrorBox{}
+		if err := json.Unmarshal(b, box); err != nil {
+			return nil, fmt.Errorf("bad mirror index %s: %w", ent.Name(), err)
+		}
+		s.boxes[box.Name] = box
+	}
+	return s, nil
+}
+
+func (s *mirrorStore) boxDir(name string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(name)))
+}
+
+func (s *mirrorStore) bodyPath(name string, uid uint32) string {
+	return filepath.Join(s.boxDir(name), strconv.FormatUint(uint64(uid), 10)+".eml")
+}
+
+func (s *mirrorStore) get(name string) *mirrorBox {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.boxes[name]
+}
+
+func (s *mirrorStore) names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.boxes))
+	for name := range s.boxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// put writes the index of box and makes it the one served.
+func (s *mirrorStore) put(box *mirrorBox) error {
+	b, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(s.boxDir(box.Name), "index.json")
+	if err := os.WriteFile(file+".tmp", b, 0o600); err != nil {
+		return fmt.Errorf("write mirror index fail: %w", err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return fmt.Errorf("write mirror index fail: %w", err)
+	}
+
+	s.mu.Lock()
+	s.boxes[box.Name] = box
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *mirrorStore) remove(name string) error {
+	s.mu.Lock()
+	delete(s.boxes, name)
+	s.mu.Unlock()
+
+	return os.RemoveAll(s.boxDir(name))
+}
+
+// A mirror syncs the store of an upstream account every Mirror.Interval,
+// and serves it when the upstream can not be reached.
+type mirror struct {
+	mp    *Mailp
+	conf  ImapUpstreamConf
+	store *mirrorStore
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	// the offline server, started on first use
+	srv    *server.Server
+	l      *connListener
+	secret string
+}
+
+// getMirror returns the mirror of conf, syncing from first use. A dir is
+// kept by the first account that uses it, others get no mirror.
+func (mp *Mailp) getMirror(conf *ImapUpstreamConf) *mirror {
+	dir := conf.Mirror.Dir
+
+	mp.mu.Lock()
+	m, ok := mp.mirrors[dir]
+	stopped := mp.stopped
+	mp.mu.Unlock()
+	if ok || stopped {
+		return mp.mirrorOf(m, conf)
+	}
+
+	store, err := openMirrorStore(dir)
+	if err != nil {
+		mp.log.Printf("mirror %s fail: %s\n", dir, err)
+		return nil
+	}
+
+	mp.mu.Lock()
+	if m, ok := mp.mirrors[dir]; ok || mp.stopped {
+		mp.mu.Unlock()
+		return mp.mirrorOf(m, conf)
+	}
+	m = &mirror{mp: mp, conf: *conf, store: store, done: make(chan struct{})}
+	mp.mirrors[dir] = m
+	mp.mu.Unlock()
+
+	go m.run()
+	return m
+}
+
+// mirrorOf returns m when it is the mirror of the account of conf.
+func (mp *Mailp) mirrorOf(m *mirror, conf *ImapUpstreamConf) *mirror {
+	if m == nil {
+		return nil
+	}
+	if a := mirrorAccount(conf); a != mirrorAccount(&m.conf) {
+		mp.log.Printf("mirror %s is of %s, not %s\n", conf.Mirror.Dir, mirrorAccount(&m.conf), a)
+		return nil
+	}
+	return m
+}
+
+// mirrorAccount names the upstream account whose mailboxes a mirror holds.
+func mirrorAccount(conf *ImapUpstreamConf) string {
+	return conf.Auth.Username + "@" + strings.Join(conf.addrs(), ",")
+}
+
+// checkMirrors returns an error when a mirror dir would hold two upstream
+// accounts, the ones of a route or user store depend on the login when its
+// username is a template.
+func checkMirrors(conf *MailpConf) error {
+	dirs := map[string]string{}
+	check := func(where string, u *ImapUserConf, perLogin bool) error {
+		ups := []ImapUpstreamConf{u.Upstream}
+		for _, up := range u.Upstreams {
+			ups = append(ups, up)
+		}
+		for i := range ups {
+			up := &ups[i]
+			if !up.mirrored() {
+				continue
+			}
+			dir := up.Mirror.Dir
+			if perLogin && strings.Contains(up.Auth.Username, "{{") {
+				return fmt.Errorf("%s: mirror dir %s is shared by the logins of a username template", where, dir)
+			}
+			account := mirrorAccount(up)
+			if a, ok := dirs[dir]; ok && a != account {
+				return fmt.Errorf("%s: mirror dir %s is used by %s too", where, dir, a)
+			}
+			dirs[dir] = account
+		}
+		return nil
+	}
+
+	for name, u := range conf.Imap.Users {
+		if err := check("imap.users."+name, &u, false); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Imap.Routes {
+		if err := check(fmt.Sprintf("imap.routes[%d]", i), &conf.Imap.Routes[i].ImapUserConf, true); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Imap.UserStores {
+		if err := check(fmt.Sprintf("imap.userStores[%d]", i), &conf.Imap.UserStores[i].User, true); err != nil {
+			return err
+		}
+	}
+	for name, u := range conf.Pop3.Users {
+		if err := check("pop3.users."+name, &u, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startMirrors starts syncing the mirrors of users in conf, others start
+// at their first login.
+func (mp *Mailp) startMirrors(conf *MailpConf) {
+	for _, u := range conf.Imap.Users {
+		if u.Upstream.mirrored() {
+			mp.getMirror(&u.Upstream)
+		}
+	}
+}
+
+// closeMirrors stops the mirrors, new ones are started with the config in
+// use.
+func (mp *Mailp) closeMirrors() {
+	mp.mu.Lock()
+	mirrors := mp.mirrors
+	mp.mirrors = map[string]*mirror{}
+	mp.mu.Unlock()
+
+	for _, m := range mirrors {
+		m.close()
+	}
+}
+
+func (m *mirror) run() {
+	every := m.conf.Mirror.Interval
+	if every <= 0 {
+		every = defaultMirrorInterval
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		if err := m.sync(); err != nil {
+			m.mp.log.Printf("mirror %s sync fail: %s\n", m.conf.Mirror.Dir, err)
+		}
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (m *mirror) close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.done)
+	srv := m.srv
+	m.mu.Unlock()
+
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+// sync brings the store up to the mailboxes matching Mirror.Mailboxes.
+func (m *mirror) sync() error {
+	sc, err := m.mp.dialSharedConn(0, &m.conf)
+	if err != nil {
+		return err
+	}
+	defer sc.uc.c.Close()
+
+	qresync := false
+	if sc.caps["QRESYNC"] {
+		resp, err := sc.run([]byte("x ENABLE QRESYNC\r\n"), nil)
+		if err != nil {
+			return err
+		}
+		qresync = resp.Name == "OK"
+	}
+
+	patterns := m.conf.Mirror.Mailboxes
+	if len(patterns) == 0 {
+		patterns = []string{imap.InboxName}
+	}
+	var boxes []*mirrorBox
+	resp, err := sc.run([]byte("x LIST \"\" \"*\"\r\n"), func(resp *ProxyResponse) error {
+		toks := imapTokens(resp.Data, 5)
+		if resp.Name != "LIST" || len(toks) < 5 || !toks[2].list {
+			return nil
+		}
+		box := &mirrorBox{
+			Name:       canonicalMailbox(decodeMailbox(toks[4].value)),
+			Attributes: strings.Fields(strings.Trim(toks[2].value, "()")),
+		}
+		var delim byte
+		if d := toks[3]; !d.nil && len(d.value) == 1 {
+			box.Delimiter, delim = d.value, d.value[0]
+		}
+		for _, a := range box.Attributes {
+			if strings.EqualFold(a, imap.NoSelectAttr) {
+				return nil
+			}
+		}
+		for _, p := range patterns {
+			if matchMailbox(canonicalMailbox(p), box.Name, delim) {
+				boxes = append(boxes, box)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Name != "OK" {
+		return fmt.Errorf("list fail: %s", strings.TrimSpace(string(resp.Data)))
+	}
+
+	listed := map[string]bool{}
+	for _, box := range boxes {
+		listed[box.Name] = true
+		if err := m.syncMailbox(sc, box, qresync); err != nil {
+			return fmt.Errorf("mailbox %s: %w", box.Name, err)
+		}
+	}
+	// gone upstream, or not matched anymore
+	for _, name := range m.store.names() {
+		if !listed[name] {
+			if err := m.store.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	sc.uc.c.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	sc.run([]byte("x LOGOUT\r\n"), nil)
+	return nil
+}
+
+// syncMailbox syncs one mailbox into box, which has the LIST attributes.
+// With QRESYNC the upstream tells what changed since the last sync, with
+// CONDSTORE flags are fetched only when they changed.
+func (m *mirror) syncMailbox(sc *sharedConn, box *mirrorBox, qresync bool) error {
+	known := map[uint32]*mirrorMsg{}
+	if old := m.store.get(box.Name); old != nil {
+		box.UidValidity, box.HighestModSeq = old.UidValidity, old.HighestModSeq
+		for _, msg := range old.Messages {
+			c := *msg
+			known[msg.Uid] = &c
+		}
+	}
+
+	args := ""
+	switch {
+	case qresync && box.UidValidity != 0 && box.HighestModSeq != 0:
+		args = fmt.Sprintf(" (QRESYNC (%d %d))", box.UidValidity, box.HighestModSeq)
+	case qresync || sc.caps["CONDSTORE"]:
+		args = " (CONDSTORE)"
+	}
+
+	var validity uint32
+	var modseq uint64
+	vanished := map[uint32]bool{}
+	flags := map[uint32][]string{}
+	onData := func(resp *ProxyResponse) error {
+		switch resp.Name {
+		case "FETCH":
+			toks := imapTokens(resp.Data, 4)
+			if len(toks) == 4 && toks[3].list {
+				if uid, f, ok := fetchItems(toks[3].value); uid > 0 && ok {
+					flags[uid] = strings.Fields(f)
+				}
+			}
+		case "VANISHED":
+			f := strings.Fields(string(resp.Data))
+			if set, err := imap.ParseSeqSet(f[len(f)-1]); err == nil {
+				for uid := range known {
+					if set.Contains(uid) {
+						vanished[uid] = true
+					}
+				}
+			}
+		default:
+			if v, ok := respCode(resp.Data, "UIDVALIDITY"); ok {
+				n, _ := strconv.ParseUint(v, 10, 32)
+				validity = uint32(n)
+			}
+			if v, ok := respCode(resp.Data, "HIGHESTMODSEQ"); ok {
+				modseq, _ = strconv.ParseUint(v, 10, 64)
+			}
+		}
+		return nil
+	}
+	resp, err := sc.run([]byte("x EXAMINE "+quoteMailbox(box.Name)+args+"\r\n"), onData)
+	if err != nil {
+		return err
+	}
+	if resp.Name != "OK" {
+		return fmt.Errorf("examine fail: %s", strings.TrimSpace(string(resp.Data)))
+	}
+
+	if validity != box.UidValidity {
+		// UIDs of before mean nothing now
+		if err := m.store.remove(box.Name); err != nil {
+			return err
+		}
+		known = map[uint32]*mirrorMsg{}
+		vanished = map[uint32]bool{}
+		box.HighestModSeq = 0
+		args = ""
+	}
+	if err := os.MkdirAll(m.store.boxDir(box.Name), 0o700); err != nil {
+		return err
+	}
+
+	var uids []uint32
+	if strings.Contains(args, "QRESYNC") {
+		// vanished and flags came with EXAMINE, only new messages left
+		last := uint32(0)
+		for uid := range known {
+			last = max(last, uid)
+		}
+		if uids, err = m.search(sc, fmt.Sprintf("UID %d:*", last+1)); err != nil {
+			return err
+		}
+	} else {
+		if uids, err = m.search(sc, "ALL"); err != nil {
+			return err
+		}
+		present := make(map[uint32]bool, len(uids))
+		for _, uid := range uids {
+			present[uid] = true
+		}
+		for uid := range known {
+			if !present[uid] {
+				vanished[uid] = true
+			}
+		}
+
+		if len(known) > 0 && (box.HighestModSeq == 0 || modseq != box.HighestModSeq) {
+			cmd := "x UID FETCH 1:* (FLAGS)"
+			if box.HighestModSeq != 0 && modseq != 0 {
+				cmd += fmt.Sprintf(" (CHANGEDSINCE %d)", box.HighestModSeq)
+			}
+			resp, err := sc.run([]byte(cmd+"\r\n"), onData)
+			if err != nil {
+				return err
+			}
+			if resp.Name != "OK" {
+				return fmt.Errorf("fetch flags fail: %s", strings.TrimSpace(string(resp.Data)))
+			}
+		}
+	}
+
+	for uid := range vanished {
+		delete(known, uid)
+		os.Remove(m.store.bodyPath(box.Name, uid))
+	}
+	for uid, f := range flags {
+		if msg, ok := known[uid]; ok {
+			msg.Flags = f
+		}
+	}
+
+	var added []uint32
+	for _, uid := range uids {
+		if _, ok := known[uid]; !ok {
+			added = append(added, uid)
+		}
+	}
+	for i := 0; i < len(added); i += mirrorFetchBatch {
+		set := new(imap.SeqSet)
+		set.AddNum(added[i:min(i+mirrorFetchBatch, len(added))]...)
+		if err := m.fetchNew(sc, box.Name, set, known); err != nil {
+			return err
+		}
+	}
+
+	box.UidValidity = validity
+	box.HighestModSeq = modseq
+	box.Messages = make([]*mirrorMsg, 0, len(known))
+	for _, msg := range known {
+		box.Messages = append(box.Messages, msg)
+	}
+	sort.Slice(box.Messages, func(i, j int) bool { return box.Messages[i].Uid < box.Messages[j].Uid })
+	return m.store.put(box)
+}
+
+// search returns the UIDs of UID SEARCH with criteria.
+func (m *mirror) search(sc *sharedConn, criteria string) ([]uint32, error) {
+	var uids []uint32
+	resp, err := sc.run([]byte("x UID SEARCH "+criteria+"\r\n"), func(resp *ProxyResponse) error {
+		if resp.Name != "SEARCH" {
+			return nil
+		}
+		for _, f := range strings.Fields(string(resp.Data))[2:] {
+			if n, err := strconv.ParseUint(f, 10, 32); err == nil {
+				uids = append(uids, uint32(n))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Name != "OK" {
+		return nil, fmt.Errorf("search fail: %s", strings.TrimSpace(string(resp.Data)))
+	}
+	return uids, nil
+}
+
+// fetchNew fetches the messages of set into the store and known.
+func (m *mirror) fetchNew(sc *sharedConn, name string, set *imap.SeqSet, known map[uint32]*mirrorMsg) error {
+	cmd := "x UID FETCH " + set.String() + " (UID FLAGS INTERNALDATE RFC822.SIZE BODY.PEEK[])\r\n"
+	resp, err := sc.run([]byte(cmd), func(resp *ProxyResponse) error {
+		toks := imapTokens(resp.Data, 4)
+		if resp.Name != "FETCH" || len(toks) < 4 || !toks[3].list {
+			return nil
+		}
+		items := imapTokens([]byte(toks[3].value[1:len(toks[3].value)-1]), 64)
+
+		msg := &mirrorMsg{}
+		var body []byte
+		for k := 0; k+1 < len(items); k += 2 {
+			v := items[k+1].value
+			switch strings.ToUpper(items[k].value) {
+			case "UID":
+				n, _ := strconv.ParseUint(v, 10, 32)
+				msg.Uid = uint32(n)
+			case "FLAGS":
+				msg.Flags = strings.Fields(strings.Trim(v, "()"))
+			case "INTERNALDATE":
+				msg.Date, _ = time.Parse(imap.DateTimeLayout, v)
+			case "RFC822.SIZE":
+				n, _ := strconv.ParseUint(v, 10, 32)
+				msg.Size = uint32(n)
+			case "BODY[]":
+				body = []byte(v)
+			}
+		}
+		if msg.Uid == 0 || body == nil {
+			return nil
+		}
+		if msg.Size == 0 {
+			msg.Size = uint32(len(body))
+		}
+		if err := os.WriteFile(m.store.bodyPath(name, msg.Uid), body, 0o600); err != nil {
+			return err
+		}
+		known[msg.Uid] = msg
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Name != "OK" {
+		return fmt.Errorf("fetch fail: %s", strings.TrimSpace(string(resp.Data)))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpMirror(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        mirror:
+          dir: ` + t.TempDir() + `
+          interval: 50ms
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+	upConf := conf.Imap.Users["abc"].Upstream
+	A.True(upConf.mirrored())
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	m := mp.getMirror(&upConf)
+	A.NotNil(m)
+	other := upConf
+	other.Auth.Username = "other"
+	A.Nil(mp.getMirror(&other), "a dir is of one account")
+	count := func() int {
+		if b := m.store.get("INBOX"); b != nil {
+			return len(b.Messages)
+		}
+		return -1
+	}
+	A.Eventually(func() bool { return count() == 1 }, 2*time.Second, 10*time.Millisecond, "synced")
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	A.NoError(c.Login("abc", "pw"), "login")
+	msg := func(subject string) imap.Literal {
+		return imap.Literal(strings.NewReader("Subject: " + subject + "\r\n\r\nhi\r\n"))
+	}
+	A.NoError(c.Append("INBOX", nil, time.Now(), msg("keep")), "append")
+	A.NoError(c.Append("INBOX", nil, time.Now(), msg("drop")), "append")
+	A.Eventually(func() bool { return count() == 3 }, 2*time.Second, 10*time.Millisecond, "new messages")
+
+	_, err = c.Select("INBOX", false)
+	A.NoError(err, "select")
+	seqs := new(imap.SeqSet)
+	seqs.AddNum(3)
+	A.NoError(c.Store(seqs, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil), "store")
+	A.NoError(c.Expunge(nil), "expunge")
+	A.Eventually(func() bool { return count() == 2 }, 2*time.Second, 10*time.Millisecond, "expunged")
+	c.Logout()
+
+	// upstream down, served from the mirror
+	imapt.Close()
+
+	c, err = client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+	A.NoError(c.Login("abc", "pw"), "login offline")
+
+	select {
+	case u := <-updates:
+		su, ok := u.(*client.StatusUpdate)
+		A.True(ok, "status update")
+		A.Equal(imap.CodeAlert, su.Status.Code)
+		A.Contains(su.Status.Info, "offline")
+	case <-time.After(time.Second):
+		A.Fail("no alert")
+	}
+
+	ch := make(chan *imap.MailboxInfo, 10)
+	A.NoError(c.List("", "*", ch), "list")
+	info := <-ch
+	A.Equal("INBOX", info.Name)
+
+	mbox, err := c.Select("INBOX", false)
+	A.NoError(err, "select offline")
+	A.EqualValues(2, mbox.Messages)
+
+	section := &imap.BodySectionName{}
+	mch := make(chan *imap.Message, 1)
+	seqs = new(imap.SeqSet)
+	seqs.AddNum(2)
+	A.NoError(c.Fetch(seqs, []imap.FetchItem{section.FetchItem()}, mch), "fetch offline")
+	b, err := io.ReadAll((<-mch).GetBody(section))
+	A.NoError(err)
+	A.Contains(string(b), "Subject: keep")
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", "keep")
+	ids, err := c.Search(criteria)
+	A.NoError(err, "search offline")
+	A.Equal([]uint32{2}, ids)
+
+	// the selected box is kept when the store changes under the session
+	old := m.store.get("INBOX")
+	A.NoError(m.store.put(&mirrorBox{Name: old.Name, Delimiter: old.Delimiter, UidValidity: old.UidValidity, Messages: old.Messages[:1]}))
+	mch = make(chan *imap.Message, 1)
+	A.NoError(c.Fetch(seqs, []imap.FetchItem{imap.FetchUid}, mch), "fetch snapshot")
+	A.Equal(old.Messages[1].Uid, (<-mch).Uid)
+
+	err = c.Store(seqs, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.FlaggedFlag}, nil)
+	A.Error(err, "read-only")
+}
+
+func Test_checkMirrors(t *testing.T) {
+	A := Assert.New(t)
+
+	load := func(s string) *MailpConf {
+		conf := &MailpConf{}
+		A.NoError(conf.Load(s), "load conf")
+		return conf
+	}
+
+	A.NoError(checkMirrors(load(`
+imap:
+  users:
+    a:
+      upstream:
+        addr: 127.0.0.1:1233
+        mirror: {dir: /tmp/m}
+        auth: {type: plain, username: u}
+    b:
+      upstream:
+        addr: 127.0.0.1:1233
+        mirror: {dir: /tmp/m}
+        auth: {type: plain, username: u}
+`)), "one account")
+
+	err := checkMirrors(load(`
+imap:
+  users:
+    a:
+      upstream:
+        addr: 127.0.0.1:1233
+        mirror: {dir: /tmp/m}
+        auth: {type: plain, username: u}
+      upstreams:
+        work:
+          addr: 127.0.0.1:1233
+          mirror: {dir: /tmp/m}
+          auth: {type: plain, username: w}
+`))
+	A.Error(err, "two accounts")
+	A.Contains(err.Error(), "/tmp/m")
+
+	err = checkMirrors(load(`
+imap:
+  routes:
+    - match: "*@example.com"
+      upstream:
+        addr: 127.0.0.1:1233
+        mirror: {dir: /tmp/m}
+        auth: {type: plain, username: "{{.Login}}"}
+`))
+	A.Error(err, "a dir for every login")
+	A.Contains(err.Error(), "imap.routes[0]")
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+var errOffline = errors.New("upstream unreachable, the offline mirror is read-only")
+
+// offlineAlert is sent to clients served from the mirror.
+const offlineAlert = "upstream unreachable, offline mode: read-only and possibly out of date"
+
+// session returns a conn logged in to the offline server of m as login, it
+// takes the place of an upstream conn in serve.
+func (m *mirror) session(cid int64, login string) (*upstreamConn, error) {
+	l, secret, err := m.server()
+	if err != nil {
+		return nil, err
+	}
+
+	c1, c2 := net.Pipe()
+	select {
+	case l.ch <- c2:
+	case <-l.done:
+		return nil, errors.New("mirror closed")
+	}
+
+	uc := &upstreamConn{
+		addr: "mirror:" + m.conf.Mirror.Dir,
+		c:    c1,
+		r:    imap.NewReader(bufio.NewReader(c1)),
+		w:    imap.NewWriter(bufio.NewWriter(c1)),
+	}
+	c1.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if err := readGreeting(uc.r); err != nil {
+		c1.Close()
+		return nil, err
+	}
+	if err := m.mp.loginUpstream(cid, uc, &ImapAuthConf{Type: "plain", Username: login, Password: secret}); err != nil {
+		c1.Close()
+		return nil, err
+	}
+	c1.SetDeadline(time.Time{})
+	return uc, nil
+}
+
+// server returns the listener of the offline server, started on first use.
+// Only mailp knows the secret to log in with.
+func (m *mirror) server() (*connListener, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, "", errors.New("mirror closed")
+	}
+	if m.srv != nil {
+		return m.l, m.secret, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	m.secret = hex.EncodeToString(b)
+	m.l = newConnListener()
+	m.srv = server.New(&mirrorBackend{store: m.store, secret: m.secret})
+	// over a pipe in the process
+	m.srv.AllowInsecureAuth = true
+	m.srv.ErrorLog = m.mp.log
+	go m.srv.Serve(m.l)
+	return m.l, m.secret, nil
+}
+
+// A connListener hands conns made in the process to a server.
+type connListener struct {
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{ch: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "mirror" }
+
+// mirrorBackend serves a mirrorStore read-only.
+type mirrorBackend struct {
+	store  *mirrorStore
+	secret string
+}
+
+func (b *mirrorBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if subtle.ConstantTimeCompare([]byte(password), []byte(b.secret)) != 1 {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &mirrorUser{store: b.store, name: username}, nil
+}
+
+type mirrorUser struct {
+	store *mirrorStore
+	name  string
+}
+
+func (u *mirrorUser) Username() string {
+	return u.name
+}
+
+func (u *mirrorUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	var boxes []backend.Mailbox
+	for _, name := range u.store.names() {
+		if b := u.store.get(name); b != nil {
+			boxes = append(boxes, &mirrorMailbox{store: u.store, name: name, b: b})
+		}
+	}
+	return boxes, nil
+}
+
+// GetMailbox is called by SELECT, EXAMINE and STATUS, the box is kept as
+// it is then for the session.
+func (u *mirrorUser) GetMailbox(name string) (backend.Mailbox, error) {
+	name = canonicalMailbox(name)
+	b := u.store.get(name)
+	if b == nil {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &mirrorMailbox{store: u.store, name: name, b: b}, nil
+}
+
+func (u *mirrorUser) CreateMailbox(name string) error {
+	return errOffline
+}
+
+func (u *mirrorUser) DeleteMailbox(name string) error {
+	return errOffline
+}
+
+func (u *mirrorUser) RenameMailbox(existingName, newName string) error {
+	return errOffline
+}
+
+func (u *mirrorUser) Logout() error {
+	return nil
+}
+
+// A mirrorMailbox is a snapshot of a box of the store, sequence numbers do
+// not change under a session when a sync replaces the box.
+type mirrorMailbox struct {
+	store *mirrorStore
+	name  string
+	b     *mirrorBox
+}
+
+func (mbox *mirrorMailbox) box() *mirrorBox {
+	return mbox.b
+}
+
+func (mbox *mirrorMailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *mirrorMailbox) Info() (*imap.MailboxInfo, error) {
+	b := mbox.box()
+	return &imap.MailboxInfo{Attributes: b.Attributes, Delimiter: b.Delimiter, Name: b.Name}, nil
+}
+
+func (mbox *mirrorMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	b := mbox.box()
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	// none, it is read-only
+	status.PermanentFlags = []string{}
+	status.ReadOnly = true
+
+	unseen := uint32(0)
+	for i, msg := range b.Messages {
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(b.Messages))
+		case imap.StatusUidNext:
+			status.UidNext = 1
+			if n := len(b.Messages); n > 0 {
+				status.UidNext = b.Messages[n-1].Uid + 1
+			}
+		case imap.StatusUidValidity:
+			status.UidValidity = b.UidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *mirrorMailbox) SetSubscribed(subscribed bool) error {
+	return errOffline
+}
+
+func (mbox *mirrorMailbox) Check() error {
+	return nil
+}
+
+func (mbox *mirrorMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	for i, msg := range mbox.box().Messages {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.Uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		m, err := mbox.fetch(msg, seqNum, items)
+		if err != nil {
+			continue
+		}
+		ch <- m
+	}
+	return nil
+}
+
+// fetch is like the one of the memory backend, the body is read from the
+// store when an item needs it.
+func (mbox *mirrorMailbox) fetch(msg *mirrorMsg, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	var body []byte
+	headerAndBody := func() (textproto.Header, *bufio.Reader, error) {
+		if body == nil {
+			b, err := os.ReadFile(mbox.store.bodyPath(mbox.name, msg.Uid))
+			if err != nil {
+				return textproto.Header{}, nil, err
+			}
+			body = b
+		}
+		r := bufio.NewReader(bytes.NewReader(body))
+		hdr, err := textproto.ReadHeader(r)
+		return hdr, r, err
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, r, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, r, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = msg.Flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.Date
+		case imap.FetchRFC822Size:
+			fetched.Size = msg.Size
+		case imap.FetchUid:
+			fetched.Uid = msg.Uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			hdr, r, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, r, section)
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+func (mbox *mirrorMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	for i, msg := range mbox.box().Messages {
+		seqNum := uint32(i + 1)
+
+		b, err := os.ReadFile(mbox.store.bodyPath(mbox.name, msg.Uid))
+		if err != nil {
+			continue
+		}
+		// an unknown charset is an error with the entity
+		e, _ := message.Read(bytes.NewReader(b))
+		if e == nil {
+			continue
+		}
+		if ok, err := backendutil.Match(e, seqNum, msg.Uid, msg.Date, msg.Flags, criteria); err != nil || !ok {
+			continue
+		}
+
+		id := seqNum
+		if uid {
+			id = msg.Uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (mbox *mirrorMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errOffline
+}
+
+func (mbox *mirrorMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return errOffline
+}
+
+func (mbox *mirrorMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return errOffline
+}
+
+func (mbox *mirrorMailbox) Expunge() error {
+	return errOffline
+}
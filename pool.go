@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	defaultPoolKeepAlive   = time.Minute
+	defaultPoolIdleTimeout = 30 * time.Minute
+	// a conn idle longer is checked with NOOP before it is handed out
+	poolCheckAfter = 10 * time.Second
+)
+
+// An upstreamPool keeps conns logged in to one upstream account, ready for
+// client logins. A conn taken is the session's and is closed with it, so
+// pooled conns only ever run NOOP and stay in the authenticated state.
+type upstreamPool struct {
+	mp   *Mailp
+	key  string
+	conf ImapUpstreamConf
+
+	mu      sync.Mutex
+	idle    []*pooledConn
+	dialing int
+	// of the last take, the pool goes after Pool.IdleTimeout without one
+	taken  time.Time
+	closed bool
+	done   chan struct{}
+}
+
+type pooledConn struct {
+	uc   *upstreamConn
+	used time.Time
+}
+
+// pooled reports whether conf asks for a pool, passthrough logins have no
+// credentials before the client logs in.
+func (c *ImapUpstreamConf) pooled() bool {
+	return c.Pool.Size > 0 && c.Auth.Type != "passthrough"
+}
+
+// getPool returns the pool of conf, started on first use.
+func (mp *Mailp) getPool(conf *ImapUpstreamConf) *upstreamPool {
+	b, _ := json.Marshal(conf)
+	key := string(b)
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.stopped {
+		return nil
+	}
+	if p, ok := mp.pools[key]; ok {
+		return p
+	}
+	p := &upstreamPool{mp: mp, key: key, conf: *conf, taken: time.Now(), done: make(chan struct{})}
+	mp.pools[key] = p
+	go p.keepAlive()
+	go p.fill()
+	return p
+}
+
+// closePools closes the pools and their idle conns, new ones are started
+// with the config in use.
+func (mp *Mailp) closePools() {
+	mp.mu.Lock()
+	pools := mp.pools
+	mp.pools = map[string]*upstreamPool{}
+	mp.mu.Unlock()
+
+	for _, p := range pools {
+		p.close()
+	}
+}
+
+// dropPool closes p, a later getPool starts a new one.
+func (mp *Mailp) dropPool(p *upstreamPool) {
+	mp.mu.Lock()
+	if mp.pools[p.key] == p {
+		delete(mp.pools, p.key)
+	}
+	mp.mu.Unlock()
+
+	p.close()
+}
+
+// take returns a ready conn, or nil when there is none. Its trace is the
+// session's from now on.
+func (p *upstreamPool) take(cid int64, doLog *atomic.Bool) *upstreamConn {
+	defer func() {
+		go p.fill()
+	}()
+
+	for {
+		p.mu.Lock()
+		p.taken = time.Now()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.used) > poolCheckAfter && !p.check(pc) {
+			continue
+		}
+		p.mp.log.Printf("conn(%d) pooled upstream: %s", cid, pc.uc.addr)
+		pc.uc.trace.bind(cid, doLog)
+		return pc.uc
+	}
+}
+
+// check sends NOOP on pc, closing it when that fails.
+func (p *upstreamPool) check(pc *pooledConn) bool {
+	pc.uc.c.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	ret, err := pc.uc.exec(&imap.Command{Name: "NOOP"}, nil)
+	pc.uc.c.SetDeadline(time.Time{})
+	if err != nil || ret.Type != imap.StatusRespOk {
+		pc.uc.c.Close()
+		return false
+	}
+	pc.used = time.Now()
+	return true
+}
+
+// fill dials and logs in until the pool has size conns.
+func (p *upstreamPool) fill() {
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle)+p.dialing >= p.conf.Pool.Size {
+			p.mu.Unlock()
+			return
+		}
+		p.dialing++
+		p.mu.Unlock()
+
+		uc, err := p.mp.connectUpstream(0, &p.conf, nil)
+		if err == nil {
+			if err = p.mp.loginUpstream(0, uc, &p.conf.Auth); err != nil {
+				uc.c.Close()
+			}
+		}
+
+		p.mu.Lock()
+		p.dialing--
+		if err == nil && !p.closed {
+			p.idle = append(p.idle, &pooledConn{uc: uc, used: time.Now()})
+			uc = nil
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			// tried again at the next keepAlive
+			p.mp.log.Printf("upstream pool fill fail: %s\n", err)
+			return
+		}
+		if uc != nil {
+			uc.c.Close()
+		}
+	}
+}
+
+// keepAlive sends NOOP on idle conns every Pool.KeepAlive and fills the
+// pool back. A pool not taken from for Pool.IdleTimeout is closed.
+func (p *upstreamPool) keepAlive() {
+	every := p.conf.Pool.KeepAlive
+	if every <= 0 {
+		every = defaultPoolKeepAlive
+	}
+	idleTimeout := p.conf.Pool.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultPoolIdleTimeout
+	}
+	t := time.NewTicker(min(every, idleTimeout))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+
+		p.mu.Lock()
+		unused := time.Since(p.taken) >= idleTimeout
+		p.mu.Unlock()
+		if unused {
+			p.mp.dropPool(p)
+			return
+		}
+
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = nil
+		p.mu.Unlock()
+
+		var alive []*pooledConn
+		for _, pc := range idle {
+			if p.check(pc) {
+				alive = append(alive, pc)
+			}
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			for _, pc := range alive {
+				pc.uc.c.Close()
+			}
+		} else {
+			p.idle = append(p.idle, alive...)
+		}
+		p.mu.Unlock()
+
+		p.fill()
+	}
+}
+
+func (p *upstreamPool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.uc.c.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+		pc.uc.logout()
+	}
+}
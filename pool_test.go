@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpPool(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	A.NoError(err, "listen journal")
+	defer pc.Close()
+	// read all the time, a full socket blocks the writers
+	var journalMu sync.Mutex
+	var journalMsgs []string
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := pc.Read(buf)
+			if err != nil {
+				return
+			}
+			journalMu.Lock()
+			journalMsgs = append(journalMsgs, string(buf[:n]))
+			journalMu.Unlock()
+		}
+	}()
+	journal := func() []string {
+		journalMu.Lock()
+		defer journalMu.Unlock()
+		return append([]string(nil), journalMsgs...)
+	}
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+log:
+  output: journald://` + path + `
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        pool:
+          size: 1
+          keepAlive: 50ms
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+	upConf := conf.Imap.Users["abc"].Upstream
+	A.True(upConf.pooled())
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	idle := func(p *upstreamPool) int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.idle)
+	}
+	p := mp.getPool(&upConf)
+	A.Eventually(func() bool { return idle(p) == 1 }, time.Second, 10*time.Millisecond, "filled")
+	// kept alive with NOOP
+	time.Sleep(120 * time.Millisecond)
+	A.Equal(1, idle(p))
+
+	c, err := client.Dial("127.0.0.1:1234")
+	A.NoError(err, "client.Dial")
+	defer c.Terminate()
+	A.NoError(c.Login("abc", "pw"), "login")
+	_, err = c.Select("INBOX", false)
+	A.NoError(err, "select on a pooled conn")
+	A.Eventually(func() bool { return idle(p) == 1 }, time.Second, 10*time.Millisecond, "filled back")
+
+	// the pooled conn is traced as the session
+	A.NoError(c.Noop(), "noop")
+	A.Eventually(func() bool {
+		for _, msg := range journal() {
+			if strings.Contains(msg, "MESSAGE=s< ") && strings.Contains(msg, " NOOP\n") {
+				return strings.Contains(msg, "MAILP_USER=abc\n") && !strings.Contains(msg, "MAILP_CID=0\n")
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond, "pooled conn traced")
+
+	A.NoError(mp.Reload(conf), "reload")
+	A.NotSame(p, mp.getPool(&upConf), "pools restart on reload")
+
+	// a pool nobody takes from goes, like those of hook upstreams
+	hookConf := upConf
+	hookConf.Pool.IdleTimeout = 100 * time.Millisecond
+	hp := mp.getPool(&hookConf)
+	A.Eventually(func() bool {
+		hp.mu.Lock()
+		defer hp.mu.Unlock()
+		return hp.closed
+	}, time.Second, 10*time.Millisecond, "idle pool closed")
+	A.Empty(hp.idle, "its conns closed")
+	A.NotSame(hp, mp.getPool(&hookConf), "a new one later")
+
+	upConf.Auth.Type = "passthrough"
+	A.False(upConf.pooled(), "no credentials to pool with")
+}
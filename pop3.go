@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+)
+
+const (
+	// pop3Timeout is the autologout timer of RFC 1939.
+	pop3Timeout = 10 * time.Minute
+	// commands before login, like the imap handshake
+	pop3MaxAuthCommands = 10
+)
+
+var errPop3Auth = errors.New("[AUTH] bad username or password")
+
+func (mp *Mailp) acceptPop3(l net.Listener, lc *ImapListenerConf, stls *tls.Config) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go mp.servePop3(c, lc, stls)
+	}
+}
+
+// A pop3Session maps POP3 commands to the INBOX of an upstream conn, the
+// messages are the ones there at login.
+type pop3Session struct {
+	mp    *Mailp
+	sess  *session
+	conf  *MailpConf
+	doLog *atomic.Bool
+
+	c    net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	stls *tls.Config
+	// the APOP timestamp of the greeting
+	stamp string
+	// from USER
+	user string
+
+	// the logged in user, its policies apply as they do for imap
+	account *ImapUserConf
+	name    string
+	limits  *sessionLimits
+	// upstream name of the INBOX, after imap.users mailboxes rules
+	inbox string
+	// +OK or -ERR of the last reply, for the audit
+	status string
+
+	sc       *sharedConn
+	validity string
+	msgs     []pop3Msg
+}
+
+type pop3Msg struct {
+	uid     uint32
+	size    int64
+	deleted bool
+}
+
+func (mp *Mailp) servePop3(c net.Conn, lc *ImapListenerConf, stls *tls.Config) error {
+	sess := mp.addSession(c, lc)
+	cid := sess.cid
+	conf := mp.getConf()
+	mp.log.Printf("conn(%d) pop3 %s\n", cid, c.RemoteAddr())
+
+	s := &pop3Session{mp: mp, sess: sess, conf: conf, c: c, stls: stls}
+	defer func() {
+		mp.log.Printf("conn(%d) close\n", cid)
+		if s.sc != nil {
+			s.sc.uc.c.Close()
+		}
+		s.c.Close()
+		mp.removeSession(sess)
+	}()
+
+	if conf.Imap.ConnLog == "on" || conf.Imap.ConnLog == "handshake" {
+		s.doLog = &atomic.Bool{}
+		s.doLog.Store(true)
+	}
+
+	if tlsc, ok := c.(*tls.Conn); ok {
+		s.stls = nil
+		if err := tlsc.Handshake(); err != nil {
+			mp.log.Printf("conn(%d) tls handshake fail: %s\n", cid, err)
+			return err
+		}
+	}
+	s.setConn(c)
+
+	s.stamp = fmt.Sprintf("<%d.%d.%d@mailp>", os.Getpid(), cid, time.Now().UnixNano())
+	s.ok("mailp POP3 ready %s", s.stamp)
+
+	err := s.authorization()
+	if err == nil && s.sc != nil {
+		err = s.transaction()
+	}
+	if err != nil && err != io.EOF {
+		mp.log.Printf("conn(%d) pop3: %s\n", cid, err)
+	}
+	return err
+}
+
+func (s *pop3Session) setConn(c net.Conn) {
+	w := s.mp.traceWriter(s.sess.cid)
+	s.c = c
+	s.r = bufio.NewReader(newReaderWithMayPrefixWriter(c, "c> ", w, s.doLog))
+	s.w = bufio.NewWriter(newWriterWithMayPrefixWriter(c, "c< ", w, s.doLog))
+}
+
+func (s *pop3Session) ok(format string, args ...any) error {
+	s.status = "OK"
+	fmt.Fprintf(s.w, "+OK "+format+"\r\n", args...)
+	return s.w.Flush()
+}
+
+func (s *pop3Session) err(format string, args ...any) error {
+	s.status = "ERR"
+	fmt.Fprintf(s.w, "-ERR "+format+"\r\n", args...)
+	return s.w.Flush()
+}
+
+// readLine reads a command line without its CRLF, too long ones are errors.
+func (s *pop3Session) readLine() (string, error) {
+	s.c.SetReadDeadline(time.Now().Add(pop3Timeout))
+	line, err := s.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// command reads a command, its name upper cased.
+func (s *pop3Session) command() (string, []string, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return "", nil, err
+	}
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return "", nil, nil
+	}
+	return strings.ToUpper(f[0]), f[1:], nil
+}
+
+func (s *pop3Session) capa() error {
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "IMPLEMENTATION mailp"}
+	if s.sc == nil {
+		// passwords only over TLS when it can be had
+		if s.stls != nil {
+			caps = append(caps, "STLS")
+		} else {
+			caps = append(caps, "USER", "SASL PLAIN")
+		}
+	}
+	fmt.Fprintf(s.w, "+OK capability list follows\r\n")
+	for _, c := range caps {
+		fmt.Fprintf(s.w, "%s\r\n", c)
+	}
+	fmt.Fprintf(s.w, ".\r\n")
+	return s.w.Flush()
+}
+
+// authorization runs the AUTHORIZATION state, s.sc is set once logged in.
+// A client with STLS offered must use it before sending a password.
+func (s *pop3Session) authorization() error {
+	for n := 1; ; n++ {
+		name, args, err := s.command()
+		if err != nil {
+			return err
+		}
+		if n >= pop3MaxAuthCommands {
+			return s.err("[AUTH] too many commands")
+		}
+		if s.stls != nil && (name == "USER" || name == "PASS" || name == "AUTH") {
+			if err := s.err("STLS first"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch name {
+		case "CAPA":
+			err = s.capa()
+		case "USER":
+			if len(args) != 1 {
+				err = s.err("USER name")
+				break
+			}
+			s.user = args[0]
+			err = s.ok("send PASS")
+		case "PASS":
+			if s.user == "" {
+				err = s.err("USER first")
+				break
+			}
+			user := s.user
+			s.user = ""
+			err = s.loggedIn(s.login(user, strings.Join(args, " ")))
+		case "APOP":
+			if len(args) != 2 {
+				err = s.err("APOP name digest")
+				break
+			}
+			err = s.loggedIn(s.apop(args[0], args[1]))
+		case "AUTH":
+			err = s.auth(args)
+		case "STLS":
+			err = s.starttls()
+		case "QUIT":
+			s.ok("bye")
+			return nil
+		case "":
+			err = s.err("empty command")
+		default:
+			err = s.err("unsupported command %s", name)
+		}
+		if err != nil {
+			return err
+		}
+		if s.sc != nil {
+			return nil
+		}
+	}
+}
+
+// loggedIn answers a login attempt with its outcome.
+func (s *pop3Session) loggedIn(err error) error {
+	if err != nil {
+		return s.err("%s", err)
+	}
+	return s.ok("%d messages", len(s.msgs))
+}
+
+func (s *pop3Session) auth(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(s.w, "+OK\r\nPLAIN\r\n.\r\n")
+		return s.w.Flush()
+	}
+	if !strings.EqualFold(args[0], sasl.Plain) {
+		return s.err("unsupported mechanism %s", args[0])
+	}
+
+	var ir string
+	if len(args) > 1 {
+		ir = args[1]
+	} else {
+		fmt.Fprintf(s.w, "+ \r\n")
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "*" {
+			return s.err("AUTH cancelled")
+		}
+		ir = line
+	}
+	if ir == "=" {
+		ir = ""
+	}
+	b, err := base64.StdEncoding.DecodeString(ir)
+	if err != nil {
+		return s.err("bad base64")
+	}
+
+	var loginErr error
+	srv := sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errors.New("identities not supported")
+		}
+		loginErr = s.login(username, password)
+		return loginErr
+	})
+	if _, _, err := srv.Next(b); err != nil {
+		if loginErr != nil {
+			err = loginErr
+		}
+		return s.err("%s", err)
+	}
+	return s.loggedIn(nil)
+}
+
+func (s *pop3Session) starttls() error {
+	if s.stls == nil {
+		return s.err("STLS not available")
+	}
+	if err := s.ok("begin TLS"); err != nil {
+		return err
+	}
+
+	tlsc := tls.Server(s.c, s.stls)
+	if err := tlsc.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake fail: %w", err)
+	}
+	s.stls = nil
+	s.user = ""
+	s.setConn(tlsc)
+	return nil
+}
+
+// users returns pop3.users, then the imap users and stores.
+func (s *pop3Session) users() (UserStore, *authHook) {
+	users, hook := s.mp.getUsers()
+	if len(s.conf.Pop3.Users) > 0 {
+		users = userStores{&confUserStore{&ImapConf{Users: s.conf.Pop3.Users}}, users}
+	}
+	return users, hook
+}
+
+// login checks a password like the imap handshake does, and opens the
+// upstream of the user.
+func (s *pop3Session) login(username, password string) error {
+	cid := s.sess.cid
+	users, hook := s.users()
+
+	user, name, err := users.VerifyPassword(username, password)
+	if err == nil {
+		return s.open(user, name, password)
+	}
+	if err == errNoSuchUser && hook != nil {
+		user, err := hook.check(&authHookRequest{
+			Username:   username,
+			Password:   password,
+			Mechanism:  "LOGIN",
+			RemoteAddr: s.c.RemoteAddr().String(),
+		})
+		if err != nil {
+			return errPop3Auth
+		}
+		return s.open(user, username, password)
+	}
+	if err != errNoSuchUser && err != errBadPassword {
+		s.mp.log.Printf("conn(%d) verify user %s fail: %s\n", cid, username, err)
+	}
+	return errPop3Auth
+}
+
+// apop checks digest against the password of a configured user, so there
+// must be one in clear.
+func (s *pop3Session) apop(username, digest string) error {
+	users, _ := s.users()
+	user, name, err := users.LookupUser(username)
+	if err != nil || user.Password == "" || user.Upstream.Auth.Type == "passthrough" {
+		return errPop3Auth
+	}
+	sum := md5.Sum([]byte(s.stamp + user.Password))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(digest))) != 1 {
+		return errPop3Auth
+	}
+	return s.open(user, name, "")
+}
+
+// open logs in to the upstream of user and lists its INBOX.
+func (s *pop3Session) open(user *ImapUserConf, name, secret string) error {
+	mp := s.mp
+	cid := s.sess.cid
+
+	inbox, ok := user.Mailboxes.toUpstream(imap.InboxName)
+	if !ok {
+		return errors.New("[SYS/PERM] no INBOX for this user")
+	}
+
+	mp.log.Printf("conn(%d) user %s", cid, name)
+	mp.mu.Lock()
+	s.sess.user = name
+	mp.mu.Unlock()
+
+	var uc *upstreamConn
+	if user.Upstream.pooled() {
+		if p := mp.getPool(&user.Upstream); p != nil {
+			uc = p.take(cid, s.doLog)
+		}
+	}
+	if uc == nil {
+		var err error
+		if uc, err = mp.connectUpstream(cid, &user.Upstream, s.doLog); err != nil {
+			return errors.New("[SYS/TEMP] upstream unavailable")
+		}
+		if err := mp.loginUpstream(cid, uc, user.upstreamAuth(name, secret)); err != nil {
+			uc.c.Close()
+			if user.Upstream.Auth.Type == "passthrough" {
+				return errPop3Auth
+			}
+			return errors.New("[SYS/TEMP] upstream login fail")
+		}
+	}
+	sc, err := newSharedConn(uc)
+	if err != nil {
+		return errors.New("[SYS/TEMP] upstream unavailable")
+	}
+	if s.conf.Imap.ConnLog == "handshake" {
+		s.doLog.Store(false)
+	}
+
+	s.account, s.name, s.inbox = user, name, inbox
+	if err := s.list(sc); err != nil {
+		mp.log.Printf("conn(%d) pop3 list fail: %s\n", cid, err)
+		sc.uc.c.Close()
+		return errors.New("[SYS/TEMP] INBOX unavailable")
+	}
+	s.sc = sc
+
+	// rateLimit and dailyQuota, like the pipe
+	if s.limits = mp.newSessionLimits(name, user); s.limits != nil {
+		sc.r = bufio.NewReader(s.limits.reader(sc.r, s.limits.down))
+		s.r = bufio.NewReader(s.limits.reader(s.r, s.limits.up))
+	}
+	return nil
+}
+
+// list selects the INBOX on sc, EXAMINE for readOnly users, and reads the
+// UIDs and sizes of its messages.
+func (s *pop3Session) list(sc *sharedConn) error {
+	cmd := "x SELECT " + quoteMailbox(s.inbox) + "\r\n"
+	if s.account.ReadOnly {
+		cmd = "x EXAMINE " + quoteMailbox(s.inbox) + "\r\n"
+	}
+	ret, err := sc.run([]byte(cmd), func(resp *ProxyResponse) error {
+		if v, ok := respCode(resp.Data, "UIDVALIDITY"); ok {
+			s.validity = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ret.Name != "OK" {
+		return fmt.Errorf("select fail: %s", bytes.TrimSpace(ret.Data))
+	}
+	if sc.exists == 0 {
+		return nil
+	}
+
+	ret, err = sc.run([]byte("x UID FETCH 1:* (UID RFC822.SIZE)\r\n"), func(resp *ProxyResponse) error {
+		items := pop3FetchItems(resp)
+		uid, _ := strconv.ParseUint(items["UID"], 10, 32)
+		size, _ := strconv.ParseInt(items["RFC822.SIZE"], 10, 64)
+		if uid > 0 {
+			s.msgs = append(s.msgs, pop3Msg{uid: uint32(uid), size: size})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ret.Name != "OK" {
+		return fmt.Errorf("fetch fail: %s", bytes.TrimSpace(ret.Data))
+	}
+	return nil
+}
+
+// pop3FetchItems returns the items of a FETCH response by upper cased name.
+func pop3FetchItems(resp *ProxyResponse) map[string]string {
+	toks := imapTokens(resp.Data, 4)
+	if resp.Name != "FETCH" || len(toks) < 4 || !toks[3].list {
+		return nil
+	}
+	list := toks[3].value
+	toks = imapTokens([]byte(list[1:len(list)-1]), 64)
+
+	items := map[string]string{}
+	for k := 0; k+1 < len(toks); k += 2 {
+		items[strings.ToUpper(toks[k].value)] = toks[k+1].value
+	}
+	return items
+}
+
+// transaction runs the TRANSACTION state up to QUIT.
+func (s *pop3Session) transaction() error {
+	for {
+		name, args, err := s.command()
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+
+		switch name {
+		case "CAPA":
+			err = s.capa()
+		case "STAT":
+			n, size := 0, int64(0)
+			for _, m := range s.msgs {
+				if !m.deleted {
+					n++
+					size += m.size
+				}
+			}
+			err = s.ok("%d %d", n, size)
+		case "LIST", "UIDL":
+			err = s.listing(name, args)
+		case "RETR":
+			if len(args) != 1 {
+				err = s.err("RETR msg")
+				break
+			}
+			if s.limits != nil && s.limits.overQuota() {
+				err = s.err("[SYS/TEMP] daily transfer quota exceeded")
+				break
+			}
+			err = s.retr(args[0], -1)
+		case "TOP":
+			if len(args) != 2 {
+				err = s.err("TOP msg n")
+				break
+			}
+			n, perr := strconv.Atoi(args[1])
+			if perr != nil || n < 0 {
+				err = s.err("bad line count")
+				break
+			}
+			if s.limits != nil && s.limits.overQuota() {
+				err = s.err("[SYS/TEMP] daily transfer quota exceeded")
+				break
+			}
+			err = s.retr(args[0], n)
+		case "DELE":
+			if len(args) != 1 {
+				err = s.err("DELE msg")
+				break
+			}
+			if s.account.ReadOnly {
+				err = s.err("[SYS/PERM] read-only")
+				break
+			}
+			m, i, merr := s.msg(args[0])
+			if merr != nil {
+				err = s.err("%s", merr)
+				break
+			}
+			m.deleted = true
+			err = s.ok("message %d deleted", i)
+		case "NOOP":
+			err = s.ok("noop")
+		case "RSET":
+			for i := range s.msgs {
+				s.msgs[i].deleted = false
+			}
+			err = s.ok("%d messages", len(s.msgs))
+		case "QUIT":
+			uids, err := s.update()
+			s.audit(name, uids, start)
+			return err
+		case "":
+			err = s.err("empty command")
+		default:
+			err = s.err("unsupported command %s", name)
+		}
+		if name != "CAPA" && name != "NOOP" && name != "" {
+			// the message of RETR TOP DELE LIST UIDL
+			var uids string
+			if len(args) > 0 {
+				if i, aerr := strconv.Atoi(args[0]); aerr == nil && i >= 1 && i <= len(s.msgs) {
+					uids = strconv.FormatUint(uint64(s.msgs[i-1].uid), 10)
+				}
+			}
+			s.audit(name, uids, start)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// audit records a TRANSACTION command like the imap audit filter does.
+func (s *pop3Session) audit(command, uids string, start time.Time) {
+	if s.mp.getAudit() == nil {
+		return
+	}
+	rec := &auditRecord{
+		Time:       start,
+		Cid:        s.sess.cid,
+		User:       s.name,
+		Upstream:   s.sc.uc.addr,
+		Command:    "POP3 " + command,
+		Mailbox:    s.inbox,
+		Uids:       uids,
+		Status:     s.status,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err := s.mp.writeAudit(rec); err != nil {
+		s.mp.log.Printf("conn(%d) audit fail: %s\n", s.sess.cid, err)
+	}
+}
+
+// msg returns the message numbered arg, not deleted.
+func (s *pop3Session) msg(arg string) (*pop3Msg, int, error) {
+	i, err := strconv.Atoi(arg)
+	if err != nil || i < 1 || i > len(s.msgs) {
+		return nil, 0, fmt.Errorf("no such message %s", arg)
+	}
+	m := &s.msgs[i-1]
+	if m.deleted {
+		return nil, 0, fmt.Errorf("message %d already deleted", i)
+	}
+	return m, i, nil
+}
+
+// listing answers LIST and UIDL, for one message or all.
+func (s *pop3Session) listing(name string, args []string) error {
+	line := func(i int, m *pop3Msg) string {
+		if name == "UIDL" {
+			return fmt.Sprintf("%d %s.%d", i, s.validity, m.uid)
+		}
+		return fmt.Sprintf("%d %d", i, m.size)
+	}
+
+	if len(args) > 0 {
+		m, i, err := s.msg(args[0])
+		if err != nil {
+			return s.err("%s", err)
+		}
+		return s.ok("%s", line(i, m))
+	}
+
+	fmt.Fprintf(s.w, "+OK\r\n")
+	for i := range s.msgs {
+		if m := &s.msgs[i]; !m.deleted {
+			fmt.Fprintf(s.w, "%s\r\n", line(i+1, m))
+		}
+	}
+	fmt.Fprintf(s.w, ".\r\n")
+	return s.w.Flush()
+}
+
+// retr sends a message, only its header and n lines of its body when n is
+// not negative.
+func (s *pop3Session) retr(arg string, n int) error {
+	m, _, err := s.msg(arg)
+	if err != nil {
+		return s.err("%s", err)
+	}
+
+	var body []byte
+	cmd := fmt.Sprintf("x UID FETCH %d (UID BODY.PEEK[])\r\n", m.uid)
+	ret, err := s.sc.run([]byte(cmd), func(resp *ProxyResponse) error {
+		items := pop3FetchItems(resp)
+		if v, ok := items["BODY[]"]; ok && items["UID"] == strconv.FormatUint(uint64(m.uid), 10) {
+			body = []byte(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ret.Name != "OK" || body == nil {
+		return s.err("[SYS/TEMP] message %s unavailable", arg)
+	}
+	if n >= 0 {
+		body = pop3Top(body, n)
+	}
+
+	fmt.Fprintf(s.w, "+OK %d octets\r\n", len(body))
+	writeDotStuffed(s.w, body)
+	return s.w.Flush()
+}
+
+// pop3Top returns the header of msg and n lines of its body.
+func pop3Top(msg []byte, n int) []byte {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return msg
+	}
+	end := i + 4
+	for ; n > 0 && end < len(msg); n-- {
+		j := bytes.IndexByte(msg[end:], '\n')
+		if j < 0 {
+			end = len(msg)
+			break
+		}
+		end += j + 1
+	}
+	return msg[:end]
+}
+
+// writeDotStuffed writes b as a multi-line response, lines ending in CRLF
+// and leading dots doubled, and the final dot line.
+func writeDotStuffed(w *bufio.Writer, b []byte) {
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			b = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) > 0 && line[0] == '.' {
+			w.WriteByte('.')
+		}
+		w.Write(line)
+		w.WriteString("\r\n")
+	}
+	w.WriteString(".\r\n")
+}
+
+// update runs the UPDATE state: deleted messages are expunged upstream,
+// it returns their UIDs. Without UIDPLUS a plain EXPUNGE also removes
+// messages deleted by others.
+func (s *pop3Session) update() (string, error) {
+	var set imap.SeqSet
+	for _, m := range s.msgs {
+		if m.deleted {
+			set.AddNum(m.uid)
+		}
+	}
+
+	var err error
+	if !set.Empty() {
+		expunge := "x EXPUNGE\r\n"
+		if s.sc.caps["UIDPLUS"] {
+			expunge = "x UID EXPUNGE " + set.String() + "\r\n"
+		}
+		for _, cmd := range []string{"x UID STORE " + set.String() + " +FLAGS.SILENT (\\Deleted)\r\n", expunge} {
+			var ret *ProxyResponse
+			if ret, err = s.sc.run([]byte(cmd), nil); err == nil && ret.Name != "OK" {
+				err = fmt.Errorf("%s", bytes.TrimSpace(ret.Data))
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	s.sc.uc.c.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	s.sc.uc.logout()
+	if err != nil {
+		s.mp.log.Printf("conn(%d) pop3 expunge fail: %s\n", s.sess.cid, err)
+		return set.String(), s.err("[SYS/TEMP] some deleted messages not removed")
+	}
+	return set.String(), s.ok("bye")
+}
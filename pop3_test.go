@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpPop3(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	pki := testNewPKI(t)
+	cert, key := pki.issue(t, "pop.example", []string{"pop.example"}, false)
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  audit:
+    file: ` + auditFile + `
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+pop3:
+  addr: ":1243"
+  stls: true
+  tls:
+    cert: ` + cert + `
+    key: ` + key + `
+  users:
+    scanner:
+      password: "scan"
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+    viewer:
+      password: "view"
+      readOnly: true
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+    hidden:
+      password: "hide"
+      mailboxes:
+        exclude: [INBOX]
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	up, err := client.Dial("127.0.0.1:1233")
+	A.NoError(err, "dial upstream")
+	defer up.Logout()
+	A.NoError(up.Login("username", "password"), "login upstream")
+	body := "Subject: dots\r\n\r\nfirst\r\n.dot line\r\nlast\r\n"
+	A.NoError(up.Append("INBOX", nil, time.Now(), imap.Literal(strings.NewReader(body))), "append")
+
+	dial := func() (*textproto.Conn, net.Conn, string) {
+		nc, err := net.Dial("tcp", "127.0.0.1:1243")
+		A.NoError(err, "dial")
+		c := textproto.NewConn(nc)
+		greeting, err := c.ReadLine()
+		A.NoError(err, "greeting")
+		A.True(strings.HasPrefix(greeting, "+OK "))
+		return c, nc, greeting[strings.IndexByte(greeting, '<'):]
+	}
+	cmd := func(c *textproto.Conn, line string) string {
+		A.NoError(c.PrintfLine("%s", line))
+		reply, err := c.ReadLine()
+		A.NoError(err, line)
+		return reply
+	}
+	multi := func(c *textproto.Conn, line string) []string {
+		reply := cmd(c, line)
+		A.True(strings.HasPrefix(reply, "+OK"), "%s: %s", line, reply)
+		lines, err := c.ReadDotLines()
+		A.NoError(err, line)
+		return lines
+	}
+
+	starttls := func(c *textproto.Conn, nc net.Conn) *textproto.Conn {
+		A.Equal("+OK begin TLS", cmd(c, "STLS"))
+		tlsc := tls.Client(nc, &tls.Config{ServerName: "pop.example", RootCAs: pki.pool()})
+		A.NoError(tlsc.Handshake(), "tls handshake")
+		return textproto.NewConn(tlsc)
+	}
+
+	c, nc, _ := dial()
+	capa := multi(c, "CAPA")
+	A.Contains(capa, "STLS")
+	A.NotContains(capa, "USER", "no passwords in clear")
+	A.Equal("-ERR STLS first", cmd(c, "USER scanner"))
+	A.Equal("-ERR STLS first", cmd(c, "AUTH PLAIN"))
+	c = starttls(c, nc)
+	capa = multi(c, "CAPA")
+	A.NotContains(capa, "STLS")
+	A.Contains(capa, "USER")
+
+	A.Equal("+OK send PASS", cmd(c, "USER scanner"))
+	A.True(strings.HasPrefix(cmd(c, "PASS bad"), "-ERR [AUTH]"))
+	cmd(c, "USER scanner")
+	A.Equal("+OK 2 messages", cmd(c, "PASS scan"))
+
+	A.True(strings.HasPrefix(cmd(c, "STAT"), "+OK 2 "))
+	A.Len(multi(c, "LIST"), 2)
+	uidl := multi(c, "UIDL")
+	A.Len(uidl, 2)
+	A.True(strings.HasPrefix(cmd(c, "UIDL 2"), "+OK "+uidl[1]))
+
+	A.Equal([]string{"Subject: dots", "", "first", ".dot line", "last"}, multi(c, "RETR 2"))
+	A.Equal([]string{"Subject: dots", "", "first"}, multi(c, "TOP 2 1"))
+
+	A.Equal("+OK message 2 deleted", cmd(c, "DELE 2"))
+	A.True(strings.HasPrefix(cmd(c, "RETR 2"), "-ERR"))
+	A.True(strings.HasPrefix(cmd(c, "STAT"), "+OK 1 "))
+	A.Equal("+OK bye", cmd(c, "QUIT"))
+	c.Close()
+
+	mbox, err := up.Select("INBOX", false)
+	A.NoError(err, "select upstream")
+	A.EqualValues(1, mbox.Messages, "expunged")
+
+	// imap users work too, with APOP
+	c, _, stamp := dial()
+	sum := md5.Sum([]byte(stamp + "pw"))
+	A.True(strings.HasPrefix(cmd(c, "APOP abc 0123"), "-ERR [AUTH]"))
+	A.Equal("+OK 1 messages", cmd(c, "APOP abc "+hex.EncodeToString(sum[:])))
+	A.Equal(uidl[:1], multi(c, "UIDL"))
+	A.Equal("+OK bye", cmd(c, "QUIT"))
+	c.Close()
+
+	c, nc, _ = dial()
+	c = starttls(c, nc)
+	A.Equal("+ ", cmd(c, "AUTH PLAIN"))
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00abc\x00pw"))
+	A.Equal("+OK 1 messages", cmd(c, ir))
+	cmd(c, "DELE 1")
+	A.Equal("+OK 1 messages", cmd(c, "RSET"))
+	A.True(strings.HasPrefix(cmd(c, "STAT"), "+OK 1 "))
+	c.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	mbox, err = up.Select("INBOX", false)
+	A.NoError(err, "select upstream")
+	A.EqualValues(1, mbox.Messages, "kept without QUIT")
+
+	// policies of the user apply
+	apop := func(c *textproto.Conn, stamp, name, password string) string {
+		sum := md5.Sum([]byte(stamp + password))
+		return cmd(c, "APOP "+name+" "+hex.EncodeToString(sum[:]))
+	}
+	c, _, stamp = dial()
+	A.Equal("+OK 1 messages", apop(c, stamp, "viewer", "view"))
+	A.True(strings.HasPrefix(cmd(c, "DELE 1"), "-ERR [SYS/PERM]"), "read-only")
+	A.Equal("+OK bye", cmd(c, "QUIT"))
+	c.Close()
+	mbox, err = up.Select("INBOX", false)
+	A.NoError(err, "select upstream")
+	A.EqualValues(1, mbox.Messages, "read-only kept")
+
+	c, _, stamp = dial()
+	A.True(strings.HasPrefix(apop(c, stamp, "hidden", "hide"), "-ERR [SYS/PERM]"), "INBOX hidden")
+	c.Close()
+
+	// guesses are limited per conn
+	c, _, stamp = dial()
+	for i := 0; i < 9; i++ {
+		A.True(strings.HasPrefix(apop(c, stamp, "abc", "guess"), "-ERR [AUTH]"))
+	}
+	A.Equal("-ERR [AUTH] too many commands", cmd(c, "NOOP"))
+	_, err = c.ReadLine()
+	A.Error(err, "closed")
+	c.Close()
+
+	b, err := os.ReadFile(auditFile)
+	A.NoError(err, "audit")
+	A.Contains(string(b), `"user":"scanner","upstream":"127.0.0.1:1233","command":"POP3 RETR","mailbox":"INBOX","uids":"`)
+	A.Contains(string(b), `"user":"viewer","upstream":"127.0.0.1:1233","command":"POP3 DELE","mailbox":"INBOX","uids":"`)
+}
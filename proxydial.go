@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dial connects to addr, through the proxy via when it is set.
+//
+// via is socks5://[user:pass@]host:port or http://[user:pass@]host:port
+// (CONNECT), "" or "direct" dials addr directly. The proxy handshake is
+// done by deadline.
+func (mp *Mailp) dial(addr, via string, deadline time.Time) (net.Conn, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if via == "" || via == "direct" {
+		return mp.d.DialContext(ctx, "tcp", addr)
+	}
+
+	u, err := url.Parse(via)
+	if err != nil {
+		return nil, badDialVia(via, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("bad dialVia: unsupported scheme %s", u.Scheme)
+	}
+
+	c, err := mp.d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %w", u.Host, err)
+	}
+	c.SetDeadline(deadline)
+
+	if u.Scheme == "socks5" {
+		err = socks5Connect(c, u.User, addr)
+	} else {
+		c, err = httpConnect(c, u.User, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// badDialVia is the parse error of via, which does not tell the password.
+// The url.Error would quote via whole, and its cause may quote the
+// userinfo, so that is only told when there is none.
+func badDialVia(via string, err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	scheme, rest, ok := strings.Cut(via, "://")
+	if !ok {
+		return fmt.Errorf("bad dialVia %s: %w", via, err)
+	}
+	host, _, _ := strings.Cut(rest, "/")
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		user, _, _ := strings.Cut(host[:i], ":")
+		return fmt.Errorf("bad dialVia %s://%s:xxxxx@%s", scheme, user, host[i+1:])
+	}
+	return fmt.Errorf("bad dialVia %s: %w", via, err)
+}
+
+// socks5Connect does the RFC 1928 CONNECT handshake, with RFC 1929 auth when
+// user is set. The host of addr is resolved by the proxy.
+func socks5Connect(c net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %s", portStr)
+	}
+	if len(host) > 255 {
+		return errors.New("host too long")
+	}
+
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := c.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[0] != 0x05 || b[1] != method {
+		return fmt.Errorf("socks5 method not accepted")
+	}
+
+	if user != nil {
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5 username or password too long")
+		}
+
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+
+		// VER 1 (RFC 1929) STATUS
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		if b[0] != 0x01 {
+			return fmt.Errorf("socks5 bad auth reply version %d", b[0])
+		}
+		if b[1] != 0x00 {
+			return fmt.Errorf("socks5 auth fail")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, 0x01)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, 0x04)
+		req = append(req, ip...)
+	} else {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP
+	res := make([]byte, 4)
+	if _, err := io.ReadFull(c, res); err != nil {
+		return err
+	}
+	if res[0] != 0x05 {
+		return fmt.Errorf("socks5 bad connect reply version %d", res[0])
+	}
+	if res[1] != 0x00 {
+		return fmt.Errorf("socks5 connect fail, reply %d", res[1])
+	}
+
+	// BND.ADDR BND.PORT
+	var skip int
+	switch res[3] {
+	case 0x01:
+		skip = 4 + 2
+	case 0x04:
+		skip = 16 + 2
+	case 0x03:
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			return err
+		}
+		skip = int(b[0]) + 2
+	default:
+		return fmt.Errorf("socks5 bad address type %d", res[3])
+	}
+	_, err = io.CopyN(io.Discard, c, int64(skip))
+	return err
+}
+
+// httpConnect opens a tunnel with HTTP CONNECT, the returned conn keeps what
+// the proxy sent after its response.
+func httpConnect(c net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(c); err != nil {
+		return c, err
+	}
+
+	br := bufio.NewReader(c)
+	// the body is the tunnel, do not read or close it
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return c, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("http connect: %s", res.Status)
+	}
+
+	return &bufConn{Conn: c, r: br}, nil
+}
+
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
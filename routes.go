@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+var errNoSuchUser = errors.New("no such user")
+
+// A loginInfo is the data of upstream credential templates.
+type loginInfo struct {
+	// alice@corp.example
+	Login string
+	// alice
+	Local string
+	// corp.example
+	Domain string
+}
+
+func newLoginInfo(login string) *loginInfo {
+	local, domain, _ := strings.Cut(login, "@")
+	return &loginInfo{Login: login, Local: local, Domain: domain}
+}
+
+// lookupUser returns the user for login, from Users or else from the first
+// matching route, with upstream credentials resolved for login.
+//
+// login may end with +selector or /selector to pick one of the user's
+// Upstreams, name is login without it.
+func (c *ImapConf) lookupUser(login string) (user *ImapUserConf, name string, err error) {
+	name, selector := login, ""
+
+	user, err = c.lookupName(name)
+	if err == errNoSuchUser {
+		i := lastSelectorIndex(login)
+		if i <= 0 {
+			return nil, "", errNoSuchUser
+		}
+		name, selector = login[:i], login[i+1:]
+
+		user, err = c.lookupName(name)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if user, err = user.selectUpstream(selector); err != nil {
+		return nil, "", err
+	}
+	if user, err = user.forLogin(name); err != nil {
+		return nil, "", err
+	}
+	return user, name, nil
+}
+
+// lookupName returns a copy of the user or route conf for name.
+func (c *ImapConf) lookupName(name string) (*ImapUserConf, error) {
+	if user, ok := c.Users[name]; ok {
+		return &user, nil
+	}
+
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if route.match(name) {
+			user := route.ImapUserConf
+			return &user, nil
+		}
+	}
+
+	return nil, errNoSuchUser
+}
+
+// selectUpstream returns a copy of u with Upstream replaced by the named one,
+// "" is the default upstream.
+func (u ImapUserConf) selectUpstream(selector string) (*ImapUserConf, error) {
+	if selector == "" {
+		selector = u.DefaultUpstream
+	}
+	if selector == "" {
+		return &u, nil
+	}
+
+	upstream, ok := u.Upstreams[selector]
+	if !ok {
+		return nil, errNoSuchUser
+	}
+	u.Upstream = upstream
+	return &u, nil
+}
+
+// lastSelectorIndex returns the index of the + or / before an upstream
+// selector in login, or -1.
+func lastSelectorIndex(login string) int {
+	return strings.LastIndexAny(login, "+/")
+}
+
+// match reports whether login matches the route pattern.
+func (r *ImapRouteConf) match(login string) bool {
+	return matchLogin(r.Match, login)
+}
+
+// matchLogin matches login against a path.Match pattern, case-insensitively.
+func matchLogin(pattern, login string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(login))
+	return ok
+}
+
+// forLogin returns a copy of u with the upstream credentials templates
+// executed for login.
+func (u ImapUserConf) forLogin(login string) (*ImapUserConf, error) {
+	info := newLoginInfo(login)
+
+	for _, s := range []*string{&u.Upstream.Auth.Username, &u.Upstream.Auth.Password} {
+		if !strings.Contains(*s, "{{") {
+			continue
+		}
+
+		tmpl, err := template.New("").Option("missingkey=error").Parse(*s)
+		if err != nil {
+			return nil, fmt.Errorf("upstream auth template: %w", err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, info); err != nil {
+			return nil, fmt.Errorf("upstream auth template: %w", err)
+		}
+		*s = b.String()
+	}
+
+	return &u, nil
+}
+
+// upstreamAuth returns the credentials to log in upstream, passthrough uses
+// the ones the client logged in with.
+func (u *ImapUserConf) upstreamAuth(login, password string) *ImapAuthConf {
+	if u.Upstream.Auth.Type != "passthrough" {
+		return &u.Upstream.Auth
+	}
+	return &ImapAuthConf{
+		Type:     "plain",
+		Username: login,
+		Password: password,
+	}
+}
@@ -0,0 +1,1689 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	defaultShareConns = 2
+	defaultShareWait  = 30 * time.Second
+	// a watch is kept this long after its last session in IDLE
+	shareWatchLinger = time.Minute
+	// IDLE is restarted before servers time it out
+	shareIdleRestart = 25 * time.Minute
+	// watches poll upstreams without IDLE
+	shareWatchPoll = 30 * time.Second
+	// client commands and upstream responses are buffered up to this
+	shareMaxMessage = 64 << 20
+)
+
+// shareCaps are upstream capabilities shared sessions pass on, mailp adds
+// LITERAL+ IDLE and UNSELECT which it does itself.
+var shareCaps = []string{"UIDPLUS", "MOVE", "NAMESPACE", "SPECIAL-USE", "ID", "CHILDREN", "QUOTA"}
+
+// shareForward are commands without a selected mailbox, sent as is.
+var shareForward = map[string]bool{
+	"LIST":         true,
+	"LSUB":         true,
+	"XLIST":        true,
+	"STATUS":       true,
+	"CREATE":       true,
+	"DELETE":       true,
+	"RENAME":       true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"APPEND":       true,
+	"NAMESPACE":    true,
+	"ID":           true,
+	"GETQUOTA":     true,
+	"GETQUOTAROOT": true,
+}
+
+// shareSeqCommands take sequence numbers of the session, sent as UIDs.
+var shareSeqCommands = map[string]bool{
+	"FETCH":  true,
+	"STORE":  true,
+	"COPY":   true,
+	"MOVE":   true,
+	"SEARCH": true,
+}
+
+// searchKeyArgs are the arguments of SEARCH keys, a sequence set is only a
+// key where no argument is expected.
+var searchKeyArgs = map[string]int{
+	"BCC":        1,
+	"BEFORE":     1,
+	"BODY":       1,
+	"CC":         1,
+	"CHARSET":    1,
+	"FROM":       1,
+	"HEADER":     2,
+	"KEYWORD":    1,
+	"LARGER":     1,
+	"ON":         1,
+	"SENTBEFORE": 1,
+	"SENTON":     1,
+	"SENTSINCE":  1,
+	"SINCE":      1,
+	"SMALLER":    1,
+	"SUBJECT":    1,
+	"TEXT":       1,
+	"TO":         1,
+	"UID":        1,
+	"UNKEYWORD":  1,
+}
+
+var seqSetRe = regexp.MustCompile(`^[0-9*][0-9*:,]*$`)
+
+var errShareMailbox = errors.New("selected mailbox changed upstream")
+
+var errShareBusy = errors.New("no shared upstream conn free")
+
+// shared reports whether conf asks for shared conns, passthrough logins
+// have no credentials before the client logs in.
+func (c *ImapUpstreamConf) shared() bool {
+	return c.Share.Enabled && c.Auth.Type != "passthrough"
+}
+
+// A sharedAccount holds the conns of an upstream account shared by its
+// sessions, a command borrows one for its run.
+type sharedAccount struct {
+	mp   *Mailp
+	conf ImapUpstreamConf
+	size int
+	wait time.Duration
+	done chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	idle    []*sharedConn
+	open    int
+	caps    map[string]bool
+	watches map[string]*sharedWatch
+	views   map[string]*sharedView
+	closed  bool
+}
+
+// A sharedView is what a conn last read of a mailbox, conns selecting it
+// later start from it with QRESYNC.
+type sharedView struct {
+	validity string
+	modseq   uint64
+	uids     []uint32
+	flags    map[uint32]string
+}
+
+// getShare returns the account of conf, accounts are kept until a reload
+// or stop.
+func (mp *Mailp) getShare(conf *ImapUpstreamConf) *sharedAccount {
+	b, _ := json.Marshal(conf)
+	key := string(b)
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.stopped {
+		return nil
+	}
+	if a, ok := mp.shares[key]; ok {
+		return a
+	}
+	size := conf.Share.Conns
+	if size <= 0 {
+		size = defaultShareConns
+	}
+	wait := conf.Share.Wait
+	if wait <= 0 {
+		wait = defaultShareWait
+	}
+	a := &sharedAccount{
+		mp:      mp,
+		conf:    *conf,
+		size:    size,
+		wait:    wait,
+		done:    make(chan struct{}),
+		watches: map[string]*sharedWatch{},
+		views:   map[string]*sharedView{},
+	}
+	a.cond = sync.NewCond(&a.mu)
+	mp.shares[key] = a
+	return a
+}
+
+// closeShares closes the accounts and their idle conns, new ones are
+// started with the config in use.
+func (mp *Mailp) closeShares() {
+	mp.mu.Lock()
+	shares := mp.shares
+	mp.shares = map[string]*sharedAccount{}
+	mp.mu.Unlock()
+
+	for _, a := range shares {
+		a.close()
+	}
+}
+
+// session starts a session of cid, the returned conn takes the place of
+// an upstream conn in serve.
+func (a *sharedAccount) session(cid int64) *upstreamConn {
+	c1, c2 := net.Pipe()
+	s := &sharedSession{
+		a:   a,
+		cid: cid,
+		c:   c2,
+		r:   bufio.NewReader(c2),
+		w:   bufio.NewWriter(c2),
+	}
+	go func() {
+		if err := s.serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+			a.mp.log.Printf("conn(%d) shared session: %s\n", cid, err)
+		}
+		c2.Close()
+	}()
+
+	return &upstreamConn{
+		addr: a.conf.addrs()[0],
+		c:    c1,
+		r:    imap.NewReader(bufio.NewReader(c1)),
+		w:    imap.NewWriter(bufio.NewWriter(c1)),
+	}
+}
+
+// dial connects and logs in a conn, cid 0 is for watches. QRESYNC is
+// enabled when the upstream has it.
+func (a *sharedAccount) dial(cid int64) (*sharedConn, error) {
+	sc, err := a.mp.dialSharedConn(cid, &a.conf)
+	if err != nil {
+		return nil, err
+	}
+	if sc.caps["QRESYNC"] {
+		resp, err := sc.run([]byte("x ENABLE QRESYNC\r\n"), nil)
+		if err != nil {
+			sc.uc.c.Close()
+			return nil, err
+		}
+		sc.qresync = resp.Name == "OK"
+	}
+
+	a.mu.Lock()
+	a.caps = sc.caps
+	a.mu.Unlock()
+	return sc, nil
+}
+
+// dialSharedConn connects and logs in a conn run by mailp, not a client.
+func (mp *Mailp) dialSharedConn(cid int64, conf *ImapUpstreamConf) (*sharedConn, error) {
+	uc, err := mp.connectUpstream(cid, conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := mp.loginUpstream(cid, uc, &conf.Auth); err != nil {
+		uc.c.Close()
+		return nil, err
+	}
+	return newSharedConn(uc)
+}
+
+// newSharedConn runs the logged in uc, its capabilities read first. uc is
+// closed on errors.
+func newSharedConn(uc *upstreamConn) (*sharedConn, error) {
+	sc := &sharedConn{uc: uc, r: bufio.NewReader(uc.r), caps: map[string]bool{}, used: time.Now()}
+	ret, err := sc.run([]byte("x CAPABILITY\r\n"), func(resp *ProxyResponse) error {
+		if resp.Name == "CAPABILITY" {
+			for _, c := range strings.Fields(string(resp.Data))[2:] {
+				sc.caps[strings.ToUpper(c)] = true
+			}
+		}
+		return nil
+	})
+	if err == nil && ret.Name != "OK" {
+		err = fmt.Errorf("capability fail: %s", bytes.TrimSpace(ret.Data))
+	}
+	if err != nil {
+		uc.c.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// borrow returns a conn for a command of cid, one with mailbox selected
+// when there is. It is errShareBusy when none is free within a.wait.
+func (a *sharedAccount) borrow(cid int64, mailbox string) (*sharedConn, error) {
+	deadline := time.Now().Add(a.wait)
+	timer := time.AfterFunc(a.wait, func() {
+		a.mu.Lock()
+		a.cond.Broadcast()
+		a.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	a.mu.Lock()
+	for {
+		if a.closed {
+			a.mu.Unlock()
+			return nil, errors.New("shared upstream closed")
+		}
+
+		if n := len(a.idle); n > 0 {
+			i := n - 1
+			for j, sc := range a.idle {
+				if mailbox != "" && sc.mailbox == mailbox {
+					i = j
+					break
+				}
+			}
+			sc := a.idle[i]
+			a.idle = append(a.idle[:i], a.idle[i+1:]...)
+			a.mu.Unlock()
+
+			if time.Since(sc.used) <= poolCheckAfter || sc.check() {
+				return sc, nil
+			}
+			a.mu.Lock()
+			a.open--
+			continue
+		}
+
+		if a.open < a.size {
+			a.open++
+			a.mu.Unlock()
+
+			sc, err := a.dial(cid)
+			if err != nil {
+				a.mu.Lock()
+				a.open--
+				a.cond.Signal()
+				a.mu.Unlock()
+				return nil, err
+			}
+			return sc, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			a.mu.Unlock()
+			return nil, errShareBusy
+		}
+		a.cond.Wait()
+	}
+}
+
+func (a *sharedAccount) release(sc *sharedConn) {
+	sc.used = time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if sc.broken || a.closed {
+		sc.uc.c.Close()
+		a.open--
+	} else {
+		a.idle = append(a.idle, sc)
+	}
+	a.cond.Signal()
+}
+
+// capabilities returns what sessions are told, the upstream ones known
+// with the first conn.
+func (a *sharedAccount) capabilities(cid int64) (string, error) {
+	a.mu.Lock()
+	caps := a.caps
+	a.mu.Unlock()
+	if caps == nil {
+		sc, err := a.borrow(cid, "")
+		if err != nil {
+			return "", err
+		}
+		a.release(sc)
+		caps = sc.caps
+	}
+
+	list := []string{"IMAP4rev1", "LITERAL+", "IDLE", "UNSELECT"}
+	for _, c := range shareCaps {
+		if caps[c] {
+			list = append(list, c)
+		}
+	}
+	return strings.Join(list, " "), nil
+}
+
+// view returns a copy of the view of mailbox, nil when there is none.
+func (a *sharedAccount) view(mailbox string) *sharedView {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	v := a.views[mailbox]
+	if v == nil {
+		return nil
+	}
+	return &sharedView{validity: v.validity, modseq: v.modseq, uids: slices.Clone(v.uids), flags: maps.Clone(v.flags)}
+}
+
+// setView keeps what sc read of its mailbox, when it can be resynced from.
+func (a *sharedAccount) setView(sc *sharedConn) {
+	if !sc.qresync || !sc.tracked || sc.modseq == 0 {
+		return
+	}
+	v := &sharedView{validity: sc.validity, modseq: sc.modseq, uids: slices.Clone(sc.uids), flags: maps.Clone(sc.flags)}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.views[sc.mailbox] = v
+}
+
+func (a *sharedAccount) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.done)
+	idle := a.idle
+	a.idle = nil
+	a.open -= len(idle)
+	a.cond.Broadcast()
+	a.mu.Unlock()
+
+	for _, sc := range idle {
+		sc.uc.c.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+		sc.uc.logout()
+	}
+}
+
+// A sharedConn is a logged in upstream conn, with what it has selected.
+type sharedConn struct {
+	uc   *upstreamConn
+	r    *bufio.Reader
+	caps map[string]bool
+	tag  int
+
+	mailbox  string
+	readOnly bool
+	validity string
+	exists   int
+	// untagged data and tagged OK of the select, told to sessions
+	// selecting the mailbox on sc later
+	lines    [][]byte
+	selected []byte
+
+	// the messages of mailbox in order, kept from untagged responses once
+	// tracked, modseq is that of the last refresh with CONDSTORE
+	tracked    bool
+	uids       []uint32
+	flags      map[uint32]string
+	condstore  bool
+	qresync    bool
+	modseq     uint64
+	seenModseq uint64
+	refreshed  time.Time
+
+	used   time.Time
+	broken bool
+}
+
+// readResponse reads a response with its literals, keeping the EXISTS
+// count of the conn.
+func (sc *sharedConn) readResponse() (*ProxyResponse, error) {
+	line, err := sc.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	data := line
+	for {
+		n, _, ok := literalSize(line)
+		if !ok {
+			break
+		}
+		if int64(len(data))+n > shareMaxMessage {
+			return nil, errors.New("upstream response too big")
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(sc.r, lit); err != nil {
+			return nil, err
+		}
+		if line, err = sc.r.ReadBytes('\n'); err != nil {
+			return nil, err
+		}
+		data = append(append(data, lit...), line...)
+	}
+
+	resp := parseProxyResponse(data)
+	if resp.Tag == "*" && (resp.Name == "EXISTS" || resp.Name == "EXPUNGE") {
+		if f := strings.Fields(string(data)); len(f) > 2 {
+			if n, err := strconv.Atoi(f[1]); err == nil {
+				if resp.Name == "EXISTS" {
+					sc.exists = n
+				} else {
+					sc.exists--
+				}
+			}
+		}
+	}
+	if resp.Tag == "*" && sc.tracked {
+		sc.track(resp)
+	}
+	return resp, nil
+}
+
+// track applies an untagged response to the messages of sc.
+func (sc *sharedConn) track(resp *ProxyResponse) {
+	switch resp.Name {
+	case "EXPUNGE":
+		toks := imapTokens(resp.Data, 2)
+		n, err := strconv.Atoi(toks[1].value)
+		if err == nil && n >= 1 && n <= len(sc.uids) {
+			delete(sc.flags, sc.uids[n-1])
+			sc.uids = slices.Delete(sc.uids, n-1, n)
+		}
+
+	case "VANISHED":
+		f := strings.Fields(string(resp.Data))
+		if len(f) < 3 {
+			return
+		}
+		set, err := imap.ParseSeqSet(f[len(f)-1])
+		if err != nil {
+			return
+		}
+		kept := sc.uids[:0]
+		for _, uid := range sc.uids {
+			if set.Contains(uid) {
+				delete(sc.flags, uid)
+			} else {
+				kept = append(kept, uid)
+			}
+		}
+		if !strings.EqualFold(f[2], "(EARLIER)") {
+			sc.exists -= len(sc.uids) - len(kept)
+		}
+		sc.uids = kept
+
+	case "FETCH":
+		toks := imapTokens(resp.Data, 4)
+		if len(toks) < 4 || !toks[3].list {
+			return
+		}
+		n, _ := strconv.Atoi(toks[1].value)
+		uid, flags, hasFlags := fetchItems(toks[3].value)
+		switch {
+		case n >= 1 && n <= len(sc.uids) && (uid == 0 || uid == sc.uids[n-1]):
+			uid = sc.uids[n-1]
+		case n == len(sc.uids)+1 && hasFlags && (n == 1 || uid > sc.uids[n-2]):
+			// a new message, read with its UID
+			sc.uids = append(sc.uids, uid)
+		default:
+			return
+		}
+		if hasFlags {
+			sc.flags[uid] = flags
+		}
+		sc.seenModseq = max(sc.seenModseq, fetchModseq(toks[3].value))
+	}
+}
+
+// open selects mailbox on sc, EXAMINE when readOnly. With QRESYNC the
+// messages are those of the view of a and the changes since, otherwise
+// they are read by refresh.
+func (sc *sharedConn) open(a *sharedAccount, mailbox string, readOnly bool) (*ProxyResponse, error) {
+	sc.close()
+
+	name := "SELECT"
+	if readOnly {
+		name = "EXAMINE"
+	}
+	args := ""
+	v := a.view(mailbox)
+	switch {
+	case sc.qresync && v != nil:
+		args = fmt.Sprintf(" (QRESYNC (%s %d))", v.validity, v.modseq)
+		sc.tracked, sc.uids, sc.flags = true, v.uids, v.flags
+	case sc.qresync || sc.caps["CONDSTORE"]:
+		args = " (CONDSTORE)"
+	}
+
+	validity := ""
+	resp, err := sc.run([]byte("x "+name+" "+imapQuote(mailbox)+args+"\r\n"), func(r *ProxyResponse) error {
+		switch r.Name {
+		case "EXISTS", "RECENT", "EXPUNGE", "FETCH", "VANISHED":
+			return nil
+		}
+		if v, ok := respCode(r.Data, "UIDVALIDITY"); ok {
+			validity = v
+		}
+		if v, ok := respCode(r.Data, "HIGHESTMODSEQ"); ok {
+			sc.modseq, _ = strconv.ParseUint(v, 10, 64)
+			sc.condstore = sc.modseq > 0
+		}
+		sc.lines = append(sc.lines, r.Data)
+		return nil
+	})
+	if err != nil || resp.Name != "OK" {
+		sc.close()
+		return resp, err
+	}
+	sc.mailbox, sc.readOnly, sc.validity, sc.selected = mailbox, readOnly, validity, resp.Data
+	if sc.tracked && validity != v.validity {
+		// QRESYNC was not for this mailbox
+		sc.tracked, sc.uids, sc.flags = false, nil, nil
+	}
+	return resp, nil
+}
+
+// close forgets the selected mailbox.
+func (sc *sharedConn) close() {
+	sc.mailbox, sc.validity, sc.lines, sc.selected = "", "", nil, nil
+	sc.tracked, sc.uids, sc.flags = false, nil, nil
+	sc.condstore, sc.modseq, sc.seenModseq = false, 0, 0
+	sc.refreshed = time.Time{}
+}
+
+// refresh brings the messages of sc up to the mailbox: NOOP for what the
+// upstream tells by itself, flags changed since the last refresh with
+// CONDSTORE, and the new messages. All are read the first time, and when
+// the count does not add up.
+func (sc *sharedConn) refresh(a *sharedAccount) error {
+	if !sc.tracked {
+		return sc.load(a)
+	}
+
+	since := sc.modseq
+	if err := sc.runOk("x NOOP\r\n"); err != nil {
+		return err
+	}
+	if sc.condstore && len(sc.uids) > 0 {
+		if err := sc.runOk(fmt.Sprintf("x UID FETCH 1:* (FLAGS) (CHANGEDSINCE %d)\r\n", since)); err != nil {
+			return err
+		}
+		sc.modseq = max(sc.modseq, sc.seenModseq)
+	}
+	if sc.exists > len(sc.uids) {
+		last := uint32(0)
+		if len(sc.uids) > 0 {
+			last = sc.uids[len(sc.uids)-1]
+		}
+		if err := sc.runOk(fmt.Sprintf("x UID FETCH %d:* (FLAGS)\r\n", last+1)); err != nil {
+			return err
+		}
+	}
+	if len(sc.uids) != sc.exists {
+		return sc.load(a)
+	}
+	sc.refreshed = time.Now()
+	return nil
+}
+
+// load reads all the messages of the selected mailbox.
+func (sc *sharedConn) load(a *sharedAccount) error {
+	sc.tracked = false
+	modseq := sc.modseq
+	uids, flags, err := sc.messages()
+	if err != nil {
+		return err
+	}
+	sc.tracked, sc.uids, sc.flags, sc.exists = true, uids, flags, len(uids)
+	sc.modseq = max(modseq, sc.seenModseq)
+	sc.refreshed = time.Now()
+	a.setView(sc)
+	return nil
+}
+
+// runOk runs data, a response other than OK is an error.
+func (sc *sharedConn) runOk(data string) error {
+	resp, err := sc.run([]byte(data), nil)
+	if err != nil {
+		return err
+	}
+	if resp.Name != "OK" {
+		return fmt.Errorf("%s fail: %s", parseProxyCommand([]byte(data)).Name, bytes.TrimSpace(resp.Data))
+	}
+	return nil
+}
+
+// run sends a command under a tag of its own, untagged responses go to
+// onData, which may be nil, and the tagged one is returned. An onData
+// error is returned after the tagged response, the conn stays usable.
+func (sc *sharedConn) run(data []byte, onData func(*ProxyResponse) error) (*ProxyResponse, error) {
+	resp, err := sc.exec(data, onData)
+	if resp == nil {
+		sc.broken = true
+	}
+	return resp, err
+}
+
+func (sc *sharedConn) exec(data []byte, onData func(*ProxyResponse) error) (*ProxyResponse, error) {
+	sc.tag++
+	tag := "s" + strconv.Itoa(sc.tag)
+	if i := bytes.IndexByte(data, ' '); i > 0 {
+		data = append([]byte(tag), data[i:]...)
+	}
+
+	var dataErr error
+	handle := func(resp *ProxyResponse) {
+		if onData != nil && dataErr == nil {
+			dataErr = onData(resp)
+		}
+	}
+
+	w := sc.uc.w
+	for rest := data; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n') + 1
+		if i == 0 {
+			i = len(rest)
+		}
+		line := rest[:i]
+		rest = rest[i:]
+
+		n, _, ok := literalSize(line)
+		if !ok {
+			w.Write(line)
+			continue
+		}
+		if int(n) > len(rest) {
+			return nil, errors.New("bad literal")
+		}
+		j := bytes.LastIndexByte(line, '{')
+		if sc.caps["LITERAL+"] {
+			fmt.Fprintf(w, "%s{%d+}\r\n", line[:j], n)
+		} else {
+			fmt.Fprintf(w, "%s{%d}\r\n", line[:j], n)
+			if err := w.Flush(); err != nil {
+				return nil, err
+			}
+			for {
+				resp, err := sc.readResponse()
+				if err != nil {
+					return nil, err
+				}
+				if resp.Tag == "+" {
+					break
+				}
+				if resp.Tag == tag {
+					// refused before the literal
+					return resp, dataErr
+				}
+				handle(resp)
+			}
+		}
+		w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := sc.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Tag == tag {
+			return resp, dataErr
+		}
+		if resp.Tag == "+" {
+			return nil, errors.New("unexpected continuation")
+		}
+		handle(resp)
+	}
+}
+
+// check sends NOOP, closing sc when that fails.
+func (sc *sharedConn) check() bool {
+	sc.uc.c.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	ret, err := sc.run([]byte("x NOOP\r\n"), nil)
+	sc.uc.c.SetDeadline(time.Time{})
+	if err != nil || ret.Name != "OK" {
+		sc.uc.c.Close()
+		return false
+	}
+	return true
+}
+
+// messages returns the UIDs and flags of the selected mailbox.
+func (sc *sharedConn) messages() ([]uint32, map[uint32]string, error) {
+	var uids []uint32
+	flags := map[uint32]string{}
+	if sc.exists == 0 {
+		return nil, flags, nil
+	}
+
+	ret, err := sc.run([]byte("x UID FETCH 1:* (FLAGS)\r\n"), func(resp *ProxyResponse) error {
+		if resp.Name != "FETCH" {
+			return nil
+		}
+		toks := imapTokens(resp.Data, 4)
+		if len(toks) < 4 || !toks[3].list {
+			return nil
+		}
+		if uid, f, _ := fetchItems(toks[3].value); uid > 0 {
+			uids = append(uids, uid)
+			flags[uid] = f
+			sc.seenModseq = max(sc.seenModseq, fetchModseq(toks[3].value))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if ret.Name != "OK" {
+		return nil, nil, fmt.Errorf("fetch flags fail: %s", bytes.TrimSpace(ret.Data))
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, flags, nil
+}
+
+// fetchItems returns the UID and FLAGS of a FETCH response list.
+func fetchItems(list string) (uid uint32, flags string, hasFlags bool) {
+	if len(list) < 2 {
+		return 0, "", false
+	}
+	toks := imapTokens([]byte(list[1:len(list)-1]), 64)
+	for k := 0; k+1 < len(toks); k += 2 {
+		switch strings.ToUpper(toks[k].value) {
+		case "UID":
+			n, _ := strconv.ParseUint(toks[k+1].value, 10, 32)
+			uid = uint32(n)
+		case "FLAGS":
+			flags = strings.TrimSuffix(strings.TrimPrefix(toks[k+1].value, "("), ")")
+			hasFlags = true
+		}
+	}
+	return uid, flags, hasFlags
+}
+
+// fetchModseq returns the MODSEQ of a FETCH response list, 0 without.
+func fetchModseq(list string) uint64 {
+	if len(list) < 2 {
+		return 0
+	}
+	toks := imapTokens([]byte(list[1:len(list)-1]), 64)
+	for k := 0; k+1 < len(toks); k += 2 {
+		if strings.EqualFold(toks[k].value, "MODSEQ") {
+			n, _ := strconv.ParseUint(strings.Trim(toks[k+1].value, "()"), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// respCode returns the argument of a response code, like UIDVALIDITY.
+func respCode(data []byte, name string) (string, bool) {
+	s := string(data)
+	i := strings.Index(strings.ToUpper(s), "["+name+" ")
+	if i < 0 {
+		return "", false
+	}
+	s = s[i+len(name)+2:]
+	j := strings.IndexByte(s, ']')
+	if j < 0 {
+		return "", false
+	}
+	return s[:j], true
+}
+
+func retag(data []byte, tag string) []byte {
+	return append([]byte(tag), data[bytes.IndexByte(data, ' '):]...)
+}
+
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// A sharedSession serves one client over shared conns. It keeps the UIDs
+// of the selected mailbox the client knows, sequence numbers are indexes
+// in it, and tells the client what changed with NOOP and IDLE.
+type sharedSession struct {
+	a   *sharedAccount
+	cid int64
+	c   net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+
+	// upstream name, "" when none is selected
+	mailbox  string
+	readOnly bool
+	validity string
+	uids     []uint32
+	flags    map[uint32]string
+}
+
+func (s *sharedSession) serve() error {
+	for {
+		data, err := s.readCommand()
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+
+		cmd := parseProxyCommand(data)
+		if cmd.Name == "" {
+			err = s.status("*", "BAD", "Null command")
+		} else {
+			err = s.handle(cmd)
+		}
+		if ferr := s.w.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCommand reads a command with its literals, nil when it was too big
+// and refused.
+func (s *sharedSession) readCommand() ([]byte, error) {
+	line, err := s.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	data := line
+	for {
+		n, sync, ok := literalSize(line)
+		if !ok {
+			return data, nil
+		}
+		if int64(len(data))+n > shareMaxMessage {
+			if err := s.skip(line); err != nil {
+				return nil, err
+			}
+			s.status(parseProxyCommand(data).Tag, "NO", "[TOOBIG] command too big")
+			return nil, s.w.Flush()
+		}
+		if sync {
+			s.w.WriteString("+ Ready\r\n")
+			if err := s.w.Flush(); err != nil {
+				return nil, err
+			}
+		}
+
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(s.r, lit); err != nil {
+			return nil, err
+		}
+		if line, err = s.r.ReadBytes('\n'); err != nil {
+			return nil, err
+		}
+		data = append(append(data, lit...), line...)
+	}
+}
+
+// skip drops the rest of a command, up to a synchronizing literal the
+// client waits to send.
+func (s *sharedSession) skip(line []byte) error {
+	for {
+		n, sync, ok := literalSize(line)
+		if !ok || sync {
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, s.r, n); err != nil {
+			return err
+		}
+		var err error
+		if line, err = s.r.ReadBytes('\n'); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sharedSession) status(tag, typ, text string) error {
+	_, err := fmt.Fprintf(s.w, "%s %s %s\r\n", tag, typ, text)
+	return err
+}
+
+// failed answers a command that could not run, a session whose mailbox
+// changed is closed.
+func (s *sharedSession) failed(tag string, err error) error {
+	if errors.Is(err, errShareMailbox) {
+		s.status("*", "BYE", err.Error())
+		return err
+	}
+	s.a.mp.log.Printf("conn(%d) shared upstream: %s\n", s.cid, err)
+	return s.status(tag, "NO", "[UNAVAILABLE] "+err.Error())
+}
+
+func (s *sharedSession) handle(cmd *ProxyCommand) error {
+	name := cmd.Name
+	switch {
+	case name == "CAPABILITY":
+		caps, err := s.a.capabilities(s.cid)
+		if err != nil {
+			return s.failed(cmd.Tag, err)
+		}
+		fmt.Fprintf(s.w, "* CAPABILITY %s\r\n", caps)
+		return s.status(cmd.Tag, "OK", "CAPABILITY completed")
+
+	case name == "NOOP" || name == "CHECK":
+		if s.mailbox != "" {
+			if err := s.sync(time.Now()); err != nil {
+				return s.failed(cmd.Tag, err)
+			}
+		}
+		return s.status(cmd.Tag, "OK", name+" completed")
+
+	case name == "LOGOUT":
+		s.status("*", "BYE", "logging out")
+		s.status(cmd.Tag, "OK", "LOGOUT completed")
+		s.w.Flush()
+		return io.EOF
+
+	case name == "IDLE":
+		return s.idle(cmd)
+
+	case name == "SELECT" || name == "EXAMINE":
+		return s.selectMailbox(cmd)
+
+	case name == "UNSELECT" || name == "CLOSE":
+		if s.mailbox == "" {
+			return s.status(cmd.Tag, "BAD", "No mailbox selected")
+		}
+		if name == "CLOSE" && !s.readOnly {
+			// deleted messages go, without EXPUNGE responses
+			resp, err := s.run([]byte("x CLOSE\r\n"), true, nil, func(sc *sharedConn) {
+				sc.close()
+			})
+			if err != nil {
+				return s.failed(cmd.Tag, err)
+			}
+			if resp.Name != "OK" {
+				_, err := s.w.Write(retag(resp.Data, cmd.Tag))
+				return err
+			}
+		}
+		s.deselect()
+		return s.status(cmd.Tag, "OK", name+" completed")
+
+	case shareForward[name]:
+		// the conn may have another mailbox selected, its FETCH are not ours
+		resp, err := s.run(cmd.Data, false, func(r *ProxyResponse) error {
+			if r.Name == "FETCH" {
+				return nil
+			}
+			return s.untagged(r)
+		}, nil)
+		if err != nil {
+			return s.failed(cmd.Tag, err)
+		}
+		_, err = s.w.Write(retag(resp.Data, cmd.Tag))
+		return err
+
+	case shareSeqCommands[name], shareSeqCommands[strings.TrimPrefix(name, "UID ")], name == "EXPUNGE", name == "UID EXPUNGE":
+		if s.mailbox == "" {
+			return s.status(cmd.Tag, "BAD", "No mailbox selected")
+		}
+		return s.selected(cmd)
+	}
+
+	return s.status(cmd.Tag, "BAD", "command not supported with a shared upstream")
+}
+
+// run borrows a conn, with the session mailbox selected when selected,
+// and runs data on it. after, when not nil, sees the conn after the
+// command.
+func (s *sharedSession) run(data []byte, selected bool, onData func(*ProxyResponse) error, after func(*sharedConn)) (*ProxyResponse, error) {
+	mailbox := ""
+	if selected {
+		mailbox = s.mailbox
+	}
+	sc, err := s.a.borrow(s.cid, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	defer s.a.release(sc)
+
+	if selected {
+		if err := s.ensure(sc); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := sc.run(data, onData)
+	if after != nil {
+		after(sc)
+	}
+	if resp == nil && err == nil {
+		err = errors.New("upstream conn lost")
+	}
+	return resp, err
+}
+
+// ensure selects the session mailbox on sc, read-only or not like the
+// session.
+func (s *sharedSession) ensure(sc *sharedConn) error {
+	if sc.mailbox == s.mailbox && sc.readOnly == s.readOnly {
+		return nil
+	}
+
+	resp, err := sc.open(s.a, s.mailbox, s.readOnly)
+	if err != nil {
+		return err
+	}
+	if resp.Name != "OK" {
+		return fmt.Errorf("%w: %s", errShareMailbox, bytes.TrimSpace(resp.Data[bytes.IndexByte(resp.Data, ' ')+1:]))
+	}
+	if sc.validity != "" && s.validity != "" && sc.validity != s.validity {
+		return fmt.Errorf("%w: UIDVALIDITY", errShareMailbox)
+	}
+	return nil
+}
+
+func (s *sharedSession) deselect() {
+	s.mailbox = ""
+	s.validity = ""
+	s.uids = nil
+	s.flags = nil
+}
+
+// index returns the position of uid in the session view, -1 when the
+// client does not know it.
+func (s *sharedSession) index(uid uint32) int {
+	i := sort.Search(len(s.uids), func(i int) bool { return s.uids[i] >= uid })
+	if i < len(s.uids) && s.uids[i] == uid {
+		return i
+	}
+	return -1
+}
+
+// untagged passes an upstream response on. EXISTS EXPUNGE VANISHED and
+// RECENT are of the shared conn, sessions learn changes with sync.
+func (s *sharedSession) untagged(resp *ProxyResponse) error {
+	switch resp.Name {
+	case "EXISTS", "EXPUNGE", "VANISHED", "RECENT", "BYE":
+		return nil
+	case "FETCH":
+		data, ok := s.fetchResp(resp.Data)
+		if !ok {
+			return nil
+		}
+		_, err := s.w.Write(data)
+		return err
+	}
+	_, err := s.w.Write(resp.Data)
+	return err
+}
+
+// fetchResp returns a FETCH response with the sequence number of the
+// session, false for messages it does not know.
+func (s *sharedSession) fetchResp(data []byte) ([]byte, bool) {
+	toks := imapTokens(data, 4)
+	if s.mailbox == "" || len(toks) < 4 || !toks[3].list {
+		return nil, false
+	}
+	uid, flags, hasFlags := fetchItems(toks[3].value)
+	i := s.index(uid)
+	if i < 0 {
+		return nil, false
+	}
+	if hasFlags {
+		s.flags[uid] = flags
+	}
+	return []byte(string(data[:toks[1].start]) + strconv.Itoa(i+1) + string(data[toks[1].end:])), true
+}
+
+// uidSet returns the UIDs of a sequence set of the session, false when it
+// is not a sequence set.
+func (s *sharedSession) uidSet(set string) (string, bool) {
+	seqs, err := imap.ParseSeqSet(set)
+	if err != nil {
+		return "", false
+	}
+
+	n := uint32(len(s.uids))
+	uids := new(imap.SeqSet)
+	for _, q := range seqs.Set {
+		start, stop := q.Start, q.Stop
+		if start == 0 {
+			start = n
+		}
+		if stop == 0 {
+			stop = n
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		for i := max(start, 1); i <= min(stop, n); i++ {
+			uids.AddNum(s.uids[i-1])
+		}
+	}
+	return uids.String(), true
+}
+
+// searchData returns a SEARCH as UID SEARCH, with the sequence sets of
+// keys as UID sets.
+func (s *sharedSession) searchData(cmd *ProxyCommand) ([]byte, bool) {
+	data := cmd.Data
+	toks := imapTokens(data, 2)
+	if len(toks) < 2 {
+		return nil, false
+	}
+
+	var b bytes.Buffer
+	b.Write(data[:toks[1].start])
+	b.WriteString("UID SEARCH")
+	if !s.searchKeys(&b, data[toks[1].end:]) {
+		return nil, false
+	}
+	return b.Bytes(), true
+}
+
+// searchKeys writes the search keys of data to b, parenthesized keys too,
+// with sequence sets as UID sets. Keys it can not read are not sent.
+func (s *sharedSession) searchKeys(b *bytes.Buffer, data []byte) bool {
+	toks := imapTokens(data, 1024)
+	last := 0
+	skip := 0
+	for _, tok := range toks {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if tok.list {
+			b.Write(data[last : tok.start+1])
+			if !s.searchKeys(b, data[tok.start+1:tok.end-1]) {
+				return false
+			}
+			last = tok.end - 1
+			continue
+		}
+		if n, ok := searchKeyArgs[strings.ToUpper(tok.value)]; ok {
+			skip = n
+			continue
+		}
+		if !seqSetRe.MatchString(tok.value) {
+			continue
+		}
+		set, ok := s.uidSet(tok.value)
+		if !ok {
+			return false
+		}
+		if set == "" {
+			// no message, a UID that can not be
+			set = "4294967295"
+		}
+		b.Write(data[last:tok.start])
+		b.WriteString("UID " + set)
+		last = tok.end
+	}
+	// tokens stop at what they can not read
+	end := 0
+	if len(toks) > 0 {
+		end = toks[len(toks)-1].end
+	}
+	if len(bytes.TrimSpace(data[end:])) > 0 {
+		return false
+	}
+	b.Write(data[last:])
+	return true
+}
+
+// searchResp returns the UIDs of a SEARCH response as session sequence
+// numbers.
+func (s *sharedSession) searchResp(data []byte) []byte {
+	b := []byte("* SEARCH")
+	for _, f := range strings.Fields(string(data))[2:] {
+		uid, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			continue
+		}
+		if i := s.index(uint32(uid)); i >= 0 {
+			b = append(b, ' ')
+			b = strconv.AppendInt(b, int64(i+1), 10)
+		}
+	}
+	return append(b, '\r', '\n')
+}
+
+// selected runs a command of the selected state, sequence numbers are sent
+// as UIDs.
+func (s *sharedSession) selected(cmd *ProxyCommand) error {
+	data := cmd.Data
+	onData := s.untagged
+
+	switch cmd.Name {
+	case "SEARCH":
+		var ok bool
+		if data, ok = s.searchData(cmd); !ok {
+			return s.status(cmd.Tag, "BAD", "Invalid sequence set")
+		}
+		onData = func(resp *ProxyResponse) error {
+			if resp.Name == "SEARCH" {
+				_, err := s.w.Write(s.searchResp(resp.Data))
+				return err
+			}
+			return s.untagged(resp)
+		}
+
+	case "FETCH", "STORE", "COPY", "MOVE":
+		toks := imapTokens(data, 3)
+		if len(toks) < 3 {
+			return s.status(cmd.Tag, "BAD", "Missing sequence set")
+		}
+		set, ok := s.uidSet(toks[2].value)
+		if !ok {
+			return s.status(cmd.Tag, "BAD", "Invalid sequence set")
+		}
+		if set == "" {
+			return s.status(cmd.Tag, "OK", cmd.Name+" completed")
+		}
+		data = []byte(cmd.Tag + " UID " + cmd.Name + " " + set + string(data[toks[2].end:]))
+	}
+
+	resp, err := s.run(data, true, onData, nil)
+	if err != nil {
+		return s.failed(cmd.Tag, err)
+	}
+
+	// messages went, the client is told now
+	switch strings.TrimPrefix(cmd.Name, "UID ") {
+	case "EXPUNGE", "MOVE":
+		if err := s.sync(time.Now()); err != nil {
+			return s.failed(cmd.Tag, err)
+		}
+	}
+
+	_, err = s.w.Write(retag(resp.Data, cmd.Tag))
+	return err
+}
+
+func (s *sharedSession) selectMailbox(cmd *ProxyCommand) error {
+	s.deselect()
+
+	toks := imapTokens(cmd.Data, 3)
+	if len(toks) < 3 {
+		return s.status(cmd.Tag, "BAD", "Missing mailbox")
+	}
+	mailbox := canonicalMailbox(toks[2].value)
+	readOnly := cmd.Name == "EXAMINE"
+
+	sc, err := s.a.borrow(s.cid, mailbox)
+	if err != nil {
+		return s.failed(cmd.Tag, err)
+	}
+	defer s.a.release(sc)
+
+	// a conn with mailbox selected tells what it was told
+	if sc.mailbox != mailbox || sc.readOnly != readOnly {
+		resp, err := sc.open(s.a, mailbox, readOnly)
+		if err != nil {
+			return s.failed(cmd.Tag, err)
+		}
+		if resp.Name != "OK" {
+			_, err := s.w.Write(retag(resp.Data, cmd.Tag))
+			return err
+		}
+	}
+	if err := sc.refresh(s.a); err != nil {
+		return s.failed(cmd.Tag, err)
+	}
+	s.mailbox, s.readOnly, s.validity = mailbox, readOnly, sc.validity
+	s.uids, s.flags = slices.Clone(sc.uids), maps.Clone(sc.flags)
+
+	next := uint32(1)
+	if len(s.uids) > 0 {
+		next = s.uids[len(s.uids)-1] + 1
+	}
+	for _, l := range sc.lines {
+		// messages may have come since the conn selected
+		if v, ok := respCode(l, "UIDNEXT"); ok {
+			if n, err := strconv.ParseUint(v, 10, 32); err == nil && uint32(n) < next {
+				fmt.Fprintf(s.w, "* OK [UIDNEXT %d] Predicted next UID\r\n", next)
+				continue
+			}
+		}
+		s.w.Write(l)
+	}
+	fmt.Fprintf(s.w, "* %d EXISTS\r\n* 0 RECENT\r\n", len(s.uids))
+	_, err = s.w.Write(retag(sc.selected, cmd.Tag))
+	return err
+}
+
+// sync brings the session view up to the mailbox, telling the client with
+// EXPUNGE, FETCH FLAGS and EXISTS. The conn is refreshed unless it was
+// after since, by another session told of the same change.
+func (s *sharedSession) sync(since time.Time) error {
+	sc, err := s.a.borrow(s.cid, s.mailbox)
+	if err != nil {
+		return err
+	}
+	defer s.a.release(sc)
+
+	if err := s.ensure(sc); err != nil {
+		return err
+	}
+	if !sc.tracked || !sc.refreshed.After(since) {
+		if err := sc.refresh(s.a); err != nil {
+			return err
+		}
+	}
+
+	// from the end, sequence numbers before stay the same
+	gone := false
+	for i := len(s.uids) - 1; i >= 0; i-- {
+		if _, ok := slices.BinarySearch(sc.uids, s.uids[i]); !ok {
+			fmt.Fprintf(s.w, "* %d EXPUNGE\r\n", i+1)
+			gone = true
+		}
+	}
+	if gone {
+		kept := s.uids[:0]
+		for _, uid := range s.uids {
+			if _, ok := slices.BinarySearch(sc.uids, uid); ok {
+				kept = append(kept, uid)
+			} else {
+				delete(s.flags, uid)
+			}
+		}
+		s.uids = kept
+	}
+	for i, uid := range s.uids {
+		if f := sc.flags[uid]; f != s.flags[uid] {
+			s.flags[uid] = f
+			fmt.Fprintf(s.w, "* %d FETCH (UID %d FLAGS (%s))\r\n", i+1, uid, f)
+		}
+	}
+
+	last := uint32(0)
+	if len(s.uids) > 0 {
+		last = s.uids[len(s.uids)-1]
+	}
+	n := len(s.uids)
+	for _, uid := range sc.uids[sort.Search(len(sc.uids), func(i int) bool { return sc.uids[i] > last }):] {
+		s.uids = append(s.uids, uid)
+		s.flags[uid] = sc.flags[uid]
+	}
+	if len(s.uids) > n {
+		fmt.Fprintf(s.w, "* %d EXISTS\r\n", len(s.uids))
+	}
+	return nil
+}
+
+// idle waits for DONE, the client is told of changes the watch of the
+// mailbox sees.
+func (s *sharedSession) idle(cmd *ProxyCommand) error {
+	var notify chan struct{}
+	var changed func() time.Time
+	if s.mailbox != "" {
+		var stop func()
+		notify, changed, stop = s.a.watch(s.mailbox)
+		defer stop()
+	}
+
+	s.w.WriteString("+ idling\r\n")
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		line, err := s.r.ReadBytes('\n')
+		if err == nil && !strings.EqualFold(strings.TrimSpace(string(line)), "DONE") {
+			err = errors.New("expected DONE")
+		}
+		done <- err
+	}()
+
+	if s.mailbox != "" {
+		// changes since the last command
+		if err := s.sync(time.Now()); err != nil {
+			return s.failed(cmd.Tag, err)
+		}
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-notify:
+			if err := s.sync(changed()); err != nil {
+				if errors.Is(err, errShareMailbox) {
+					return s.failed(cmd.Tag, err)
+				}
+				s.a.mp.log.Printf("conn(%d) shared upstream: %s\n", s.cid, err)
+			}
+			if err := s.w.Flush(); err != nil {
+				return err
+			}
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			return s.status(cmd.Tag, "OK", "IDLE terminated")
+		}
+	}
+}
+
+// A sharedWatch holds a conn in IDLE on a mailbox for the sessions in IDLE
+// on it, each change wakes them up.
+type sharedWatch struct {
+	a       *sharedAccount
+	mailbox string
+
+	// guarded by a.mu
+	subs  map[chan struct{}]bool
+	empty time.Time
+	// of the last change
+	changed time.Time
+}
+
+// watch returns a channel told of changes to mailbox, a func returning
+// when the last one was, and the func to stop it.
+func (a *sharedAccount) watch(mailbox string) (chan struct{}, func() time.Time, func()) {
+	ch := make(chan struct{}, 1)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	w := a.watches[mailbox]
+	if w == nil {
+		w = &sharedWatch{a: a, mailbox: mailbox, subs: map[chan struct{}]bool{}}
+		a.watches[mailbox] = w
+		go w.run()
+	}
+	w.subs[ch] = true
+
+	changed := func() time.Time {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return w.changed
+	}
+	return ch, changed, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		delete(w.subs, ch)
+		if len(w.subs) == 0 {
+			w.empty = time.Now()
+		}
+	}
+}
+
+func (w *sharedWatch) notify() {
+	w.a.mu.Lock()
+	defer w.a.mu.Unlock()
+
+	w.changed = time.Now()
+	for ch := range w.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// done reports whether the watch had no session for shareWatchLinger, it
+// is then removed.
+func (w *sharedWatch) done() bool {
+	a := w.a
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.closed && (len(w.subs) > 0 || time.Since(w.empty) < shareWatchLinger) {
+		return false
+	}
+	if a.watches[w.mailbox] == w {
+		delete(a.watches, w.mailbox)
+	}
+	return true
+}
+
+func (w *sharedWatch) run() {
+	for !w.done() {
+		err := w.watch()
+		if err == nil {
+			continue
+		}
+		w.a.mp.log.Printf("shared watch %s fail: %s\n", w.mailbox, err)
+		// sessions look for themselves, the watch is back after a pause
+		w.notify()
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.a.done:
+		}
+	}
+}
+
+// watch examines the mailbox on a conn of its own, and waits in IDLE, or
+// polls with NOOP, until the watch is done.
+func (w *sharedWatch) watch() error {
+	sc, err := w.a.dial(0)
+	if err != nil {
+		return err
+	}
+	defer sc.uc.c.Close()
+
+	changed := func(resp *ProxyResponse) error {
+		switch resp.Name {
+		case "EXISTS", "EXPUNGE", "VANISHED", "FETCH":
+			w.notify()
+		}
+		return nil
+	}
+
+	resp, err := sc.run([]byte("x EXAMINE "+imapQuote(w.mailbox)+"\r\n"), nil)
+	if err != nil {
+		return err
+	}
+	if resp.Name != "OK" {
+		return fmt.Errorf("examine fail: %s", bytes.TrimSpace(resp.Data))
+	}
+
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+
+	if !sc.caps["IDLE"] {
+		last := time.Now()
+		for !w.done() {
+			select {
+			case <-tick.C:
+			case <-w.a.done:
+				return nil
+			}
+			if time.Since(last) < shareWatchPoll {
+				continue
+			}
+			last = time.Now()
+			if _, err := sc.run([]byte("x NOOP\r\n"), changed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	resps := make(chan *ProxyResponse)
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			resp, err := sc.readResponse()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case resps <- resp:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	// wait reads up to the response tag, passing changes on
+	wait := func(tag string) error {
+		for {
+			select {
+			case resp := <-resps:
+				if resp.Tag == tag {
+					return nil
+				}
+				if resp.Name == "BYE" {
+					return errors.New("upstream said bye")
+				}
+				changed(resp)
+			case err := <-errs:
+				return err
+			}
+		}
+	}
+	w_ := sc.uc.w
+
+	for {
+		sc.tag++
+		tag := "w" + strconv.Itoa(sc.tag)
+		fmt.Fprintf(w_, "%s IDLE\r\n", tag)
+		if err := w_.Flush(); err != nil {
+			return err
+		}
+		if err := wait("+"); err != nil {
+			return err
+		}
+		started := time.Now()
+
+	idle:
+		for {
+			select {
+			case resp := <-resps:
+				if resp.Name == "BYE" || resp.Tag == tag {
+					return errors.New("upstream ended IDLE")
+				}
+				changed(resp)
+			case err := <-errs:
+				return err
+			case <-w.a.done:
+				return nil
+			case <-tick.C:
+				if w.done() || time.Since(started) > shareIdleRestart {
+					break idle
+				}
+			}
+		}
+
+		w_.Write([]byte("DONE\r\n"))
+		if err := w_.Flush(); err != nil {
+			return err
+		}
+		if err := wait(tag); err != nil {
+			return err
+		}
+		if w.done() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+)
+
+func Test_mailpShare(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  users:
+    abc:
+      password: "pw"
+      upstream:
+        addr: 127.0.0.1:1233
+        share:
+          enabled: true
+          conns: 1
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+	upConf := conf.Imap.Users["abc"].Upstream
+	A.True(upConf.shared())
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	login := func() *client.Client {
+		c, err := client.Dial("127.0.0.1:1234")
+		A.NoError(err, "client.Dial")
+		A.NoError(c.Login("abc", "pw"), "login")
+		return c
+	}
+	c1 := login()
+	defer c1.Terminate()
+	c2 := login()
+	defer c2.Terminate()
+
+	mbox, err := c1.Select("INBOX", false)
+	A.NoError(err, "select c1")
+	n := mbox.Messages
+	A.NotZero(n)
+	mbox, err = c2.Select("INBOX", false)
+	A.NoError(err, "select c2")
+	A.Equal(n, mbox.Messages)
+
+	// the client does not count EXPUNGE, FETCH 1:* does
+	count := func(c *client.Client) int {
+		seqs, _ := imap.ParseSeqSet("1:*")
+		ch := make(chan *imap.Message, 10)
+		A.NoError(c.Fetch(seqs, []imap.FetchItem{imap.FetchUid}, ch), "fetch 1:*")
+		n := 0
+		for m := range ch {
+			A.EqualValues(n+1, m.SeqNum)
+			n++
+		}
+		return n
+	}
+
+	msg := func(subject string) imap.Literal {
+		return imap.Literal(strings.NewReader("Subject: " + subject + "\r\n\r\nhi\r\n"))
+	}
+	A.NoError(c1.Append("INBOX", nil, time.Now(), msg("one")), "append")
+	A.NoError(c1.Append("INBOX", nil, time.Now(), msg("two")), "append")
+	A.NoError(c2.Noop(), "noop c2")
+	A.Equal(n+2, c2.Mailbox().Messages, "c2 sees new messages")
+
+	// sequence numbers are of the session
+	seqs := new(imap.SeqSet)
+	seqs.AddNum(n + 1)
+	A.NoError(c1.Noop(), "noop c1")
+	A.NoError(c1.Store(seqs, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil), "store")
+	A.NoError(c1.Expunge(nil), "expunge")
+	A.Equal(int(n+1), count(c1))
+	A.NoError(c2.Noop(), "noop c2")
+	A.Equal(int(n+1), count(c2), "c2 sees the expunge")
+
+	ch := make(chan *imap.Message, 1)
+	seqs = new(imap.SeqSet)
+	seqs.AddNum(n + 1)
+	A.NoError(c2.Fetch(seqs, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, ch), "fetch")
+	m := <-ch
+	A.Equal("two", m.Envelope.Subject)
+	A.EqualValues(n+1, m.SeqNum)
+
+	ids, err := c2.Search(&imap.SearchCriteria{SeqNum: seqs})
+	A.NoError(err, "search")
+	A.Equal([]uint32{n + 1}, ids)
+
+	// several expunges at once, the view follows without a full fetch
+	A.NoError(c1.Append("INBOX", nil, time.Now(), msg("four")), "append")
+	A.NoError(c1.Append("INBOX", nil, time.Now(), msg("five")), "append")
+	A.NoError(c1.Noop(), "noop c1")
+	A.NoError(c2.Noop(), "noop c2")
+	A.Equal(int(n+3), count(c2))
+	seqs = new(imap.SeqSet)
+	seqs.AddRange(n+1, n+2)
+	A.NoError(c1.Store(seqs, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil), "store")
+	seqs = new(imap.SeqSet)
+	seqs.AddNum(n + 3)
+	A.NoError(c1.Store(seqs, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.FlaggedFlag}, nil), "store")
+	A.NoError(c1.Expunge(nil), "expunge")
+	A.NoError(c2.Noop(), "noop c2")
+	A.Equal(int(n+1), count(c2), "c2 sees both expunges")
+
+	ch = make(chan *imap.Message, 1)
+	seqs = new(imap.SeqSet)
+	seqs.AddNum(n + 1)
+	A.NoError(c2.Fetch(seqs, []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags}, ch), "fetch")
+	m = <-ch
+	A.Equal("five", m.Envelope.Subject)
+	A.Contains(m.Flags, imap.FlaggedFlag)
+
+	a := mp.getShare(&upConf)
+	a.mu.Lock()
+	idle := slices.Clone(a.idle)
+	a.mu.Unlock()
+	A.NotEmpty(idle)
+	for _, sc := range idle {
+		A.True(sc.tracked, "view kept")
+		A.Len(sc.uids, int(n+1))
+	}
+	a.mu.Lock()
+	A.LessOrEqual(a.open, 1, "one conn for both sessions")
+	a.mu.Unlock()
+
+	// IDLE, the memory backend tells nothing, the watch is woken up here
+	updates := make(chan client.Update, 10)
+	c2.Updates = updates
+	stop := make(chan struct{})
+	idleDone := make(chan error, 1)
+	go func() {
+		idleDone <- c2.Idle(stop, &client.IdleOptions{LogoutTimeout: -1})
+	}()
+
+	var w *sharedWatch
+	A.Eventually(func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		w = a.watches["INBOX"]
+		return w != nil && len(w.subs) == 1
+	}, time.Second, 10*time.Millisecond, "watching")
+
+	A.NoError(c1.Append("INBOX", nil, time.Now(), msg("three")), "append")
+	w.notify()
+
+	timeout := time.After(2 * time.Second)
+	for seen := false; !seen; {
+		select {
+		case u := <-updates:
+			if mu, ok := u.(*client.MailboxUpdate); ok && mu.Mailbox.Messages == n+2 {
+				seen = true
+			}
+		case <-timeout:
+			A.Fail("no update in IDLE")
+			seen = true
+		}
+	}
+	close(stop)
+	A.NoError(<-idleDone, "idle")
+
+	A.NoError(mp.Reload(conf), "reload")
+	A.NotSame(a, mp.getShare(&upConf), "accounts restart on reload")
+	a.mu.Lock()
+	A.True(a.closed, "old account closed")
+	A.Empty(a.idle, "idle conns closed")
+	a.mu.Unlock()
+
+	upConf.Auth.Type = "passthrough"
+	A.False(upConf.shared(), "no credentials to share")
+}
+
+func Test_sharedSessionSearchData(t *testing.T) {
+	A := Assert.New(t)
+
+	s := &sharedSession{uids: []uint32{10, 20, 30}}
+	for data, want := range map[string]string{
+		"a SEARCH 2:*\r\n":                      "a UID SEARCH UID 20,30\r\n",
+		"a SEARCH OR 1 (3 SEEN)\r\n":            "a UID SEARCH OR UID 10 (UID 30 SEEN)\r\n",
+		"a SEARCH NOT (OR (1) (UID 1))\r\n":     "a UID SEARCH NOT (OR (UID 10) (UID 1))\r\n",
+		"a SEARCH (SUBJECT 1 LARGER 2) 9\r\n":   "a UID SEARCH (SUBJECT 1 LARGER 2) UID 4294967295\r\n",
+		"a SEARCH SUBJECT {1}\r\n2 NOT (3)\r\n": "a UID SEARCH SUBJECT {1}\r\n2 NOT (UID 30)\r\n",
+	} {
+		got, ok := s.searchData(parseProxyCommand([]byte(data)))
+		A.True(ok, data)
+		A.Equal(want, string(got), data)
+	}
+
+	for _, data := range []string{
+		"a SEARCH NOT (1::2)\r\n",
+		"a SEARCH (SUBJECT {5}\r\nab)\r\n",
+	} {
+		_, ok := s.searchData(parseProxyCommand([]byte(data)))
+		A.False(ok, data)
+	}
+}
+
+func Test_sharedAccountBorrowWait(t *testing.T) {
+	A := Assert.New(t)
+
+	a := &sharedAccount{size: 1, open: 1, wait: 50 * time.Millisecond}
+	a.cond = sync.NewCond(&a.mu)
+
+	start := time.Now()
+	_, err := a.borrow(1, "INBOX")
+	A.ErrorIs(err, errShareBusy)
+	A.GreaterOrEqual(time.Since(start), a.wait)
+
+	// a conn released in time is taken
+	sc := &sharedConn{used: time.Now()}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.release(sc)
+	}()
+	got, err := a.borrow(1, "INBOX")
+	A.NoError(err)
+	A.Same(sc, got)
+}
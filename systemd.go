@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemd socket activation and sd_notify, see sd_listen_fds(3) and sd_notify(3)
+
+// SD_LISTEN_FDS_START, var for tests
+var sdListenFdsStart = 3
+
+// sdListeners returns the sockets passed by systemd, keyed by LISTEN_FDNAMES
+// entry. Unnamed sockets are named "unknown" like systemd does.
+func sdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	ls := map[string][]net.Listener{}
+	for i := 0; i < nfds; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ll := range ls {
+				for _, l := range ll {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("systemd fd %d (%s): %w", fd, name, err)
+		}
+
+		ls[name] = append(ls[name], l)
+	}
+
+	return ls, nil
+}
+
+// sdNotify sends state to NOTIFY_SOCKET, it is a no-op when not run by systemd.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// abstract socket
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte(state))
+	return err
+}
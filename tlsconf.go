@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTlsVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("bad tls version %s", s)
+	}
+	return v, nil
+}
+
+// loadCertPool reads PEM certificates from file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// tlsClientConfig builds the config to connect upstream addr.
+func tlsClientConfig(conf *TlsClientConf, addr string) (*tls.Config, error) {
+	serverName := conf.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: conf.SkipVerify,
+	}
+
+	var err error
+	if tlsConfig.MinVersion, err = parseTlsVersion(conf.MinVersion); err != nil {
+		return nil, err
+	}
+
+	if conf.CaFile != "" {
+		if tlsConfig.RootCAs, err = loadCertPool(conf.CaFile); err != nil {
+			return nil, fmt.Errorf("load tls.caFile fail: %w", err)
+		}
+	}
+
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls.certFile fail: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(conf.PinSha256) > 0 || len(conf.Fingerprints) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(conf, &cs)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPins checks the leaf fingerprint against conf.Fingerprints, and
+// SPKIs against conf.PinSha256: the ones of the verified chains, or only the
+// leaf with skipVerify, the rest of the sent chain proves nothing. Either
+// matching is enough.
+func verifyPins(conf *TlsClientConf, cs *tls.ConnectionState) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("tls pin: no peer certificate")
+	}
+
+	fp := sha256.Sum256(certs[0].Raw)
+	for _, want := range conf.Fingerprints {
+		want = strings.ToLower(strings.ReplaceAll(want, ":", ""))
+		if want == hex.EncodeToString(fp[:]) {
+			return nil
+		}
+	}
+
+	chain := certs[:1]
+	if !conf.SkipVerify {
+		chain = nil
+		for _, verified := range cs.VerifiedChains {
+			chain = append(chain, verified...)
+		}
+	}
+	for _, cert := range chain {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, want := range conf.PinSha256 {
+			if want == base64.StdEncoding.EncodeToString(spki[:]) {
+				return nil
+			}
+		}
+	}
+
+	spki := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	return fmt.Errorf("tls pin mismatch, leaf fingerprint %s, spki pinSha256 %s",
+		hex.EncodeToString(fp[:]), base64.StdEncoding.EncodeToString(spki[:]))
+}
+
+// certReloadInterval is how often certStore checks cert files for changes.
+var certReloadInterval = 5 * time.Second
+
+// A certStore serves the certificates of a listener by SNI, reloading them
+// when their files change.
+type certStore struct {
+	log *log.Logger
+
+	mu        sync.Mutex
+	certs     []*storedCert
+	lastCheck time.Time
+}
+
+type storedCert struct {
+	conf    TlsCertConf
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+func newCertStore(confs []TlsCertConf, logger *log.Logger) (*certStore, error) {
+	st := &certStore{log: logger, lastCheck: time.Now()}
+	for _, conf := range confs {
+		sc := &storedCert{conf: conf}
+		if err := sc.load(); err != nil {
+			return nil, fmt.Errorf("load tls cert %s fail: %w", conf.Cert, err)
+		}
+		st.certs = append(st.certs, sc)
+	}
+	if len(st.certs) == 0 {
+		return nil, errors.New("no tls cert")
+	}
+	return st, nil
+}
+
+func (sc *storedCert) modified() (time.Time, error) {
+	var t time.Time
+	for _, file := range []string{sc.conf.Cert, sc.conf.Key} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (sc *storedCert) load() error {
+	modTime, err := sc.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(sc.conf.Cert, sc.conf.Key)
+	if err != nil {
+		return err
+	}
+	sc.cert = &cert
+	sc.modTime = modTime
+	return nil
+}
+
+// reload reloads changed certs at most once per certReloadInterval, a cert
+// that fails to load is kept as it was.
+func (st *certStore) reload() {
+	if time.Since(st.lastCheck) < certReloadInterval {
+		return
+	}
+	st.lastCheck = time.Now()
+
+	for _, sc := range st.certs {
+		modTime, err := sc.modified()
+		if err != nil || modTime.Equal(sc.modTime) {
+			continue
+		}
+		if err := sc.load(); err != nil {
+			st.log.Printf("reload tls cert %s fail: %s\n", sc.conf.Cert, err)
+			continue
+		}
+		st.log.Printf("reload tls cert %s\n", sc.conf.Cert)
+	}
+}
+
+// GetCertificate returns the first cert valid for the SNI name, or the first
+// cert.
+func (st *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.reload()
+
+	if hello.ServerName != "" {
+		for _, sc := range st.certs {
+			if sc.cert.Leaf != nil && sc.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return sc.cert, nil
+			}
+		}
+	}
+	return st.certs[0].cert, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	all := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		all[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		all[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := all[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tlsServerConfig builds the config of a listener.
+func tlsServerConfig(conf *TlsServerConf, logger *log.Logger) (*tls.Config, error) {
+	certs := conf.Certs
+	if conf.Cert != "" {
+		certs = append([]TlsCertConf{{Cert: conf.Cert, Key: conf.Key}}, certs...)
+	}
+	st, err := newCertStore(certs, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: st.GetCertificate,
+	}
+
+	if tlsConfig.MinVersion, err = parseTlsVersion(conf.MinVersion); err != nil {
+		return nil, err
+	}
+	if len(conf.CipherSuites) > 0 {
+		if tlsConfig.CipherSuites, err = parseCipherSuites(conf.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.ClientCA != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(conf.ClientCA); err != nil {
+			return nil, fmt.Errorf("load tls.clientCA fail: %w", err)
+		}
+	}
+	switch conf.ClientAuth {
+	case "":
+	case "request":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("bad tls.clientAuth %s", conf.ClientAuth)
+	}
+	if tlsConfig.ClientAuth != tls.NoClientCert && tlsConfig.ClientCAs == nil {
+		return nil, errors.New("tls.clientAuth needs tls.clientCA")
+	}
+
+	return tlsConfig, nil
+}
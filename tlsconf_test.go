@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	Assert "github.com/stretchr/testify/require"
+)
+
+// testPKI is a CA in a temp dir, issuing certs for tests.
+type testPKI struct {
+	dir    string
+	caFile string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func testNewPKI(t *testing.T) *testPKI {
+	A := Assert.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	A.NoError(err, "ca key")
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mailp test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	A.NoError(err, "ca cert")
+	ca, err := x509.ParseCertificate(der)
+	A.NoError(err, "parse ca")
+
+	p := &testPKI{dir: t.TempDir(), ca: ca, caKey: key, serial: 1}
+	p.caFile = filepath.Join(p.dir, "ca.cert")
+	A.NoError(os.WriteFile(p.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return p
+}
+
+// issue writes a cert and key signed by the CA, for server names when client
+// is false.
+func (p *testPKI) issue(t *testing.T, cn string, names []string, client bool) (certFile, keyFile string) {
+	A := Assert.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	A.NoError(err, "key")
+
+	p.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	A.NoError(err, "cert")
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	A.NoError(err, "marshal key")
+
+	certFile = filepath.Join(p.dir, cn+".cert")
+	keyFile = filepath.Join(p.dir, cn+".key")
+	A.NoError(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	A.NoError(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+
+	return certFile, keyFile
+}
+
+func (p *testPKI) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+	return pool
+}
+
+func Test_mailpUpstreamTlsVerify(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	pki := testNewPKI(t)
+	serverCert, serverKey := pki.issue(t, "mailp-test.local", []string{"mailp-test.local"}, false)
+	clientCert, clientKey := pki.issue(t, "mailp-client", nil, true)
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	A.NoError(err, "load cert")
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool(),
+	})
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	caSpki := sha256.Sum256(pki.ca.RawSubjectPublicKeyInfo)
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  connLog: on
+  users:
+    abc:
+      password: 123
+      upstream:
+        addr: 127.0.0.1:1233
+        tls:
+          enabled: true
+          caFile: ` + pki.caFile + `
+          serverName: mailp-test.local
+          minVersion: "1.2"
+          pinSha256: ["` + base64.StdEncoding.EncodeToString(caSpki[:]) + `"]
+          certFile: ` + clientCert + `
+          keyFile: ` + clientKey + `
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	testMailpBasic(t, "127.0.0.1:1234", true)
+
+	upConf := conf.Imap.Users["abc"].Upstream
+
+	t.Run("wrong pin", func(t *testing.T) {
+		c := upConf
+		c.Tls.PinSha256 = []string{"AAAA"}
+		_, err := mp.dialUpstream(0, "127.0.0.1:1233", &c, nil)
+		Assert.ErrorContains(t, err, "tls pin mismatch")
+	})
+
+	t.Run("unknown ca", func(t *testing.T) {
+		c := upConf
+		c.Tls.CaFile = ""
+		c.Tls.PinSha256 = nil
+		_, err := mp.dialUpstream(0, "127.0.0.1:1233", &c, nil)
+		Assert.ErrorContains(t, err, "tls verify mailp-test.local fail")
+	})
+
+	t.Run("no client cert", func(t *testing.T) {
+		c := upConf
+		c.Tls.CertFile = ""
+		_, err := mp.dialUpstream(0, "127.0.0.1:1233", &c, nil)
+		Assert.Error(t, err)
+	})
+}
+
+func Test_verifyPins(t *testing.T) {
+	A := Assert.New(t)
+
+	pki := testNewPKI(t)
+	caSpki := sha256.Sum256(pki.ca.RawSubjectPublicKeyInfo)
+	caPin := base64.StdEncoding.EncodeToString(caSpki[:])
+
+	// a self-signed leaf sent along with the pinned CA
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	A.NoError(err, "key")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "mailp-test.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	A.NoError(err, "cert")
+	forged, err := x509.ParseCertificate(der)
+	A.NoError(err, "parse")
+	cs := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{forged, pki.ca}}
+
+	A.ErrorContains(verifyPins(&TlsClientConf{SkipVerify: true, PinSha256: []string{caPin}}, cs), "tls pin mismatch")
+	A.ErrorContains(verifyPins(&TlsClientConf{PinSha256: []string{caPin}}, cs), "tls pin mismatch")
+
+	leafSpki := sha256.Sum256(forged.RawSubjectPublicKeyInfo)
+	leafPin := base64.StdEncoding.EncodeToString(leafSpki[:])
+	A.NoError(verifyPins(&TlsClientConf{SkipVerify: true, PinSha256: []string{leafPin}}, cs), "leaf pinned")
+
+	cs.VerifiedChains = [][]*x509.Certificate{{forged, pki.ca}}
+	A.NoError(verifyPins(&TlsClientConf{PinSha256: []string{caPin}}, cs), "verified chain")
+}
+
+func Test_mailpTlsServer(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	defer func(d time.Duration) { certReloadInterval = d }(certReloadInterval)
+	certReloadInterval = 0
+
+	pki := testNewPKI(t)
+	aCert, aKey := pki.issue(t, "imap.team-a.example", []string{"imap.team-a.example"}, false)
+	bCert, bKey := pki.issue(t, "imap.team-b.example", []string{"imap.team-b.example"}, false)
+	clientCert, clientKey := pki.issue(t, "mailp-client", nil, true)
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  listeners:
+    - addr: ":1234"
+      tls:
+        enabled: true
+        certs:
+          - cert: ` + aCert + `
+            key: ` + aKey + `
+          - cert: ` + bCert + `
+            key: ` + bKey + `
+        minVersion: "1.2"
+        cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]
+        clientCA: ` + pki.caFile + `
+        clientAuth: require
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	A.NoError(err, "load client cert")
+
+	dial := func(tlsConfig *tls.Config) (*tls.Conn, error) {
+		tlsConfig.RootCAs = pki.pool()
+		c, err := tls.Dial("tcp", "127.0.0.1:1234", tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		// client cert errors show up on read with tls 1.3
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := c.Read(make([]byte, 1)); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	for _, name := range []string{"imap.team-a.example", "imap.team-b.example"} {
+		c, err := dial(&tls.Config{ServerName: name, Certificates: []tls.Certificate{cert}})
+		A.NoError(err, "dial %s", name)
+		A.Equal(name, c.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		c.Close()
+	}
+
+	_, err = dial(&tls.Config{ServerName: "imap.team-a.example"})
+	A.Error(err, "client cert required")
+
+	_, err = dial(&tls.Config{ServerName: "imap.team-a.example", Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS11})
+	A.Error(err, "min version")
+
+	c, err := dial(&tls.Config{ServerName: "imap.team-a.example", Certificates: []tls.Certificate{cert}})
+	A.NoError(err, "dial")
+	serial := c.ConnectionState().PeerCertificates[0].SerialNumber
+	c.Close()
+
+	pki.issue(t, "imap.team-a.example", []string{"imap.team-a.example"}, false)
+
+	c, err = dial(&tls.Config{ServerName: "imap.team-a.example", Certificates: []tls.Certificate{cert}})
+	A.NoError(err, "dial after reload")
+	A.NotEqual(serial, c.ConnectionState().PeerCertificates[0].SerialNumber, "cert reloaded")
+	c.Close()
+}
+
+func Test_mailpClientCertAuth(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	pki := testNewPKI(t)
+	serverCert, serverKey := pki.issue(t, "mailp-test.local", []string{"mailp-test.local"}, false)
+	aliceCert, aliceKey := pki.issue(t, "alice-device", nil, true)
+	otherCert, otherKey := pki.issue(t, "other-device", nil, true)
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  listeners:
+    - addr: ":1234"
+      tls:
+        enabled: true
+        cert: ` + serverCert + `
+        key: ` + serverKey + `
+        clientCA: ` + pki.caFile + `
+        clientAuth: request
+  connLog: on
+  users:
+    alice:
+      password: 123
+      certSubject: CN=alice-device
+      certLogin: true
+      upstream:
+        addr: 127.0.0.1:1233
+        auth:
+          type: plain
+          username: username
+          password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	dial := func(certFile, keyFile string) *client.Client {
+		tlsConfig := &tls.Config{ServerName: "mailp-test.local", RootCAs: pki.pool()}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			A.NoError(err, "load client cert")
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		c, err := client.DialTLS("127.0.0.1:1234", tlsConfig)
+		A.NoError(err, "dial")
+		return c
+	}
+
+	t.Run("external", func(t *testing.T) {
+		c := dial(aliceCert, aliceKey)
+		defer c.Terminate()
+
+		ok, err := c.SupportAuth(sasl.External)
+		Assert.NoError(t, err)
+		Assert.True(t, ok, "AUTH=EXTERNAL")
+
+		Assert.NoError(t, c.Authenticate(sasl.NewExternalClient("")), "external")
+		_, err = c.Select("INBOX", true)
+		Assert.NoError(t, err, "select upstream")
+	})
+
+	t.Run("cert login", func(t *testing.T) {
+		c := dial(aliceCert, aliceKey)
+		defer c.Terminate()
+
+		Assert.NoError(t, c.Login("alice", "any"), "login with cert")
+	})
+
+	t.Run("other cert", func(t *testing.T) {
+		c := dial(otherCert, otherKey)
+		defer c.Terminate()
+
+		Assert.Error(t, c.Authenticate(sasl.NewExternalClient("alice")), "external")
+		Assert.Error(t, c.Login("alice", "any"), "login")
+	})
+
+	t.Run("no cert", func(t *testing.T) {
+		c := dial("", "")
+		defer c.Terminate()
+
+		ok, err := c.SupportAuth(sasl.External)
+		Assert.NoError(t, err)
+		Assert.False(t, ok, "no AUTH=EXTERNAL")
+
+		Assert.Error(t, c.Login("alice", "any"), "login without cert")
+		Assert.NoError(t, c.Login("alice", "123"), "login with password")
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-sasl"
+)
+
+const (
+	defaultUpstreamMaxFails    = 1
+	defaultUpstreamFailTimeout = 10 * time.Second
+
+	// dial to greeting
+	upstreamHandshakeTimeout = 10 * time.Second
+)
+
+// An upstreamConn is a connected upstream that has sent its greeting.
+type upstreamConn struct {
+	addr string
+	c    net.Conn
+	r    *imap.Reader
+	w    *imap.Writer
+	tag  int
+
+	// under r and w, for COMPRESS; nil for conns not dialed
+	br *bufio.Reader
+	dc *deflateConn
+	// nil for conns not dialed
+	trace *upstreamTrace
+}
+
+// An upstreamTrace writes the bytes of a dialed conn to the trace of the
+// session it is bound to, when its doLog is on. A pooled conn is dialed for
+// no session and bound when taken.
+type upstreamTrace struct {
+	mp    *Mailp
+	cid   atomic.Int64
+	doLog atomic.Pointer[atomic.Bool]
+}
+
+func (t *upstreamTrace) bind(cid int64, doLog *atomic.Bool) {
+	t.cid.Store(cid)
+	t.doLog.Store(doLog)
+}
+
+// writer returns a writer of the bytes prefixed with ch.
+func (t *upstreamTrace) writer(ch string) io.Writer {
+	return &upstreamTraceWriter{t: t, ch: []byte(ch)}
+}
+
+type upstreamTraceWriter struct {
+	t  *upstreamTrace
+	ch []byte
+}
+
+func (w *upstreamTraceWriter) Write(p []byte) (int, error) {
+	doLog := w.t.doLog.Load()
+	if doLog == nil || !doLog.Load() {
+		return len(p), nil
+	}
+
+	// one write, a sink gets the prefix with the bytes
+	_, err := w.t.mp.traceWriter(w.t.cid.Load()).Write(append(w.ch[:len(w.ch):len(w.ch)], p...))
+	return len(p), err
+}
+
+// exec writes cmd with a new tag, and reads responses until the tagged one.
+// Untagged data responses go to onData, which may be nil.
+func (uc *upstreamConn) exec(cmd *imap.Command, onData func(*imap.DataResp) error) (*imap.StatusResp, error) {
+	uc.tag++
+	cmd.Tag = fmt.Sprintf("mailp.%d", uc.tag)
+
+	if err := cmd.WriteTo(uc.w); err != nil {
+		return nil, err
+	}
+	for {
+		ret, err := imap.ReadResp(uc.r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch vv := ret.(type) {
+		case *imap.DataResp:
+			if onData != nil {
+				if err := onData(vv); err != nil {
+					return nil, err
+				}
+			}
+		case *imap.StatusResp:
+			if vv.Tag == cmd.Tag {
+				return vv, nil
+			}
+			// untagged status, like * OK [ALERT]
+		default:
+			return nil, fmt.Errorf("unexpected continuation")
+		}
+	}
+}
+
+// logout sends LOGOUT and closes uc.
+func (uc *upstreamConn) logout() error {
+	defer uc.c.Close()
+
+	_, err := uc.exec(&imap.Command{Name: "LOGOUT"}, nil)
+	return err
+}
+
+// upstreamHealth tracks failures of upstream addrs, shared by all sessions.
+type upstreamHealth struct {
+	mu    sync.Mutex
+	addrs map[string]*upstreamState
+	// round-robin counters, keyed by joined addrs
+	rr map[string]int
+}
+
+type upstreamState struct {
+	fails     int
+	downUntil time.Time
+	lastErr   error
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{
+		addrs: map[string]*upstreamState{},
+		rr:    map[string]int{},
+	}
+}
+
+func (h *upstreamHealth) state(addr string) *upstreamState {
+	st, ok := h.addrs[addr]
+	if !ok {
+		st = &upstreamState{}
+		h.addrs[addr] = st
+	}
+	return st
+}
+
+// order returns the addrs of conf in the order they should be tried. Addrs
+// marked down go last, so they are still tried when nothing else is left.
+func (h *upstreamHealth) order(conf *ImapUpstreamConf) []string {
+	addrs := conf.addrs()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	up := make([]string, 0, len(addrs))
+	down := []string{}
+	for _, addr := range addrs {
+		if now.Before(h.state(addr).downUntil) {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+
+	switch conf.Strategy {
+	case "round-robin":
+		if len(up) > 1 {
+			key := strings.Join(addrs, ",")
+			n := h.rr[key] % len(up)
+			h.rr[key]++
+			up = append(up[n:], up[:n]...)
+		}
+	case "random":
+		rand.Shuffle(len(up), func(i, j int) { up[i], up[j] = up[j], up[i] })
+	}
+
+	return append(up, down...)
+}
+
+func (h *upstreamHealth) fail(addr string, conf *ImapUpstreamConf, err error) {
+	maxFails := conf.MaxFails
+	if maxFails <= 0 {
+		maxFails = defaultUpstreamMaxFails
+	}
+	failTimeout := conf.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = defaultUpstreamFailTimeout
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.state(addr)
+	st.fails++
+	st.lastErr = err
+	if st.fails >= maxFails {
+		st.downUntil = time.Now().Add(failTimeout)
+	}
+}
+
+func (h *upstreamHealth) ok(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.state(addr)
+	st.fails = 0
+	st.downUntil = time.Time{}
+	st.lastErr = nil
+}
+
+// connectUpstream connects to the first addr of conf that works.
+func (mp *Mailp) connectUpstream(cid int64, conf *ImapUpstreamConf, doLog *atomic.Bool) (*upstreamConn, error) {
+	var lastErr error
+	for _, addr := range mp.upstreams.order(conf) {
+		mp.log.Printf("conn(%d) connect upstream: %s", cid, addr)
+
+		uc, err := mp.dialUpstream(cid, addr, conf, doLog)
+		if err != nil {
+			mp.log.Printf("conn(%d) connect upstream: %s (fail: %s)", cid, addr, err)
+			mp.upstreams.fail(addr, conf, err)
+			lastErr = err
+			continue
+		}
+
+		mp.upstreams.ok(addr)
+		mp.log.Printf("conn(%d) connect upstream: %s (ok)", cid, addr)
+		return uc, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no upstream addr")
+	}
+	return nil, lastErr
+}
+
+// dialUpstream dials addr, does the TLS handshake and reads the greeting.
+// connLog traces go with cid.
+func (mp *Mailp) dialUpstream(cid int64, addr string, conf *ImapUpstreamConf, doLog *atomic.Bool) (*upstreamConn, error) {
+	return mp.dialUpstreamBy(time.Now().Add(upstreamHandshakeTimeout), cid, addr, conf, doLog)
+}
+
+// dialUpstreamBy is dialUpstream done by deadline.
+func (mp *Mailp) dialUpstreamBy(deadline time.Time, cid int64, addr string, conf *ImapUpstreamConf, doLog *atomic.Bool) (*upstreamConn, error) {
+	var tlsConfig *tls.Config
+	if conf.Tls.Enabled {
+		var err error
+		if tlsConfig, err = tlsClientConfig(&conf.Tls, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	via := conf.DialVia
+	if via == "" {
+		via = mp.getConf().Imap.DialVia
+	}
+
+	c2, err := mp.dial(addr, via, deadline)
+	if err != nil {
+		return nil, err
+	}
+	c2.SetDeadline(deadline)
+
+	var c3 net.Conn
+	if tlsConfig != nil {
+		tlsc := tls.Client(c2, tlsConfig)
+		if err := tlsc.Handshake(); err != nil {
+			c2.Close()
+
+			var verr *tls.CertificateVerificationError
+			if errors.As(err, &verr) {
+				return nil, fmt.Errorf("tls verify %s fail: %w", tlsConfig.ServerName, err)
+			}
+			return nil, fmt.Errorf("tls handshake fail: %w", err)
+		}
+		c3 = tlsc
+	} else {
+		c3 = c2
+	}
+
+	dc := newDeflateConn(c3)
+	trace := &upstreamTrace{mp: mp}
+	trace.bind(cid, doLog)
+	br := bufio.NewReader(io.TeeReader(dc, trace.writer("s> ")))
+	uc := &upstreamConn{
+		addr:  addr,
+		c:     c3,
+		r:     imap.NewReader(br),
+		w:     imap.NewWriter(bufio.NewWriter(io.MultiWriter(dc, trace.writer("s< ")))),
+		br:    br,
+		dc:    dc,
+		trace: trace,
+	}
+
+	if err := readGreeting(uc.r); err != nil {
+		c3.Close()
+		return nil, err
+	}
+
+	c2.SetDeadline(time.Time{})
+
+	return uc, nil
+}
+
+// readGreeting reads the untagged OK a server starts with.
+func readGreeting(r *imap.Reader) error {
+	ret, err := imap.ReadResp(r)
+	if err != nil {
+		return err
+	}
+
+	vv, ok := ret.(*imap.StatusResp)
+	if !ok {
+		return fmt.Errorf("want greet")
+	}
+	if !(vv.Tag == "*" && vv.Type == imap.StatusRespOk) {
+		return fmt.Errorf("bad greet")
+	}
+	return nil
+}
+
+// loginUpstream authenticates uc as described by auth.
+func (mp *Mailp) loginUpstream(cid int64, uc *upstreamConn, auth *ImapAuthConf) error {
+	username := auth.Username
+	password := auth.Password
+	mp.log.Printf("conn(%d) login upstream as %s", cid, username)
+
+	var cmd *imap.Command
+
+	switch auth.Type {
+	case "plain":
+		mech, ir, err := sasl.NewPlainClient(username, username, password).Start()
+		if err != nil {
+			return err
+		}
+		cmdr := &commands.Authenticate{
+			Mechanism:       mech,
+			InitialResponse: ir,
+		}
+		cmd = cmdr.Command()
+
+	case "xoauth2":
+		mech, ir, err := NewXoauth2Client(username, password).Start()
+		if err != nil {
+			return err
+		}
+		cmdr := &commands.Authenticate{
+			Mechanism:       mech,
+			InitialResponse: ir,
+		}
+		cmd = cmdr.Command()
+
+	default:
+		return fmt.Errorf("upstream auth support plain, got %s", auth.Type)
+	}
+
+	ret, err := uc.exec(cmd, func(vv *imap.DataResp) error {
+		mp.log.Printf("conn(%d) server auth ret: %+v\n", cid, vv)
+
+		name, fields, ok := imap.ParseNamedResp(vv)
+		if !ok || name != "CAPABILITY" {
+			return fmt.Errorf("auth bad data")
+		}
+		// TODO: use fields
+		_ = fields
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	mp.log.Printf("conn(%d) server auth ret: %+v\n", cid, ret)
+
+	if ret.Type != imap.StatusRespOk {
+		return &statusError{code: ret.Code, err: fmt.Errorf("auth fail: %s", ret.Info)}
+	}
+
+	return nil
+}
+
+// A statusError is an error with the response code to tell the client.
+type statusError struct {
+	code imap.StatusRespCode
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// noResp is the tagged NO for err.
+func noResp(tag string, err error) *imap.StatusResp {
+	resp := &imap.StatusResp{
+		Tag:  tag,
+		Type: imap.StatusRespNo,
+		Info: err.Error(),
+	}
+	var serr *statusError
+	if errors.As(err, &serr) {
+		resp.Code = serr.code
+	}
+	return resp
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var errBadPassword = errors.New("bad password")
+
+// A UserStore finds proxy users and their upstream config.
+type UserStore interface {
+	// LookupUser returns the user for login, and login without the upstream
+	// selector. It returns errNoSuchUser for logins it does not know.
+	LookupUser(login string) (user *ImapUserConf, name string, err error)
+	// VerifyPassword is LookupUser that also checks password, it returns
+	// errBadPassword when it does not match.
+	VerifyPassword(login, password string) (user *ImapUserConf, name string, err error)
+}
+
+// newUserStore returns the stores of conf, imap.users and imap.routes first.
+func newUserStore(conf *ImapConf, logger *log.Logger) (UserStore, error) {
+	stores := userStores{&confUserStore{conf}}
+
+	for i := range conf.UserStores {
+		sc := &conf.UserStores[i]
+
+		var st UserStore
+		switch sc.Type {
+		case "htpasswd":
+			st = newHtpasswdStore(sc, logger)
+		case "ldap":
+			st = newLdapStore(sc)
+		default:
+			return nil, fmt.Errorf("imap.userStores[%d]: unsupported type %s", i, sc.Type)
+		}
+
+		if sc.Match != "" {
+			st = &matchUserStore{match: sc.Match, UserStore: st}
+		}
+		stores = append(stores, st)
+	}
+
+	return stores, nil
+}
+
+// userStores asks each store in turn, the first one that knows a login
+// decides.
+type userStores []UserStore
+
+func (s userStores) LookupUser(login string) (*ImapUserConf, string, error) {
+	for _, st := range s {
+		user, name, err := st.LookupUser(login)
+		if err != errNoSuchUser {
+			return user, name, err
+		}
+	}
+	return nil, "", errNoSuchUser
+}
+
+func (s userStores) VerifyPassword(login, password string) (*ImapUserConf, string, error) {
+	for _, st := range s {
+		user, name, err := st.VerifyPassword(login, password)
+		if err != errNoSuchUser {
+			return user, name, err
+		}
+	}
+	return nil, "", errNoSuchUser
+}
+
+// confUserStore is imap.users and imap.routes.
+type confUserStore struct {
+	conf *ImapConf
+}
+
+func (s *confUserStore) LookupUser(login string) (*ImapUserConf, string, error) {
+	return s.conf.lookupUser(login)
+}
+
+func (s *confUserStore) VerifyPassword(login, password string) (*ImapUserConf, string, error) {
+	user, name, err := s.conf.lookupUser(login)
+	if err != nil {
+		return nil, "", err
+	}
+	// without a password of its own, the upstream checks a passthrough user
+	if user.Password == "" && user.Upstream.Auth.Type == "passthrough" {
+		return user, name, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil, "", errBadPassword
+	}
+	return user, name, nil
+}
+
+// matchUserStore limits a store to the logins matching a pattern.
+type matchUserStore struct {
+	match string
+	UserStore
+}
+
+func (s *matchUserStore) LookupUser(login string) (*ImapUserConf, string, error) {
+	if !matchLogin(s.match, login) {
+		return nil, "", errNoSuchUser
+	}
+	return s.UserStore.LookupUser(login)
+}
+
+func (s *matchUserStore) VerifyPassword(login, password string) (*ImapUserConf, string, error) {
+	if !matchLogin(s.match, login) {
+		return nil, "", errNoSuchUser
+	}
+	return s.UserStore.VerifyPassword(login, password)
+}
+
+// storeUser returns the user conf of a login found in an external store,
+// built from the store's user template.
+func storeUser(sc *UserStoreConf, login string) (*ImapUserConf, string, error) {
+	// selectors are not part of the names of external stores
+	name, selector := login, ""
+	if i := lastSelectorIndex(login); i > 0 && len(sc.User.Upstreams) > 0 {
+		if _, ok := sc.User.Upstreams[login[i+1:]]; ok {
+			name, selector = login[:i], login[i+1:]
+		}
+	}
+
+	user, err := sc.User.selectUpstream(selector)
+	if err != nil {
+		return nil, "", err
+	}
+	if user, err = user.forLogin(name); err != nil {
+		return nil, "", err
+	}
+	return user, name, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	Assert "github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_htpasswdMatch(t *testing.T) {
+	A := Assert.New(t)
+
+	bc, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	A.NoError(err, "bcrypt")
+
+	for _, hash := range []string{
+		string(bc),
+		"$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	} {
+		A.True(htpasswdMatch(hash, "password", false), hash)
+		A.False(htpasswdMatch(hash, "passwore", false), hash)
+		A.False(htpasswdMatch(hash, hash, true), hash)
+	}
+
+	// plain text only when asked for, as htpasswd -p writes it
+	A.True(htpasswdMatch("password", "password", true))
+	A.False(htpasswdMatch("password", "passwore", true))
+	A.False(htpasswdMatch("{PLAIN}password", "password", true), "no made up prefix")
+
+	// unsupported hashes never match, not even as plain text
+	for _, hash := range []string{
+		"password",
+		"{PLAIN}password",
+		"$5$salt$hash",
+		"$6$salt$hash",
+		"abJnggxhB/yWI",
+		"{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	} {
+		A.False(htpasswdSupported(hash, false), hash)
+		A.False(htpasswdMatch(hash, hash, false), hash)
+	}
+}
+
+func Test_mailpHtpasswd(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	A.NoError(os.WriteFile(file, []byte("# users\nalice:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1\n"), 0600))
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  userStores:
+    - type: htpasswd
+      file: ` + file + `
+      user:
+        upstream:
+          addr: 127.0.0.1:1233
+          auth:
+            type: plain
+            username: username
+            password: password
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	login := func(username, password string) error {
+		c, err := client.Dial("127.0.0.1:1234")
+		A.NoError(err, "client.Dial")
+		defer c.Terminate()
+		return c.Login(username, password)
+	}
+
+	A.NoError(login("alice", "password"), "alice")
+	A.Error(login("alice", "bad"), "alice bad password")
+	A.Error(login("bob", "password"), "no bob yet")
+
+	A.NoError(os.WriteFile(file, []byte("alice:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600))
+	A.NoError(login("bob", "password"), "bob after re-read")
+}
+
+// testStartLdap serves simple binds and base searches, passwords maps DNs
+// to passwords. binds counts the binds with a password.
+func testStartLdap(t *testing.T, addr string, passwords map[string]string) (net.Listener, *atomic.Int32) {
+	l, err := net.Listen("tcp", addr)
+	Assert.NoError(t, err, "ldap listen")
+
+	binds := &atomic.Int32{}
+	result := func(id []byte, tag byte, code byte) []byte {
+		return berTLV(0x30,
+			berTLV(0x02, id),
+			berTLV(tag,
+				berTLV(0x0a, []byte{code}),
+				berTLV(0x04),
+				berTLV(0x04),
+			),
+		)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+
+				r := bufio.NewReader(c)
+				for {
+					_, msg, err := readBER(r)
+					if err != nil {
+						return
+					}
+					fields, err := parseBERSeq(msg)
+					if err != nil || len(fields) < 2 {
+						return
+					}
+					id := fields[0].value
+					req, _ := parseBERSeq(fields[1].value)
+
+					switch fields[1].tag {
+					case 0x60:
+						if len(req) < 3 {
+							return
+						}
+						code := byte(49)
+						dn, password := string(req[1].value), string(req[2].value)
+						if password != "" {
+							binds.Add(1)
+						}
+						if want, ok := passwords[dn]; ok && want == password {
+							code = 0
+						}
+						if dn == "" && password == "" {
+							code = 0
+						}
+						c.Write(result(id, 0x61, code))
+					case 0x63:
+						if len(req) < 1 {
+							return
+						}
+						dn := string(req[0].value)
+						if _, ok := passwords[dn]; !ok {
+							c.Write(result(id, 0x65, 32))
+							continue
+						}
+						c.Write(berTLV(0x30,
+							berTLV(0x02, id),
+							berTLV(0x64, berTLV(0x04, []byte(dn)), berTLV(0x30)),
+						))
+						c.Write(result(id, 0x65, 0))
+					default:
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l, binds
+}
+
+func Test_berInt(t *testing.T) {
+	A := Assert.New(t)
+
+	for n, want := range map[int64][]byte{
+		0:    {0x02, 0x01, 0x00},
+		127:  {0x02, 0x01, 0x7f},
+		128:  {0x02, 0x02, 0x00, 0x80},
+		255:  {0x02, 0x02, 0x00, 0xff},
+		256:  {0x02, 0x02, 0x01, 0x00},
+		-1:   {0x02, 0x01, 0xff},
+		-129: {0x02, 0x02, 0xff, 0x7f},
+	} {
+		A.Equal(want, berInt(n), n)
+	}
+
+	// message ids past 127 stay positive
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	lc := &ldapConn{c: c1, id: 127}
+	go lc.send(berTLV(0x42))
+	_, msg, err := readBER(bufio.NewReader(c2))
+	A.NoError(err)
+	fields, err := parseBERSeq(msg)
+	A.NoError(err)
+	A.Equal([]byte{0x00, 0x80}, fields[0].value)
+
+	lc.id = math.MaxInt32
+	A.EqualValues(1, lc.nextID(), "wraps to 1")
+}
+
+func Test_mailpLdap(t *testing.T) {
+	A := Assert.New(t)
+
+	var err error
+
+	imapt, err := testStartImapServer(":1233", 20*time.Millisecond, nil)
+	if imapt != nil {
+		defer imapt.Close()
+	}
+	A.NoError(err, "start imap fail")
+
+	ldapl, binds := testStartLdap(t, "127.0.0.1:1239", map[string]string{
+		"uid=alice,ou=people,dc=example,dc=com": "secret",
+	})
+	defer ldapl.Close()
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &authHookRequest{}
+		A.NoError(json.NewDecoder(r.Body).Decode(req), "hook request")
+
+		if req.Username == "bob@example.com" && req.Password == "hooked" {
+			w.Write([]byte(`{"allow": true, "upstream": {"addr": "127.0.0.1:1233",
+				"auth": {"type": "plain", "username": "username", "password": "password"}}}`))
+			return
+		}
+		w.Write([]byte(`{"allow": false}`))
+	}))
+	defer hook.Close()
+
+	conf := &MailpConf{}
+	err = conf.Load(`
+imap:
+  addr: ":1234"
+  userStores:
+    - type: ldap
+      match: "*@example.com"
+      addr: 127.0.0.1:1239
+      bindDN: "uid={{.Local}},ou=people,dc=example,dc=com"
+      user:
+        upstream:
+          addr: 127.0.0.1:1233
+          auth:
+            type: plain
+            username: username
+            password: password
+    - type: ldap
+      match: "*@pass.example"
+      addr: 127.0.0.1:1239
+      bindDN: "uid={{.Local}},ou=people,dc=example,dc=com"
+      user:
+        upstream:
+          addr: 127.0.0.1:1233
+          auth:
+            type: passthrough
+  authHook:
+    url: ` + hook.URL + `
+`)
+	A.NoError(err, "load conf")
+
+	mp, err := testStartMailp(conf, 20*time.Millisecond)
+	if mp != nil {
+		defer mp.Stop()
+	}
+	A.NoError(err, "start mp fail")
+
+	login := func(username, password string) error {
+		c, err := client.Dial("127.0.0.1:1234")
+		A.NoError(err, "client.Dial")
+		defer c.Terminate()
+		return c.Login(username, password)
+	}
+
+	A.NoError(login("alice@example.com", "secret"), "alice")
+	A.Error(login("alice@example.com", "bad"), "bad password")
+	A.Error(login("alice@example.com", ""), "empty password")
+	A.Error(login("alice@other.example", "secret"), "not matched")
+	A.Error(login("alice,ou=admins@example.com", "secret"), "escaped dn")
+
+	// logins the directory does not have are left to the hook
+	A.NoError(login("bob@example.com", "hooked"), "bob from the hook")
+	A.Error(login("bob@example.com", "bad"), "bob bad password")
+
+	st := newLdapStore(&conf.Imap.UserStores[0])
+	_, name, err := st.LookupUser("alice@example.com")
+	A.NoError(err, "lookup alice")
+	A.Equal("alice@example.com", name)
+	_, _, err = st.LookupUser("bob@example.com")
+	A.Equal(errNoSuchUser, err, "lookup bob")
+
+	// passthrough users are bound too
+	n := binds.Load()
+	A.Error(login("alice@pass.example", "bad"), "passthrough bad password")
+	A.Equal(n+1, binds.Load(), "bound")
+}